@@ -15,6 +15,256 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/api/v1/devices": {
+            "get": {
+                "description": "devices connected to this instance from the oldest session to the newest",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "device"
+                ],
+                "summary": "connected devices",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Page number, starts from 1",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size, max 100",
+                        "name": "page_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with devices:read scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/tokeon-test-task_internal_dto.ArrayWithAmountResponse-internal_controllers_DevicePresenceDto"
+                        }
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/devices/{id}": {
+            "get": {
+                "description": "sessions of the device connected to this instance",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "device"
+                ],
+                "summary": "connected device",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Unique id of the device",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with devices:read scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.DevicePresenceDto"
+                        }
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Device is not connected",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/devices/{id}/connection": {
+            "delete": {
+                "description": "close every session of the device with the close frame, the device may be banned from reconnecting\nin cluster mode the device is disconnected and banned on every instance",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "device"
+                ],
+                "summary": "disconnect device",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Unique id of the device",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Close code, 1000 or 3000-4999, DISCONNECT_CLOSE_CODE by default",
+                        "name": "code",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Close reason, DISCONNECT_CLOSE_REASON by default",
+                        "name": "reason",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Period the device can't reconnect for, e.g. 10m",
+                        "name": "ban",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with admin scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Device is not connected",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/devices/{id}/messages": {
+            "get": {
+                "description": "messages sent to the device from the newest to the oldest with its delivery status",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "message"
+                ],
+                "summary": "device messages history",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Unique id of the device",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page number, starts from 1",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size, max 100",
+                        "name": "page_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with devices:read scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/tokeon-test-task_internal_dto.ArrayWithAmountResponse-internal_controllers_MessageRecordDto"
+                        }
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "501": {
+                        "description": "Not Implemented",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
         "/api/v1/health-check": {
             "get": {
                 "description": "health check",
@@ -38,40 +288,572 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/send": {
-            "post": {
-                "description": "send message to the device with id in body or to lthe all devices if id is not provided in body",
-                "consumes": [
-                    "application/json"
-                ],
+        "/api/v1/messages": {
+            "get": {
+                "description": "sent messages from the newest to the oldest with their delivery status",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "message"
+                ],
+                "summary": "messages history",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Page number, starts from 1",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size, max 100",
+                        "name": "page_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with devices:read scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/tokeon-test-task_internal_dto.ArrayWithAmountResponse-internal_controllers_MessageRecordDto"
+                        }
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "501": {
+                        "description": "Not Implemented",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/messages/{id}": {
+            "get": {
+                "description": "delivery status of the message for every target device",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "message"
+                ],
+                "summary": "message delivery status",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Id of the message returned by send",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with devices:read scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.MessageStatusResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/poll/{id}": {
+            "get": {
+                "description": "long-polling transport for the clients that can make plain http requests only\nthe request is held until there are messages or the wait expires, the device counts as connected\nwhile the poll is outstanding and for POLL_GRACE after it, messages sent in between wait for the next poll\ncursor of the response must be passed to the next poll, messages after it are returned again\nif the previous response has been lost and they are kept for REPLAY_TTL\na newer poll of the device ends the outstanding one with no messages\nthe device of the tenant polls /api/v1/{tenant}/poll/{id} the same way as it connects to the websocket",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "device"
+                ],
+                "summary": "poll messages of the device",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Unique id of the polling device",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "How long to wait for the message, e.g. 30s, POLL_WAIT by default",
+                        "name": "wait",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor of the previous response",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Token of the device, may be passed in Authorization header",
+                        "name": "token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.PollResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Id, wait or cursor is not valid or the device is connected by another transport",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Token is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Device is banned",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Tenant not found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Tenant has reached TENANT_MAX_DEVICES",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/scheduled/{id}": {
+            "get": {
+                "description": "state of the message scheduled by send with send_at or delay\nsent and failed messages are available while their delivery status is kept",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduled"
+                ],
+                "summary": "scheduled message",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Id of the scheduled message returned by send",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with devices:read scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ScheduledMessageDto"
+                        }
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "cancel the message that has not been sent yet\nthe key needs send:device scope for the message to the devices and send:broadcast for the rest",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduled"
+                ],
+                "summary": "cancel scheduled message",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Id of the scheduled message returned by send",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with send:device or send:broadcast scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope of the message target",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Message has already been sent",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/send": {
+            "post": {
+                "description": "send message to the device with id in body or to lthe all devices if id is not provided in body\nmessages to the offline device are queued and delivered when it reconnects\nif topic is provided the message is sent only to the devices subscribed to it\nwith device_ids the message is sent to every listed device, offline ones get it in the mailbox\nand are reported as not found if the mailbox is disabled\nexclude_device_ids are skipped by broadcasts, topic and device_ids messages\nbinary data is accepted as application/octet-stream body with device_id, topic and type\nin query or as multipart body with \"metadata\" json part and \"data\" part\nmessage that has not been written to the connection within ttl or SEND_TIMEOUT if ttl is not set\nis expired, messages of the offline device wait in the mailbox for ttl or MAILBOX_MAX_AGE\nmessages wait for the connection in the outbox of OUTBOUND_QUEUE_SIZE, when it is full\nOUTBOUND_POLICY drops the oldest or the new message, disconnects the slow device or blocks\nwith send_at or delay the message is scheduled and 202 with the scheduled message is returned,\nttl of the scheduled message counts from the time it is sent\nwith report the response has outcome of the message on the targets and the request fails\nonly if the message can't be accepted, without report it fails if the message has reached no target\nthe device is reported delivered once the message is written to its connection and accepted while\nthe message waits in the outbox, the delivery status has the final outcome of the accepted message",
+                "consumes": [
+                    "application/json",
+                    "application/octet-stream",
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "sender"
+                ],
+                "summary": "send message to the devices",
+                "parameters": [
+                    {
+                        "description": "Data",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.SendBodyDto"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Target device of the binary message",
+                        "name": "device_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Target topic of the binary message",
+                        "name": "topic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Type of the binary message",
+                        "name": "type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "TTL of the binary message",
+                        "name": "ttl",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time to send the binary message at",
+                        "name": "send_at",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Delay of the binary message",
+                        "name": "delay",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Return delivery report",
+                        "name": "report",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with send:device or send:broadcast scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.SendResponse"
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ScheduledMessageDto"
+                        }
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope, send:broadcast is required for topic and all devices",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Outbox of every target device is full",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Message has expired before the device accepted it",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/send/batch": {
+            "post": {
+                "description": "send many distinct messages in one request, every item is the body of /send without binary data\nitems are validated and sent concurrently, one failed item doesn't fail the others\nresults are in the order of the items, status of the result is the one /send would have responded with",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "sender"
+                ],
+                "summary": "send batch of messages",
+                "parameters": [
+                    {
+                        "description": "Data",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.SendBatchBodyDto"
+                        }
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Return delivery report of every message",
+                        "name": "report",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key of the client with send:device or send:broadcast scope",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/tokeon-test-task_internal_dto.ArrayResponse-internal_controllers_SendBatchResultDto"
+                        }
+                    },
+                    "401": {
+                        "description": "API key is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key doesn't have the scope, send:broadcast is required for topic and all devices",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/sse/{id}": {
+            "get": {
+                "description": "open connect via server-sent events for the clients that can't use websocket\nevery message is written as \"message\" event with the envelope or bare text for format=raw,\nbinary data follows in \"binary\" event encoded with base64, id of the event is id of the message\nreconnecting client sending Last-Event-ID header or last_event_id query parameter gets messages\nit has missed if they are kept for REPLAY_TTL, comment is written every SSE_KEEP_ALIVE\nstream closed by the server ends with \"close\" event with the code and reason\nthe connection is registered the same way as the websocket one and follows SESSION_POLICY\nthe device of the tenant connects to /api/v1/{tenant}/sse/{id} the same way as to the websocket",
                 "produces": [
-                    "application/json"
+                    "text/event-stream"
                 ],
                 "tags": [
-                    "sender"
+                    "device"
                 ],
-                "summary": "send message to the devices",
+                "summary": "open connect via server-sent events",
                 "parameters": [
                     {
-                        "description": "Data",
-                        "name": "body",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/internal_controllers.SendBodyDto"
-                        }
+                        "type": "string",
+                        "description": "Unique id of the connecting device",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "enum": [
+                            "envelope",
+                            "raw"
+                        ],
+                        "type": "string",
+                        "description": "Format of the messages",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Id of the last received message",
+                        "name": "Last-Event-ID",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Id of the last received message",
+                        "name": "last_event_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Token of the device, may be passed in Authorization header",
+                        "name": "token",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK"
+                    },
+                    "400": {
+                        "description": "Id is not valid or the device is already connected",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Token is missing or invalid",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Device is banned",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Tenant not found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Tenant has reached TENANT_MAX_DEVICES",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controllers.ErrorResponse"
+                        }
                     }
                 }
             }
         },
         "/api/v1/ws/{id}": {
             "get": {
-                "description": "open connect via websocket",
+                "description": "open connect via websocket\nmessages are written as json envelopes, legacy clients may request bare text\nwith \"raw\" websocket subprotocol or format=raw query parameter\nbinary messages are written as binary frames, in the envelope format the frame\nfollows the envelope with \"binary\" field set to size of the data\nframes of the device other than ack, subscribe and unsubscribe are posted to the upstream webhooks\nsubscriptions belong to the device, subscribe and unsubscribe of one session apply to all its sessions\na connected device connecting again is rejected, replaces the old connection closed with 4409\nor gets another session receiving the same messages depending on SESSION_POLICY\nthe device is pinged every HEARTBEAT_PING_INTERVAL and disconnected if it doesn't answer within\nHEARTBEAT_PONG_TIMEOUT, connection without messages for HEARTBEAT_IDLE_TIMEOUT is closed with 1000\nif JWT_KEYS are set the device passes the token with sub claim equal to its id in token query parameter,\n\"bearer.\u003ctoken\u003e\" subprotocol or Authorization header, the connection without valid token is closed with 4401\nthe device connects to the tenant of /api/v1/{tenant}/ws/{id} or of the tenant claim of the token,\nthey must be the same if both are set, and to TENANT_DEFAULT without either\nthe token without the tenant claim is issued for TENANT_DEFAULT only",
                 "consumes": [
                     "application/json"
                 ],
@@ -89,6 +871,22 @@ const docTemplate = `{
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "enum": [
+                            "envelope",
+                            "raw"
+                        ],
+                        "type": "string",
+                        "description": "Format of the messages",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Token of the device",
+                        "name": "token",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -100,17 +898,440 @@ const docTemplate = `{
         }
     },
     "definitions": {
-        "internal_controllers.SendBodyDto": {
+        "internal_controllers.DeliveryStatusDto": {
+            "type": "object",
+            "properties": {
+                "device_id": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "pending",
+                        "delivered",
+                        "acked",
+                        "expired"
+                    ]
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controllers.DevicePresenceDto": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "string"
+                },
+                "sessions": {
+                    "description": "Sessions - live connections of the device from the oldest to the newest",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controllers.SessionPresenceDto"
+                    }
+                }
+            }
+        },
+        "internal_controllers.ErrorResponse": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controllers.MessageRecordDto": {
+            "type": "object",
+            "properties": {
+                "binary_size": {
+                    "description": "BinarySize - size of the binary data, the data itself is not kept",
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "deliveries": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controllers.DeliveryStatusDto"
+                    }
+                },
+                "device_id": {
+                    "description": "DeviceID - target device, null for broadcasts",
+                    "type": "string"
+                },
+                "device_ids": {
+                    "description": "DeviceIDs - target devices, omitted if the message is not sent to the device list",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "exclude_device_ids": {
+                    "description": "ExcludeDeviceIDs - devices that haven't received the message",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "headers": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "string"
+                },
+                "payload": {
+                    "type": "object"
+                },
+                "sender": {
+                    "type": "string"
+                },
+                "text": {
+                    "type": "string"
+                },
+                "topic": {
+                    "description": "Topic - target topic, omitted for direct messages and broadcasts",
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controllers.MessageStatusResponse": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "deliveries": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controllers.DeliveryStatusDto"
+                    }
+                },
+                "id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controllers.PollCloseDto": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "integer"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controllers.PollMessageDto": {
+            "type": "object",
+            "properties": {
+                "binary": {
+                    "description": "Binary - binary data of the message encoded with base64",
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "envelope": {
+                    "description": "Envelope - the message in the format written to the websocket",
+                    "type": "object"
+                }
+            }
+        },
+        "internal_controllers.PollResponse": {
+            "type": "object",
+            "properties": {
+                "close": {
+                    "description": "Close - set if the server has closed the session, the next poll connects again",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/internal_controllers.PollCloseDto"
+                        }
+                    ]
+                },
+                "cursor": {
+                    "description": "Cursor - id of the last message to pass to the next poll",
+                    "type": "string"
+                },
+                "messages": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controllers.PollMessageDto"
+                    }
+                }
+            }
+        },
+        "internal_controllers.ScheduledMessageDto": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "device_id": {
+                    "description": "DeviceID - target device, null for topics and broadcasts",
+                    "type": "string"
+                },
+                "device_ids": {
+                    "description": "DeviceIDs - target devices, omitted if the message is not sent to the device list",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "error": {
+                    "description": "Error - why the message has failed",
+                    "type": "string"
+                },
+                "exclude_device_ids": {
+                    "description": "ExcludeDeviceIDs - devices that don't receive the message",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "description": "ID of the scheduled message, not of the sent one",
+                    "type": "string"
+                },
+                "message_id": {
+                    "description": "MessageID - id of the sent message to check its delivery status",
+                    "type": "string"
+                },
+                "send_at": {
+                    "type": "string"
+                },
+                "state": {
+                    "type": "string",
+                    "enum": [
+                        "pending",
+                        "sent",
+                        "failed"
+                    ]
+                },
+                "topic": {
+                    "description": "Topic - target topic, omitted for direct messages and broadcasts",
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controllers.SendBatchBodyDto": {
             "type": "object",
             "required": [
-                "text"
+                "items"
             ],
             "properties": {
+                "items": {
+                    "description": "Items - messages of the batch, each is validated and sent as the body of /send",
+                    "type": "array",
+                    "minItems": 1,
+                    "items": {
+                        "$ref": "#/definitions/internal_controllers.SendBodyDto"
+                    }
+                },
+                "report": {
+                    "description": "Report - return delivery report of every message",
+                    "type": "boolean"
+                }
+            }
+        },
+        "internal_controllers.SendBatchResultDto": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "description": "Error - why the message has failed",
+                    "type": "string"
+                },
+                "message": {
+                    "$ref": "#/definitions/internal_controllers.SendResponse"
+                },
+                "scheduled": {
+                    "$ref": "#/definitions/internal_controllers.ScheduledMessageDto"
+                },
+                "status": {
+                    "description": "Status - status /send would have responded with to the message",
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controllers.SendBodyDto": {
+            "type": "object",
+            "properties": {
+                "delay": {
+                    "description": "Delay - send the message after the delay, e.g. 10m",
+                    "type": "string",
+                    "example": "10m"
+                },
                 "device_id": {
                     "type": "string"
                 },
+                "device_ids": {
+                    "description": "DeviceIDs - send to the listed devices, can't be used with device_id and topic",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "exclude_device_ids": {
+                    "description": "ExcludeDeviceIDs - devices that don't receive the message, can't be used with device_id",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "headers": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "payload": {
+                    "description": "Payload - arbitrary json passed to the device as is",
+                    "type": "object"
+                },
+                "report": {
+                    "description": "Report - return what has happened to the message on every target",
+                    "type": "boolean"
+                },
+                "send_at": {
+                    "description": "SendAt - RFC 3339 time to send the message at, can't be used with delay",
+                    "type": "string",
+                    "example": "2030-01-02T15:04:05Z"
+                },
                 "text": {
                     "type": "string"
+                },
+                "topic": {
+                    "description": "Topic - send to the devices subscribed to the topic, can't be used with device_id",
+                    "type": "string",
+                    "maxLength": 256
+                },
+                "ttl": {
+                    "description": "TTL - how long the message may wait for delivery including the time in the mailbox\nof the offline device, e.g. 30s or 1h. The request waits for connected devices\nto accept the message up to ttl",
+                    "type": "string",
+                    "example": "30s"
+                },
+                "type": {
+                    "description": "Type - kind of the message for the device, e.g. notification or command",
+                    "type": "string",
+                    "maxLength": 64
+                }
+            }
+        },
+        "internal_controllers.SendReportDto": {
+            "type": "object",
+            "properties": {
+                "accepted": {
+                    "description": "Accepted - waits in the outbox of the device connection, may still expire or be dropped",
+                    "type": "integer"
+                },
+                "delivered": {
+                    "description": "Delivered - written to the device connection",
+                    "type": "integer"
+                },
+                "devices": {
+                    "description": "Devices - outcome of every target device, omitted for broadcasts: delivered, accepted,\nqueued, forwarded, timed_out, dropped or not_found",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "dropped": {
+                    "description": "Dropped - rejected by the full outbox of the connection",
+                    "type": "integer"
+                },
+                "forwarded": {
+                    "description": "Forwarded - passed to the instance the device is connected to",
+                    "type": "integer"
+                },
+                "not_found": {
+                    "description": "NotFound - device is offline and the mailbox is disabled",
+                    "type": "integer"
+                },
+                "queued": {
+                    "description": "Queued - kept in the mailbox of the offline device",
+                    "type": "integer"
+                },
+                "targets": {
+                    "type": "integer"
+                },
+                "timed_out": {
+                    "description": "TimedOut - not accepted by the connection within ttl or SEND_TIMEOUT",
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controllers.SendResponse": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "description": "ID of the message to check its delivery status",
+                    "type": "string"
+                },
+                "report": {
+                    "description": "Report - set if requested",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/internal_controllers.SendReportDto"
+                        }
+                    ]
+                }
+            }
+        },
+        "internal_controllers.SessionPresenceDto": {
+            "type": "object",
+            "properties": {
+                "connected_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "inbound_count": {
+                    "type": "integer"
+                },
+                "last_inbound_at": {
+                    "description": "LastInboundAt - last message from the device, null if none",
+                    "type": "string"
+                },
+                "last_outbound_at": {
+                    "description": "LastOutboundAt - last message written to the device, null if none",
+                    "type": "string"
+                },
+                "outbound_count": {
+                    "type": "integer"
+                },
+                "remote_ip": {
+                    "type": "string"
+                },
+                "transport": {
+                    "enum": [
+                        "websocket",
+                        "sse",
+                        "poll",
+                        "grpc"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/tokeon-test-task_internal_services_device.Transport"
+                        }
+                    ]
+                },
+                "user_agent": {
+                    "type": "string"
                 }
             }
         },
@@ -121,6 +1342,60 @@ const docTemplate = `{
                     "type": "string"
                 }
             }
+        },
+        "tokeon-test-task_internal_dto.ArrayResponse-internal_controllers_SendBatchResultDto": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controllers.SendBatchResultDto"
+                    }
+                }
+            }
+        },
+        "tokeon-test-task_internal_dto.ArrayWithAmountResponse-internal_controllers_DevicePresenceDto": {
+            "type": "object",
+            "properties": {
+                "count": {
+                    "type": "integer"
+                },
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controllers.DevicePresenceDto"
+                    }
+                }
+            }
+        },
+        "tokeon-test-task_internal_dto.ArrayWithAmountResponse-internal_controllers_MessageRecordDto": {
+            "type": "object",
+            "properties": {
+                "count": {
+                    "type": "integer"
+                },
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controllers.MessageRecordDto"
+                    }
+                }
+            }
+        },
+        "tokeon-test-task_internal_services_device.Transport": {
+            "type": "string",
+            "enum": [
+                "websocket",
+                "sse",
+                "poll",
+                "grpc"
+            ],
+            "x-enum-varnames": [
+                "TransportWebsocket",
+                "TransportSSE",
+                "TransportPoll",
+                "TransportGRPC"
+            ]
         }
     }
 }`
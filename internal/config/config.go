@@ -1,9 +1,16 @@
 package config
 
 import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
 	"tokeon-test-task/pkg/hc"
+	"tokeon-test-task/pkg/webhook"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
 )
 
 type Config struct {
@@ -11,7 +18,224 @@ type Config struct {
 	ApiAddr     string `json:"API_ADDR" default:"localhost:8080"`
 	ServiceName string `json:"SERVICE_NAME" default:"tokeon-test-task"`
 	Port        int    `json:"PORT" default:"8080"`
+	// GRPCPort - port of the grpc api, the api is disabled while it is 0
+	GRPCPort    int `json:"GRPC_PORT" default:"0"`
 	HealthCheck hc.Config
+	Mailbox     MailboxConfig
+	// MessageStatusTTL - how long delivery status of the sent message is available
+	MessageStatusTTL time.Duration `json:"MESSAGE_STATUS_TTL" default:"24h"`
+	Cluster          ClusterConfig
+	Postgres         PostgresConfig
+	// SendTimeout - how long the message without ttl may wait for the connection of the device
+	SendTimeout time.Duration `json:"SEND_TIMEOUT" default:"10s"`
+	// MessageMaxTTL - max ttl of the message the sender may request
+	MessageMaxTTL time.Duration `json:"MESSAGE_MAX_TTL" default:"24h"`
+	// MaxBinarySize - max size of the binary message in bytes
+	MaxBinarySize int64 `json:"MAX_BINARY_SIZE" default:"16777216"`
+	Upstream      UpstreamConfig
+	Events        EventsConfig
+	Scheduler     SchedulerConfig
+	Disconnect    DisconnectConfig
+	// SessionPolicy - what happens when the connected device connects again:
+	// reject the new connection, takeover by the new connection or multi sessions
+	SessionPolicy string `json:"SESSION_POLICY" default:"reject"`
+	Heartbeat     HeartbeatConfig
+	Outbound      OutboundConfig
+	Batch         BatchConfig
+	Replay        ReplayConfig
+	SSE           SSEConfig
+	Poll          PollConfig
+	JWT           JWTConfig
+	API           APIConfig
+	Tenant        TenantConfig
+}
+
+// MailboxConfig - limits of the queue that keeps messages for offline devices
+type MailboxConfig struct {
+	// MaxSize - max amount of messages stored per device, 0 disables mailbox
+	MaxSize int `json:"MAILBOX_MAX_SIZE" default:"100"`
+	// MaxAge - how long a message may wait for the device to reconnect
+	MaxAge time.Duration `json:"MAILBOX_MAX_AGE" default:"1h"`
+}
+
+// ClusterConfig - settings of running several instances that share devices through redis
+type ClusterConfig struct {
+	Enabled       bool   `json:"CLUSTER_ENABLED"`
+	RedisAddr     string `json:"CLUSTER_REDIS_ADDR" default:"localhost:6379"`
+	RedisPassword string `json:"CLUSTER_REDIS_PASSWORD"`
+	RedisDB       int    `json:"CLUSTER_REDIS_DB"`
+	// KeyPrefix - prefix of the redis keys and channels
+	KeyPrefix string `json:"CLUSTER_KEY_PREFIX" default:"tokeon"`
+	// NodeID - unique id of the instance, random if empty
+	NodeID string `json:"CLUSTER_NODE_ID"`
+	// PresenceTTL - how long the device stays online after its instance has gone
+	PresenceTTL time.Duration `json:"CLUSTER_PRESENCE_TTL" default:"30s"`
+}
+
+// PostgresConfig - storage of the message history
+type PostgresConfig struct {
+	// DSN - connection string, history is disabled if empty
+	DSN string `json:"POSTGRES_DSN"`
+	// HistoryBuffer - max amount of delivery updates waiting to be written
+	HistoryBuffer int `json:"POSTGRES_HISTORY_BUFFER" default:"4096"`
+}
+
+// UpstreamConfig - webhooks receiving messages sent by the devices
+type UpstreamConfig struct {
+	// Urls - comma separated webhooks, upstream is disabled if empty
+	Urls []string `json:"UPSTREAM_URLS"`
+	// Secret - key of HMAC-SHA256 signature of the requests
+	Secret string `json:"UPSTREAM_SECRET"`
+	// BufferSize - max amount of messages waiting to be posted per webhook
+	BufferSize      int           `json:"UPSTREAM_BUFFER_SIZE" default:"1024"`
+	MaxRetries      int           `json:"UPSTREAM_MAX_RETRIES" default:"5"`
+	RetryBackoff    time.Duration `json:"UPSTREAM_RETRY_BACKOFF" default:"500ms"`
+	MaxRetryBackoff time.Duration `json:"UPSTREAM_MAX_RETRY_BACKOFF" default:"30s"`
+	Timeout         time.Duration `json:"UPSTREAM_TIMEOUT" default:"10s"`
+}
+
+// EventsConfig - webhooks receiving connection and delivery events
+type EventsConfig struct {
+	// Urls - comma separated webhooks, events are disabled if empty
+	Urls []string `json:"EVENTS_URLS"`
+	// Types - comma separated types of the posted events, all events if empty
+	Types []string `json:"EVENTS_TYPES"`
+	// Secret - key of HMAC-SHA256 signature of the requests
+	Secret string `json:"EVENTS_SECRET"`
+	// BufferSize - max amount of events waiting to be posted per webhook
+	BufferSize      int           `json:"EVENTS_BUFFER_SIZE" default:"1024"`
+	MaxRetries      int           `json:"EVENTS_MAX_RETRIES" default:"5"`
+	RetryBackoff    time.Duration `json:"EVENTS_RETRY_BACKOFF" default:"500ms"`
+	MaxRetryBackoff time.Duration `json:"EVENTS_MAX_RETRY_BACKOFF" default:"30s"`
+	Timeout         time.Duration `json:"EVENTS_TIMEOUT" default:"10s"`
+}
+
+// SchedulerConfig - messages sent at the requested time
+type SchedulerConfig struct {
+	// StorePath - directory the scheduled messages are kept in, one file per message, they
+	// are lost on restart if empty. The file of the previous versions is moved to the directory
+	StorePath string `json:"SCHEDULER_STORE_PATH" default:"data/scheduled"`
+	// MaxDelay - how far in the future the message may be scheduled
+	MaxDelay time.Duration `json:"SCHEDULER_MAX_DELAY" default:"720h"`
+}
+
+// HeartbeatConfig - liveness checks of the device connections
+type HeartbeatConfig struct {
+	// PingInterval - how often the device is pinged
+	PingInterval time.Duration `json:"HEARTBEAT_PING_INTERVAL" default:"30s"`
+	// PongTimeout - how long the device may take to answer the ping
+	PongTimeout time.Duration `json:"HEARTBEAT_PONG_TIMEOUT" default:"10s"`
+	// IdleTimeout - connection without messages in both directions is closed, 0 disables
+	IdleTimeout time.Duration `json:"HEARTBEAT_IDLE_TIMEOUT" default:"0"`
+	// HandshakeTimeout - how long the websocket upgrade may take
+	HandshakeTimeout time.Duration `json:"HEARTBEAT_HANDSHAKE_TIMEOUT" default:"10s"`
+}
+
+// OutboundConfig - queue of the messages waiting to be written to the device connection
+type OutboundConfig struct {
+	// QueueSize - max amount of messages queued per connection
+	QueueSize int `json:"OUTBOUND_QUEUE_SIZE" default:"256"`
+	// Policy - what happens to the message when the queue is full: drop_oldest, drop_newest,
+	// disconnect the slow device or block until there is space
+	Policy string `json:"OUTBOUND_POLICY" default:"disconnect"`
+	// BlockTimeout - how long the sender waits for space with block policy
+	BlockTimeout time.Duration `json:"OUTBOUND_BLOCK_TIMEOUT" default:"1s"`
+}
+
+// BatchConfig - limits of the batch send
+type BatchConfig struct {
+	// MaxSize - max amount of messages in the batch
+	MaxSize int `json:"BATCH_MAX_SIZE" default:"1000"`
+	// Concurrency - how many messages of the batch are sent at once
+	Concurrency int `json:"BATCH_CONCURRENCY" default:"64"`
+}
+
+// ReplayConfig - messages kept for the clients resuming the stream, e.g. by Last-Event-ID
+type ReplayConfig struct {
+	// Size - max amount of messages kept per device, 0 disables resume
+	Size int `json:"REPLAY_SIZE" default:"100"`
+	// TTL - how long the message is kept after it has been sent
+	TTL time.Duration `json:"REPLAY_TTL" default:"5m"`
+}
+
+// SSEConfig - server-sent events transport
+type SSEConfig struct {
+	// KeepAlive - how often the comment is written to the idle stream
+	KeepAlive time.Duration `json:"SSE_KEEP_ALIVE" default:"15s"`
+}
+
+// PollConfig - long-polling transport
+type PollConfig struct {
+	// Wait - how long the poll is held if the client hasn't set it
+	Wait time.Duration `json:"POLL_WAIT" default:"30s"`
+	// MaxWait - max wait the client may request
+	MaxWait time.Duration `json:"POLL_MAX_WAIT" default:"60s"`
+	// Grace - how long the device stays connected after the poll has returned
+	Grace time.Duration `json:"POLL_GRACE" default:"30s"`
+}
+
+// JWTConfig - tokens the devices connect with
+type JWTConfig struct {
+	// Keys - comma separated keys as kid:alg:key, the key is the secret for HS256 and path
+	// to the PEM public key for RS256 and EdDSA, e.g. main:HS256:secret,next:RS256:/keys/next.pem.
+	// Devices connect without tokens if empty
+	Keys []string `json:"JWT_KEYS"`
+	// Issuer - required iss claim if set
+	Issuer string `json:"JWT_ISSUER"`
+	// Audience - required aud claim if set
+	Audience string `json:"JWT_AUDIENCE"`
+	// Leeway - allowed clock skew of exp and nbf claims
+	Leeway time.Duration `json:"JWT_LEEWAY" default:"30s"`
+}
+
+// APIConfig - keys of the api clients, the api is open if none are set
+type APIConfig struct {
+	// Keys - comma separated keys as name:key:scopes, scopes are separated by |,
+	// e.g. backend:secret:send:device|devices:read. The name may be prefixed with the
+	// tenant of the key as tenant/name, the key belongs to the default tenant otherwise
+	Keys []string `json:"API_KEYS"`
+	// KeysFile - json file with the keys as
+	// [{"name":"...","tenant":"...","key_sha256":"<hex>","scopes":["admin"]}]
+	KeysFile string `json:"API_KEYS_FILE"`
+}
+
+// tenantName - tenant is a part of the path, so it is restricted to the safe characters
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// TenantConfig - tenants sharing the deployment, devices and senders of one tenant don't
+// see the others
+type TenantConfig struct {
+	// Names - comma separated allowed tenants, any tenant is allowed if empty
+	Names []string `json:"TENANT_NAMES"`
+	// Default - tenant of the devices connecting without tenant and of the keys without it
+	Default string `json:"TENANT_DEFAULT" default:"default"`
+	// MaxDevices - max amount of devices of the tenant connected to the instance, 0 if unlimited
+	MaxDevices int `json:"TENANT_MAX_DEVICES" default:"0"`
+}
+
+// Allows reports whether the tenant may be used
+func (c TenantConfig) Allows(tenant string) bool {
+	if !tenantName.MatchString(tenant) {
+		return false
+	}
+
+	if len(c.Names) == 0 || tenant == c.Default {
+		return true
+	}
+
+	for _, name := range c.Names {
+		if name == tenant {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DisconnectConfig - defaults of the close frame written to the device disconnected by the api
+type DisconnectConfig struct {
+	CloseCode   int    `json:"DISCONNECT_CLOSE_CODE" default:"4000"`
+	CloseReason string `json:"DISCONNECT_CLOSE_REASON" default:"disconnected by server"`
 }
 
 // Validate config
@@ -20,5 +244,236 @@ func (c *Config) Validate() error {
 		c,
 		validation.Field(&c.ServiceName, validation.Required),
 		validation.Field(&c.Port, validation.Required),
+		validation.Field(&c.GRPCPort, validation.Min(0), validation.Max(65535)),
+		validation.Field(&c.Mailbox),
+		validation.Field(&c.MessageStatusTTL, validation.Min(time.Duration(0))),
+		validation.Field(&c.Cluster),
+		validation.Field(&c.Postgres),
+		validation.Field(&c.SendTimeout, validation.Required, validation.Min(time.Millisecond)),
+		validation.Field(&c.MessageMaxTTL, validation.Required, validation.Min(time.Second)),
+		validation.Field(&c.MaxBinarySize, validation.Required, validation.Min(int64(1))),
+		validation.Field(&c.Upstream),
+		validation.Field(&c.Events),
+		validation.Field(&c.Scheduler),
+		validation.Field(&c.Disconnect),
+		validation.Field(&c.SessionPolicy, validation.Required, validation.In("reject", "takeover", "multi")),
+		validation.Field(&c.Heartbeat),
+		validation.Field(&c.Outbound),
+		validation.Field(&c.Batch),
+		validation.Field(&c.Replay),
+		validation.Field(&c.SSE),
+		validation.Field(&c.Poll),
+		validation.Field(&c.JWT),
+		validation.Field(&c.API),
+		validation.Field(&c.Tenant),
+	)
+}
+
+// Validate mailbox config
+func (c MailboxConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.MaxSize, validation.Min(0)),
+		validation.Field(&c.MaxAge, validation.Min(time.Duration(0))),
+	)
+}
+
+// Validate cluster config
+func (c ClusterConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.RedisAddr, validation.When(c.Enabled, validation.Required)),
+		validation.Field(&c.KeyPrefix, validation.When(c.Enabled, validation.Required)),
+		validation.Field(&c.PresenceTTL, validation.When(c.Enabled, validation.Required, validation.Min(time.Second))),
+	)
+}
+
+// Validate postgres config
+func (c PostgresConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.HistoryBuffer, validation.When(c.DSN != "", validation.Required, validation.Min(1))),
+	)
+}
+
+// Validate upstream config
+func (c UpstreamConfig) Validate() error {
+	enabled := len(c.Urls) > 0
+
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.Urls, validation.Each(is.RequestURL)),
+		validation.Field(&c.BufferSize, validation.When(enabled, validation.Required, validation.Min(1))),
+		validation.Field(&c.MaxRetries, validation.Min(0)),
+		validation.Field(&c.RetryBackoff, validation.When(enabled, validation.Required)),
+		validation.Field(&c.MaxRetryBackoff, validation.When(enabled, validation.Min(c.RetryBackoff))),
+		validation.Field(&c.Timeout, validation.When(enabled, validation.Required)),
+	)
+}
+
+// Webhook returns config of the upstream webhooks
+func (c UpstreamConfig) Webhook() webhook.Config {
+	return webhook.Config{
+		URLs:       c.Urls,
+		Secret:     c.Secret,
+		BufferSize: c.BufferSize,
+		MaxRetries: c.MaxRetries,
+		Backoff:    c.RetryBackoff,
+		MaxBackoff: c.MaxRetryBackoff,
+		Timeout:    c.Timeout,
+	}
+}
+
+// Validate events config
+func (c EventsConfig) Validate() error {
+	enabled := len(c.Urls) > 0
+
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.Urls, validation.Each(is.RequestURL)),
+		validation.Field(&c.Types, validation.Each(validation.In(
+			"device.connected", "device.disconnected", "message.delivered", "message.failed",
+		))),
+		validation.Field(&c.BufferSize, validation.When(enabled, validation.Required, validation.Min(1))),
+		validation.Field(&c.MaxRetries, validation.Min(0)),
+		validation.Field(&c.RetryBackoff, validation.When(enabled, validation.Required)),
+		validation.Field(&c.MaxRetryBackoff, validation.When(enabled, validation.Min(c.RetryBackoff))),
+		validation.Field(&c.Timeout, validation.When(enabled, validation.Required)),
+	)
+}
+
+// Webhook returns config of the event webhooks
+func (c EventsConfig) Webhook() webhook.Config {
+	return webhook.Config{
+		URLs:       c.Urls,
+		Secret:     c.Secret,
+		BufferSize: c.BufferSize,
+		MaxRetries: c.MaxRetries,
+		Backoff:    c.RetryBackoff,
+		MaxBackoff: c.MaxRetryBackoff,
+		Timeout:    c.Timeout,
+	}
+}
+
+// Validate scheduler config
+func (c SchedulerConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.MaxDelay, validation.Required, validation.Min(time.Second)),
+	)
+}
+
+// Validate heartbeat config
+func (c HeartbeatConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.PingInterval, validation.Required, validation.Min(time.Second)),
+		validation.Field(&c.PongTimeout, validation.Required, validation.Min(time.Millisecond)),
+		validation.Field(&c.IdleTimeout, validation.Min(time.Duration(0))),
+		validation.Field(&c.HandshakeTimeout, validation.Min(time.Duration(0))),
+	)
+}
+
+// Validate outbound config
+func (c OutboundConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.QueueSize, validation.Required, validation.Min(1)),
+		validation.Field(&c.Policy, validation.Required, validation.In("drop_oldest", "drop_newest", "disconnect", "block")),
+		validation.Field(&c.BlockTimeout, validation.When(c.Policy == "block", validation.Required, validation.Min(time.Millisecond))),
+	)
+}
+
+// Validate batch config
+func (c BatchConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.MaxSize, validation.Required, validation.Min(1)),
+		validation.Field(&c.Concurrency, validation.Required, validation.Min(1)),
+	)
+}
+
+// Validate replay config
+func (c ReplayConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.Size, validation.Min(0)),
+		validation.Field(&c.TTL, validation.When(c.Size > 0, validation.Required, validation.Min(time.Second))),
+	)
+}
+
+// Validate sse config
+func (c SSEConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.KeepAlive, validation.Required, validation.Min(time.Second)),
+	)
+}
+
+// Validate poll config
+func (c PollConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.Wait, validation.Min(time.Duration(0)), validation.Max(c.MaxWait)),
+		validation.Field(&c.MaxWait, validation.Required),
+		validation.Field(&c.Grace, validation.Required, validation.Min(time.Second)),
+	)
+}
+
+// Validate jwt config
+func (c JWTConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.Keys, validation.Each(validation.By(func(value interface{}) error {
+			parts := strings.SplitN(value.(string), ":", 3)
+			if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+				return errors.New("must be kid:alg:key")
+			}
+
+			return validation.Validate(parts[1], validation.In("HS256", "RS256", "EdDSA"))
+		}))),
+		validation.Field(&c.Leeway, validation.Min(time.Duration(0))),
+	)
+}
+
+// Validate api config
+func (c APIConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.Keys, validation.Each(validation.By(func(value interface{}) error {
+			parts := strings.SplitN(value.(string), ":", 3)
+			if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+				return errors.New("must be name:key:scopes")
+			}
+			if tenant, _, ok := strings.Cut(parts[0], "/"); ok && !tenantName.MatchString(tenant) {
+				return errors.New("tenant must be lowercase letters, digits, - and _")
+			}
+
+			scopes := make([]interface{}, 0)
+			for _, scope := range strings.Split(parts[2], "|") {
+				scopes = append(scopes, scope)
+			}
+
+			return validation.Validate(scopes, validation.Each(validation.In("send:device", "send:broadcast", "devices:read", "admin")))
+		}))),
+	)
+}
+
+// Validate tenant config
+func (c TenantConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.Names, validation.Each(validation.Match(tenantName))),
+		validation.Field(&c.Default, validation.Required, validation.Match(tenantName)),
+		validation.Field(&c.MaxDevices, validation.Min(0)),
+	)
+}
+
+// Validate disconnect config
+func (c DisconnectConfig) Validate() error {
+	return validation.ValidateStruct(
+		&c,
+		validation.Field(&c.CloseCode, validation.Required, validation.Min(3000), validation.Max(4999)),
+		validation.Field(&c.CloseReason, validation.Length(0, 123)),
 	)
 }
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cristalhq/aconfig"
+)
+
+func newTestLoader(cfg *Config) *aconfig.Loader {
+	return aconfig.LoaderFor(cfg, aconfig.Config{
+		AllowUnknownEnvs: true,
+		SkipFiles:        true,
+		SkipFlags:        true,
+	})
+}
+
+// Test every variable is read from the env named in its json tag
+func TestEnvNames(t *testing.T) {
+	newTestLoader(&Config{}).WalkFields(func(f aconfig.Field) bool {
+		tag := f.Tag("json")
+		if tag == "" {
+			return true
+		}
+
+		name := f.Tag("env")
+		for parent, ok := f.Parent(); ok; parent, ok = parent.Parent() {
+			name = parent.Tag("env") + "_" + name
+		}
+
+		if name != strings.Split(tag, ",")[0] {
+			t.Errorf("field %s is read from %s instead of %s", f.Name(), name, tag)
+		}
+
+		return true
+	})
+}
+
+// Test max ttl of the message is loaded from the environment
+func TestMessageMaxTTL(t *testing.T) {
+	t.Setenv("MESSAGE_MAX_TTL", "5m")
+
+	cfg := &Config{}
+	if err := newTestLoader(cfg).Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.MessageMaxTTL != 5*time.Minute {
+		t.Errorf("expected 5m, got %s", cfg.MessageMaxTTL)
+	}
+}
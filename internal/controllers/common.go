@@ -6,9 +6,32 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
+const (
+	defaultPageSize uint64 = 20
+	maxPageSize     uint64 = 100
+)
+
 type PageOptionsDto struct {
 	Page     *uint64 `validate:"omitempty,gte=1" query:"page" json:"page"`
-	PageSize *uint64 `validate:"omitempty,gte=1" query:"page_size" json:"pageSize"`
+	PageSize *uint64 `validate:"omitempty,gte=1,lte=100" query:"page_size" json:"pageSize"`
+}
+
+// GetPage returns requested page, the first one by default
+func (p PageOptionsDto) GetPage() uint64 {
+	if p.Page == nil {
+		return 1
+	}
+
+	return *p.Page
+}
+
+// GetPageSize returns requested page size limited by maxPageSize
+func (p PageOptionsDto) GetPageSize() uint64 {
+	if p.PageSize == nil {
+		return defaultPageSize
+	}
+
+	return min(*p.PageSize, maxPageSize)
 }
 
 type ErrorResponse struct {
@@ -1,23 +1,54 @@
 package controllers
 
 import (
+	"tokeon-test-task/internal/config"
 	"tokeon-test-task/pkg/log"
 
 	"github.com/go-playground/validator"
 )
 
 type Controllers struct {
-	common *Common
-	device *Device
-	sender *Sender
+	common    *Common
+	device    *Device
+	stream    *Stream
+	poll      *Poll
+	sender    *Sender
+	message   *Message
+	history   *History
+	scheduled *Scheduled
+	presence  *Presence
+	gateway   *Gateway
 }
 
-func New(log log.Logger, validator *validator.Validate, deviceService DeviceService, senderService SenderService) *Controllers {
-	return &Controllers{
-		common: NewCommon(),
-		device: NewDevice(log, deviceService),
-		sender: NewSender(validator, senderService),
+func New(
+	log log.Logger,
+	config *config.Config,
+	validator *validator.Validate,
+	deviceService DeviceService,
+	streamService StreamService,
+	senderService SenderService,
+	messageService MessageService,
+	historyService HistoryService,
+	upstreamService UpstreamService,
+	schedulerService SchedulerService,
+	presenceService PresenceService,
+	deviceAuthorizer DeviceAuthorizer,
+) *Controllers {
+	controllers := &Controllers{
+		common:    NewCommon(),
+		device:    NewDevice(log, config, deviceService, upstreamService),
+		stream:    NewStream(log, config, streamService),
+		poll:      NewPoll(log, config, streamService),
+		sender:    NewSender(config, validator, senderService, schedulerService),
+		message:   NewMessage(messageService),
+		history:   NewHistory(validator, historyService),
+		scheduled: NewScheduled(schedulerService),
+		presence:  NewPresence(config, validator, presenceService),
 	}
+
+	controllers.gateway = NewGateway(log, config, controllers.sender, controllers.presence, controllers.device, deviceAuthorizer)
+
+	return controllers
 }
 
 func (c *Controllers) Common() *Common {
@@ -28,6 +59,34 @@ func (c *Controllers) Device() *Device {
 	return c.device
 }
 
+func (c *Controllers) Stream() *Stream {
+	return c.stream
+}
+
+func (c *Controllers) Poll() *Poll {
+	return c.poll
+}
+
 func (c *Controllers) Sender() *Sender {
 	return c.sender
 }
+
+func (c *Controllers) Message() *Message {
+	return c.message
+}
+
+func (c *Controllers) History() *History {
+	return c.history
+}
+
+func (c *Controllers) Scheduled() *Scheduled {
+	return c.scheduled
+}
+
+func (c *Controllers) Presence() *Presence {
+	return c.presence
+}
+
+func (c *Controllers) Gateway() *Gateway {
+	return c.gateway
+}
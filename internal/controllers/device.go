@@ -2,33 +2,85 @@ package controllers
 
 import (
 	"context"
+	e "errors"
+	"net"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
 	"tokeon-test-task/pkg/log"
 
+	"github.com/goccy/go-json"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
 type DeviceService interface {
-	Register(id uuid.UUID) error
-	Get(id uuid.UUID) (<-chan string, error)
-	Close(id uuid.UUID) error
+	Register(id uuid.UUID, info device.ConnectionInfo) (*device.Session, error)
+	Drain(id uuid.UUID) []device.Message
+	Close(session *device.Session, reason device.DisconnectReason) error
+	Delivered(deviceID, messageID uuid.UUID) error
+	Ack(deviceID, messageID uuid.UUID) error
+	Subscribe(id uuid.UUID, topic string) error
+	Unsubscribe(id uuid.UUID, topic string) error
 }
 
+type UpstreamService interface {
+	Forward(deviceID uuid.UUID, tenant string, frame []byte, binary bool)
+}
+
+const (
+	frameTypeAck         = "ack"
+	frameTypeSubscribe   = "subscribe"
+	frameTypeUnsubscribe = "unsubscribe"
+)
+
+// deviceFrame is read from the device, e.g. {"type":"ack","id":"<message id>"}
+// or {"type":"subscribe","topic":"<topic>"}. Subscriptions belong to the device, so with
+// multi session policy subscribe and unsubscribe of one session apply to all of them
+type deviceFrame struct {
+	Type  string    `json:"type"`
+	ID    uuid.UUID `json:"id"`
+	Topic string    `json:"topic"`
+}
+
+// closeTimeout - how long writing of the close frame may take
+const closeTimeout = time.Second
+
+// incomingFrame is read from the websocket
+type incomingFrame struct {
+	data   []byte
+	binary bool
+}
+
+// unauthorizedFrame - close frame of the connection without valid token
+var unauthorizedFrame = device.CloseFrame{Code: 4401, Reason: "unauthorized"}
+
+// idleFrame - close frame of the connection closed by the idle timeout
+var idleFrame = device.CloseFrame{Code: websocket.CloseNormalClosure, Reason: "idle timeout"}
+
 type Device struct {
-	log           log.Logger
-	deviceService DeviceService
+	log             log.Logger
+	deviceService   DeviceService
+	upstreamService UpstreamService
+	heartbeat       config.HeartbeatConfig
 }
 
-func NewDevice(log log.Logger, deviceService DeviceService) *Device {
+func NewDevice(log log.Logger, config *config.Config, deviceService DeviceService, upstreamService UpstreamService) *Device {
 	return &Device{
 		log,
 		deviceService,
+		upstreamService,
+		config.Heartbeat,
 	}
 }
 
 func (d *Device) websocketCfg() *websocket.Config {
 	return &websocket.Config{
+		HandshakeTimeout: d.heartbeat.HandshakeTimeout,
+		Subprotocols:     []string{protocolEnvelope, protocolRaw},
 		RecoverHandler: func(conn *websocket.Conn) {
 			if err := recover(); err != nil {
 				conn.WriteJSON(fiber.Map{"error": "Internal Server Error"})
@@ -41,7 +93,24 @@ func (d *Device) websocketCfg() *websocket.Config {
 //
 //	@Summary		open connect via websocket
 //	@Description	open connect via websocket
+//	@Description	messages are written as json envelopes, legacy clients may request bare text
+//	@Description	with "raw" websocket subprotocol or format=raw query parameter
+//	@Description	binary messages are written as binary frames, in the envelope format the frame
+//	@Description	follows the envelope with "binary" field set to size of the data
+//	@Description	frames of the device other than ack, subscribe and unsubscribe are posted to the upstream webhooks
+//	@Description	subscriptions belong to the device, subscribe and unsubscribe of one session apply to all its sessions
+//	@Description	a connected device connecting again is rejected, replaces the old connection closed with 4409
+//	@Description	or gets another session receiving the same messages depending on SESSION_POLICY
+//	@Description	the device is pinged every HEARTBEAT_PING_INTERVAL and disconnected if it doesn't answer within
+//	@Description	HEARTBEAT_PONG_TIMEOUT, connection without messages for HEARTBEAT_IDLE_TIMEOUT is closed with 1000
+//	@Description	if JWT_KEYS are set the device passes the token with sub claim equal to its id in token query parameter,
+//	@Description	"bearer.<token>" subprotocol or Authorization header, the connection without valid token is closed with 4401
+//	@Description	the device connects to the tenant of /api/v1/{tenant}/ws/{id} or of the tenant claim of the token,
+//	@Description	they must be the same if both are set, and to TENANT_DEFAULT without either
+//	@Description	the token without the tenant claim is issued for TENANT_DEFAULT only
 //	@Param			id			path		string		true	"Unique id of the connecting device"
+//	@Param			format		query		string		false	"Format of the messages" Enums(envelope, raw)
+//	@Param			token		query		string		false	"Token of the device"
 //	@Tags			device
 //	@Accept			json
 //	@Produce		json
@@ -66,7 +135,33 @@ func (d *Device) Connect(ctx context.Context) fiber.Handler {
 			return
 		}
 
-		if err := d.deviceService.Register(id); err != nil {
+		if err, ok := c.Locals(middleware.DeviceAuthError).(error); ok {
+			if e.Is(err, errors.ErrUnauthorized) {
+				d.writeClose(c, unauthorizedFrame)
+				return
+			}
+
+			if err := c.WriteMessage(mt, []byte(err.Error())); err != nil {
+				d.log.Errorf("write: %v", err)
+			}
+
+			if err := c.Close(); err != nil {
+				d.log.Errorf("close: %v", err)
+			}
+
+			return
+		}
+
+		remoteIP, _ := c.Locals(middleware.WebsocketRemoteIP).(string)
+		tenant, _ := c.Locals(middleware.TenantLocal).(string)
+
+		session, err := d.deviceService.Register(id, device.ConnectionInfo{
+			RemoteIP:  remoteIP,
+			UserAgent: c.Headers(fiber.HeaderUserAgent),
+			Transport: device.TransportWebsocket,
+			Tenant:    tenant,
+		})
+		if err != nil {
 			if err := c.WriteMessage(mt, []byte(err.Error())); err != nil {
 				d.log.Errorf("write: %v", err)
 			}
@@ -78,51 +173,224 @@ func (d *Device) Connect(ctx context.Context) fiber.Handler {
 			return
 		}
 
-		received := make(chan []byte)
+		// legacy clients read bare text instead of envelopes
+		raw := c.Subprotocol() == protocolRaw || c.Query("format") == protocolRaw
+
+		// deliver messages sent while the device was offline
+		for _, msg := range d.deviceService.Drain(id) {
+			if err := d.write(c, session, msg, raw); err != nil {
+				d.log.Errorf("write: %v", err)
+				d.disconnect(session, device.DisconnectWriteError)
+				return
+			}
+		}
+
+		// the device must answer every ping before the next one is due
+		pongWait := d.heartbeat.PingInterval + d.heartbeat.PongTimeout
+		extendDeadline := func() error {
+			return c.SetReadDeadline(time.Now().Add(pongWait))
+		}
+
+		if err := extendDeadline(); err != nil {
+			d.log.Errorf("read deadline: %v", err)
+		}
+		c.SetPongHandler(func(string) error {
+			return extendDeadline()
+		})
+
+		received := make(chan incomingFrame)
+		done := make(chan struct{})
+		defer func() {
+			close(done)
+
+			// the connection is released when the handler returns, so the reader must be
+			// done with it by then. Closing the connection ends the blocked read
+			c.Close()
+			for range received {
+			}
+		}()
+
+		// readErr is set before received is closed
+		var readErr error
+
+		go func(message chan incomingFrame) {
+			defer close(message)
 
-		go func(ctx context.Context, message chan []byte) {
-			var (
-				msg []byte
-				err error
-			)
 			for {
-				if mt, msg, err = c.ReadMessage(); err != nil {
-					if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-						close(message)
-					} else {
-						d.log.Errorf("read: %v", err)
-					}
-					break
+				frameType, msg, err := c.ReadMessage()
+				if err != nil {
+					readErr = err
+					return
+				}
+
+				if err := extendDeadline(); err != nil {
+					readErr = err
+					return
 				}
 
-				message <- msg
+				select {
+				case message <- incomingFrame{data: msg, binary: frameType == websocket.BinaryMessage}:
+				case <-done:
+					return
+				}
 			}
-		}(ctx, received)
+		}(received)
 
-		ch, err := d.deviceService.Get(id)
-		if err != nil {
-			d.log.Errorf("failed to get device channel: %v", err)
-			return
+		ping := time.NewTicker(d.heartbeat.PingInterval)
+		defer ping.Stop()
+
+		// idle fires when there have been no messages for the idle timeout, nil if disabled
+		var idle <-chan time.Time
+		var idleTimer *time.Timer
+		if d.heartbeat.IdleTimeout > 0 {
+			idleTimer = time.NewTimer(d.heartbeat.IdleTimeout)
+			defer idleTimer.Stop()
+			idle = idleTimer.C
+		}
+
+		active := func() {
+			if idleTimer == nil {
+				return
+			}
+
+			if !idleTimer.Stop() {
+				select {
+				case <-idleTimer.C:
+				default:
+				}
+			}
+			idleTimer.Reset(d.heartbeat.IdleTimeout)
 		}
 
 		for {
 			select {
 			case msg, ok := <-received:
-				d.log.Infof("revieved message from device %s: %s", id, msg)
 				if !ok {
-					if err := d.deviceService.Close(id); err != nil {
-						d.log.Errorf("write: %v", err)
+					reason := device.DisconnectNormal
+
+					var netErr net.Error
+					switch {
+					case websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+					case e.As(readErr, &netErr) && netErr.Timeout():
+						d.log.Warnf("device %s has not answered the ping in %s", id, pongWait)
+						reason = device.DisconnectTimeout
+					default:
+						d.log.Errorf("read: %v", readErr)
+						reason = device.DisconnectReadError
 					}
+
+					d.disconnect(session, reason)
 					return
 				}
-			case msg := <-ch:
-				if err = c.WriteMessage(mt, []byte(msg)); err != nil {
+
+				active()
+				d.handleFrame(session, msg)
+			case msg := <-session.Messages():
+				if err = d.write(c, session, msg, raw); err != nil {
 					d.log.Errorf("write: %v", err)
+					d.disconnect(session, device.DisconnectWriteError)
 					return
 				}
+
+				active()
+			case <-ping.C:
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(d.heartbeat.PongTimeout)); err != nil {
+					d.log.Errorf("ping: %v", err)
+					d.disconnect(session, device.DisconnectWriteError)
+					return
+				}
+			case <-idle:
+				d.log.Infof("device %s has been idle for %s", id, d.heartbeat.IdleTimeout)
+				d.disconnect(session, device.DisconnectIdle)
+				d.writeClose(c, idleFrame)
+				return
+			case frame := <-session.Closed():
+				// session has been closed by the server and is already unregistered
+				d.writeClose(c, frame)
+				return
 			case <-ctx.Done():
+				d.disconnect(session, device.DisconnectShutdown)
 				return
 			}
 		}
 	}, *d.websocketCfg())
 }
+
+func (d *Device) write(c *websocket.Conn, session *device.Session, msg device.Message, raw bool) error {
+	frame, err := encodeMessage(msg, raw)
+	if err != nil {
+		return err
+	}
+
+	if frame != nil {
+		if err := c.WriteMessage(websocket.TextMessage, frame); err != nil {
+			return err
+		}
+	}
+
+	if msg.Binary != nil {
+		if err := c.WriteMessage(websocket.BinaryMessage, msg.Binary); err != nil {
+			return err
+		}
+	}
+
+	session.CountOutbound()
+
+	if err := d.deviceService.Delivered(session.DeviceID, msg.ID); err != nil {
+		d.log.Warnf("failed to mark message %s delivered to device %s: %v", msg.ID, session.DeviceID, err)
+	}
+
+	return nil
+}
+
+// writeClose writes the close frame, the connection is closed by the caller
+func (d *Device) writeClose(c *websocket.Conn, frame device.CloseFrame) {
+	message := websocket.FormatCloseMessage(frame.Code, frame.Reason)
+	if err := c.WriteControl(websocket.CloseMessage, message, time.Now().Add(closeTimeout)); err != nil {
+		d.log.Errorf("close: %v", err)
+	}
+}
+
+func (d *Device) disconnect(session *device.Session, reason device.DisconnectReason) {
+	if err := d.deviceService.Close(session, reason); err != nil {
+		d.log.Errorf("close: %v", err)
+	}
+}
+
+// handleFrame applies control frames and passes the rest to upstream
+func (d *Device) handleFrame(session *device.Session, msg incomingFrame) {
+	session.CountInbound()
+
+	id := session.DeviceID
+
+	if msg.binary {
+		d.upstreamService.Forward(id, session.Tenant, msg.data, true)
+		return
+	}
+
+	var frame deviceFrame
+	if err := json.Unmarshal(msg.data, &frame); err != nil {
+		d.upstreamService.Forward(id, session.Tenant, msg.data, false)
+		return
+	}
+
+	switch frame.Type {
+	case frameTypeAck:
+		if err := d.deviceService.Ack(id, frame.ID); err != nil {
+			d.log.Warnf("failed to ack message %s from device %s: %v", frame.ID, id, err)
+		}
+	case frameTypeSubscribe:
+		if frame.Topic == "" {
+			return
+		}
+		if err := d.deviceService.Subscribe(id, frame.Topic); err != nil {
+			d.log.Warnf("failed to subscribe device %s to %s: %v", id, frame.Topic, err)
+		}
+	case frameTypeUnsubscribe:
+		if err := d.deviceService.Unsubscribe(id, frame.Topic); err != nil {
+			d.log.Warnf("failed to unsubscribe device %s from %s: %v", id, frame.Topic, err)
+		}
+	default:
+		d.upstreamService.Forward(id, session.Tenant, msg.data, false)
+	}
+}
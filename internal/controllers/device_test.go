@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// serve starts the app on a free port and returns its address
+func serve(t *testing.T, app *fiber.App) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go app.Listener(ln)
+	t.Cleanup(func() {
+		app.Shutdown()
+	})
+
+	return ln.Addr().String()
+}
+
+type noUpstream struct{}
+
+func (noUpstream) Forward(uuid.UUID, string, []byte, bool) {}
+
+// disconnects passes reasons of the disconnected devices
+type disconnects chan string
+
+func (d disconnects) HandleEvent(event device.Event) {
+	if event.Type == device.EventDeviceDisconnected {
+		d <- event.Reason
+	}
+}
+
+// newTestDevice serves the websocket of the devices with the heartbeat, disconnect
+// reasons are passed to the returned channel
+func newTestDevice(t *testing.T, heartbeat config.HeartbeatConfig) (string, disconnects) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	events := make(disconnects, 8)
+	cfg := &config.Config{Heartbeat: heartbeat}
+	service := device.New(log.New(), cfg, device.WithEventSubscriber(events))
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/ws/:id", NewDevice(log.New(), cfg, service, noUpstream{}).Connect(ctx))
+
+	return serve(t, app), events
+}
+
+func dial(t *testing.T, addr string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws/"+uuid.NewString(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn
+}
+
+func disconnected(t *testing.T, events disconnects) string {
+	t.Helper()
+
+	select {
+	case reason := <-events:
+		return reason
+	case <-time.After(5 * time.Second):
+		t.Fatal("device has not been disconnected")
+	}
+
+	return ""
+}
+
+// Test connection without messages is closed with 1000 after the idle timeout
+func TestDeviceIdleTimeout(t *testing.T) {
+	addr, events := newTestDevice(t, config.HeartbeatConfig{
+		PingInterval: time.Hour,
+		PongTimeout:  time.Hour,
+		IdleTimeout:  50 * time.Millisecond,
+	})
+
+	conn := dial(t, addr)
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected normal close, got: %v", err)
+	}
+
+	if reason := disconnected(t, events); reason != string(device.DisconnectIdle) {
+		t.Errorf("wrong reason: %s", reason)
+	}
+}
+
+// Test the device answering pings stays connected and the one that doesn't is disconnected
+// when the read deadline passes
+func TestDeviceHeartbeat(t *testing.T) {
+	heartbeat := config.HeartbeatConfig{
+		PingInterval: 30 * time.Millisecond,
+		PongTimeout:  30 * time.Millisecond,
+	}
+	addr, events := newTestDevice(t, heartbeat)
+
+	// pings are answered while the connection is read
+	alive := dial(t, addr)
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	silent := dial(t, addr)
+	silent.SetPingHandler(func(string) error {
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := silent.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if reason := disconnected(t, events); reason != string(device.DisconnectTimeout) {
+		t.Errorf("wrong reason: %s", reason)
+	}
+
+	select {
+	case reason := <-events:
+		t.Errorf("device answering pings has been disconnected: %s", reason)
+	case <-time.After(5 * (heartbeat.PingInterval + heartbeat.PongTimeout)):
+	}
+}
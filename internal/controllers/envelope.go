@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"time"
+	"tokeon-test-task/internal/services/device"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+const (
+	// envelopeVersion - version of the envelope written to the devices
+	envelopeVersion = 1
+	// defaultMessageType - type of the message if the sender has not set it
+	defaultMessageType = "message"
+
+	// protocolEnvelope - websocket subprotocol of the clients reading envelopes
+	protocolEnvelope = "envelope.v1"
+	// protocolRaw - websocket subprotocol of the legacy clients reading bare text
+	protocolRaw = "raw"
+)
+
+type envelopeTarget struct {
+	Kind     device.TargetKind `json:"kind"`
+	DeviceID *uuid.UUID        `json:"device_id,omitempty"`
+	Topic    string            `json:"topic,omitempty"`
+}
+
+// envelope is written to the device for every message, e.g.
+// {"v":1,"id":"...","type":"message","created_at":"...","target":{"kind":"broadcast"},"text":"hello"}
+type envelope struct {
+	Version   int       `json:"v"`
+	ID        uuid.UUID `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt - the device may drop the message after this time
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Sender    string            `json:"sender,omitempty"`
+	Target    envelopeTarget    `json:"target"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Text      string            `json:"text,omitempty"`
+	Payload   json.RawMessage   `json:"payload,omitempty"`
+	// Binary - size of the data in the binary frame that follows the envelope
+	Binary *int `json:"binary,omitempty"`
+}
+
+// encodeMessage returns the message in the format the device has requested: the
+// envelope or bare text for the legacy clients. Binary data is not encoded, it is
+// written as a separate frame, so legacy clients get nothing but the frame
+func encodeMessage(msg device.Message, raw bool) ([]byte, error) {
+	if raw {
+		if msg.Binary != nil {
+			return nil, nil
+		}
+
+		if msg.Text == "" {
+			return msg.Payload, nil
+		}
+
+		return []byte(msg.Text), nil
+	}
+
+	messageType := msg.Type
+	if messageType == "" {
+		messageType = defaultMessageType
+	}
+
+	var expiresAt *time.Time
+	if !msg.ExpiresAt.IsZero() {
+		expiresAt = &msg.ExpiresAt
+	}
+
+	var binary *int
+	if msg.Binary != nil {
+		size := len(msg.Binary)
+		binary = &size
+	}
+
+	return json.Marshal(envelope{
+		Version:   envelopeVersion,
+		ID:        msg.ID,
+		Type:      messageType,
+		CreatedAt: msg.CreatedAt,
+		ExpiresAt: expiresAt,
+		Sender:    msg.Sender,
+		Target: envelopeTarget{
+			Kind:     msg.Target.Kind(),
+			DeviceID: msg.Target.DeviceID,
+			Topic:    msg.Target.Topic,
+		},
+		Headers: msg.Headers,
+		Text:    msg.Text,
+		Payload: msg.Payload,
+		Binary:  binary,
+	})
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"testing"
+	"tokeon-test-task/internal/services/device"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// Test envelope and raw frames of the message
+func TestEncodeMessage(t *testing.T) {
+	id := uuid.New()
+	msg := device.Message{
+		Content: device.Content{
+			Text:    "hello",
+			Payload: []byte(`{"count":1}`),
+		},
+		ID:     uuid.New(),
+		Target: device.Target{DeviceID: &id},
+	}
+
+	frame, err := encodeMessage(msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var env envelope
+	if err := json.Unmarshal(frame, &env); err != nil {
+		t.Fatal(err)
+	}
+
+	if env.Version != envelopeVersion || env.ID != msg.ID || env.Type != defaultMessageType {
+		t.Errorf("wrong envelope: %s", frame)
+	}
+
+	if env.Target.Kind != device.TargetDevice || *env.Target.DeviceID != id {
+		t.Errorf("wrong target: %s", frame)
+	}
+
+	if string(env.Payload) != `{"count":1}` {
+		t.Errorf("wrong payload: %s", env.Payload)
+	}
+
+	raw, err := encodeMessage(msg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(raw) != "hello" {
+		t.Errorf("wrong raw frame: %s", raw)
+	}
+}
+
+// Test binary data is announced in the envelope and not encoded in the frame
+func TestEncodeBinaryMessage(t *testing.T) {
+	msg := device.Message{
+		Content: device.Content{Binary: []byte{0, 1, 2}},
+		ID:      uuid.New(),
+	}
+
+	frame, err := encodeMessage(msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var env envelope
+	if err := json.Unmarshal(frame, &env); err != nil {
+		t.Fatal(err)
+	}
+
+	if env.Binary == nil || *env.Binary != 3 {
+		t.Errorf("wrong binary size: %s", frame)
+	}
+
+	raw, err := encodeMessage(msg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if raw != nil {
+		t.Errorf("raw frame must be empty: %s", raw)
+	}
+}
@@ -0,0 +1,521 @@
+package controllers
+
+import (
+	"context"
+	e "errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	gatewayv1 "tokeon-test-task/pkg/api/gateway/v1"
+	"tokeon-test-task/pkg/log"
+	"tokeon-test-task/pkg/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// metadataDeviceID - metadata of the Connect stream with id of the device
+	metadataDeviceID = "device-id"
+	// metadataAuthorization - metadata of the Connect stream with the device token
+	metadataAuthorization = "authorization"
+	// metadataTenant - metadata of the Connect stream with the tenant of the device
+	metadataTenant = "tenant"
+)
+
+// grpcCodes - grpc codes of the statuses the http api responds with
+var grpcCodes = map[int]codes.Code{
+	fiber.StatusBadRequest:            codes.InvalidArgument,
+	fiber.StatusUnauthorized:          codes.Unauthenticated,
+	fiber.StatusForbidden:             codes.PermissionDenied,
+	fiber.StatusNotFound:              codes.NotFound,
+	fiber.StatusConflict:              codes.FailedPrecondition,
+	fiber.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	fiber.StatusNotImplemented:        codes.Unimplemented,
+	fiber.StatusServiceUnavailable:    codes.Unavailable,
+	fiber.StatusGatewayTimeout:        codes.DeadlineExceeded,
+}
+
+type DeviceAuthorizer interface {
+	AuthorizeDevice(token, tenant string, id uuid.UUID) (string, error)
+}
+
+// Gateway serves the grpc api with the same services and validation as the http one
+type Gateway struct {
+	log              log.Logger
+	sender           *Sender
+	presence         *Presence
+	device           *Device
+	deviceAuthorizer DeviceAuthorizer
+	heartbeat        config.HeartbeatConfig
+}
+
+func NewGateway(
+	log log.Logger,
+	config *config.Config,
+	sender *Sender,
+	presence *Presence,
+	device *Device,
+	deviceAuthorizer DeviceAuthorizer,
+) *Gateway {
+	return &Gateway{
+		log,
+		sender,
+		presence,
+		device,
+		deviceAuthorizer,
+		config.Heartbeat,
+	}
+}
+
+// gatewayServer implements the grpc service, ctx is done when the server shuts down
+type gatewayServer struct {
+	gatewayv1.UnimplementedGatewayServer
+	*Gateway
+	ctx context.Context
+}
+
+// Server returns the grpc service
+func (g *Gateway) Server(ctx context.Context) gatewayv1.GatewayServer {
+	return &gatewayServer{Gateway: g, ctx: ctx}
+}
+
+func (g *gatewayServer) Send(ctx context.Context, req *gatewayv1.SendRequest) (*gatewayv1.SendResponse, error) {
+	body, err := g.parseSendRequest(req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	result, err := g.sender.dispatch(ctx, middleware.ContextAPIKey(ctx), middleware.ContextTenant(ctx), body, false)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return newSendResponse(result), nil
+}
+
+func (g *gatewayServer) SendBatch(ctx context.Context, req *gatewayv1.SendBatchRequest) (*gatewayv1.SendBatchResponse, error) {
+	// items that can't be converted are dispatched empty and get the conversion error
+	items := make([]SendBodyDto, len(req.Items))
+	invalid := make([]error, len(req.Items))
+	for i, item := range req.Items {
+		body, err := g.parseSendRequest(item)
+		if err != nil {
+			invalid[i] = err
+			continue
+		}
+		items[i] = *body
+	}
+
+	results, err := g.sender.dispatchBatch(ctx, middleware.ContextAPIKey(ctx), middleware.ContextTenant(ctx), items, req.Report)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &gatewayv1.SendBatchResponse{Results: make([]*gatewayv1.SendBatchResult, len(results))}
+	for i, result := range results {
+		if invalid[i] != nil {
+			result.err = invalid[i]
+		}
+
+		if result.err != nil {
+			st := status.Convert(grpcError(result.err))
+			response.Results[i] = &gatewayv1.SendBatchResult{Code: int32(st.Code()), Error: st.Message()}
+			continue
+		}
+
+		response.Results[i] = &gatewayv1.SendBatchResult{Code: int32(codes.OK), Response: newSendResponse(result.sendResult)}
+	}
+
+	return response, nil
+}
+
+func (g *gatewayServer) ListDevices(ctx context.Context, req *gatewayv1.ListDevicesRequest) (*gatewayv1.ListDevicesResponse, error) {
+	query := PageOptionsDto{}
+	if req.Page != 0 {
+		query.Page = &req.Page
+	}
+	if req.PageSize != 0 {
+		query.PageSize = &req.PageSize
+	}
+	if err := g.presence.validator.Struct(query); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	devices, count := g.presence.presenceService.Devices(middleware.ContextTenant(ctx), query.GetPage(), query.GetPageSize())
+
+	return &gatewayv1.ListDevicesResponse{
+		Devices: utils.Map(devices, newGatewayDevice),
+		Count:   count,
+	}, nil
+}
+
+// Connect passes messages of the device session to the stream the same way the websocket does
+func (g *gatewayServer) Connect(stream gatewayv1.Gateway_ConnectServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+
+	values := md.Get(metadataDeviceID)
+	if len(values) == 0 {
+		return status.Error(codes.InvalidArgument, metadataDeviceID+" metadata is required")
+	}
+
+	id, err := uuid.Parse(values[0])
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "id is not valid uuid")
+	}
+
+	var token string
+	if values := md.Get(metadataAuthorization); len(values) > 0 {
+		token = strings.TrimPrefix(values[0], "Bearer ")
+	}
+	var tenant string
+	if values := md.Get(metadataTenant); len(values) > 0 {
+		tenant = values[0]
+	}
+
+	tenant, err = g.deviceAuthorizer.AuthorizeDevice(token, tenant, id)
+	if e.Is(err, errors.ErrUnauthorized) {
+		g.log.Warnf("device %s: %v", id, err)
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+
+	info := device.ConnectionInfo{Transport: device.TransportGRPC, Tenant: tenant}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		info.RemoteIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(info.RemoteIP); err == nil {
+			info.RemoteIP = host
+		}
+	}
+	if agents := md.Get("user-agent"); len(agents) > 0 {
+		info.UserAgent = agents[0]
+	}
+
+	session, err := g.device.deviceService.Register(id, info)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	// deliver messages sent while the device was offline
+	for _, msg := range g.device.deviceService.Drain(id) {
+		if err := g.write(stream, session, msg); err != nil {
+			g.log.Errorf("write: %v", err)
+			g.device.disconnect(session, device.DisconnectWriteError)
+			return err
+		}
+	}
+
+	received := make(chan *gatewayv1.DeviceFrame)
+	done := make(chan struct{})
+	defer close(done)
+
+	// readErr is set before received is closed
+	var readErr error
+
+	go func() {
+		defer close(received)
+
+		for {
+			frame, err := stream.Recv()
+			if err != nil {
+				readErr = err
+				return
+			}
+
+			select {
+			case received <- frame:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// idle fires when there have been no messages for the idle timeout, nil if disabled
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if g.heartbeat.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(g.heartbeat.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	active := func() {
+		if idleTimer == nil {
+			return
+		}
+
+		if !idleTimer.Stop() {
+			select {
+			case <-idleTimer.C:
+			default:
+			}
+		}
+		idleTimer.Reset(g.heartbeat.IdleTimeout)
+	}
+
+	for {
+		select {
+		case frame, ok := <-received:
+			if !ok {
+				reason := device.DisconnectNormal
+
+				// the stream of the client gone without closing is cancelled by the keepalive
+				if !e.Is(readErr, io.EOF) && status.Code(readErr) != codes.Canceled {
+					g.log.Errorf("read: %v", readErr)
+					reason = device.DisconnectReadError
+				}
+
+				g.device.disconnect(session, reason)
+				return nil
+			}
+
+			active()
+			g.handleFrame(session, frame)
+		case msg := <-session.Messages():
+			if err := g.write(stream, session, msg); err != nil {
+				g.log.Errorf("write: %v", err)
+				g.device.disconnect(session, device.DisconnectWriteError)
+				return err
+			}
+
+			active()
+		case <-idle:
+			g.log.Infof("device %s has been idle for %s", id, g.heartbeat.IdleTimeout)
+			g.device.disconnect(session, device.DisconnectIdle)
+			return g.writeClose(stream, idleFrame)
+		case frame := <-session.Closed():
+			// session has been closed by the server and is already unregistered
+			return g.writeClose(stream, frame)
+		case <-g.ctx.Done():
+			g.device.disconnect(session, device.DisconnectShutdown)
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+func (g *gatewayServer) write(stream gatewayv1.Gateway_ConnectServer, session *device.Session, msg device.Message) error {
+	if err := stream.Send(&gatewayv1.ServerFrame{
+		Frame: &gatewayv1.ServerFrame_Message{Message: newGatewayMessage(msg)},
+	}); err != nil {
+		return err
+	}
+
+	session.CountOutbound()
+
+	if err := g.device.deviceService.Delivered(session.DeviceID, msg.ID); err != nil {
+		g.log.Warnf("failed to mark message %s delivered to device %s: %v", msg.ID, session.DeviceID, err)
+	}
+
+	return nil
+}
+
+// writeClose writes the close frame, the stream ends when Connect returns
+func (g *gatewayServer) writeClose(stream gatewayv1.Gateway_ConnectServer, frame device.CloseFrame) error {
+	return stream.Send(&gatewayv1.ServerFrame{
+		Frame: &gatewayv1.ServerFrame_Close{Close: &gatewayv1.Close{Code: int32(frame.Code), Reason: frame.Reason}},
+	})
+}
+
+// handleFrame applies control frames and passes the rest to upstream
+func (g *gatewayServer) handleFrame(session *device.Session, frame *gatewayv1.DeviceFrame) {
+	id := session.DeviceID
+
+	switch f := frame.Frame.(type) {
+	case *gatewayv1.DeviceFrame_Ack:
+		session.CountInbound()
+
+		messageID, err := uuid.Parse(f.Ack)
+		if err != nil {
+			g.log.Warnf("device %s has acked message with invalid id %q", id, f.Ack)
+			return
+		}
+		if err := g.device.deviceService.Ack(id, messageID); err != nil {
+			g.log.Warnf("failed to ack message %s from device %s: %v", messageID, id, err)
+		}
+	case *gatewayv1.DeviceFrame_Subscribe:
+		session.CountInbound()
+
+		if f.Subscribe == "" {
+			return
+		}
+		if err := g.device.deviceService.Subscribe(id, f.Subscribe); err != nil {
+			g.log.Warnf("failed to subscribe device %s to %s: %v", id, f.Subscribe, err)
+		}
+	case *gatewayv1.DeviceFrame_Unsubscribe:
+		session.CountInbound()
+
+		if err := g.device.deviceService.Unsubscribe(id, f.Unsubscribe); err != nil {
+			g.log.Warnf("failed to unsubscribe device %s from %s: %v", id, f.Unsubscribe, err)
+		}
+	case *gatewayv1.DeviceFrame_Upstream:
+		g.device.handleFrame(session, incomingFrame{data: f.Upstream.Data, binary: f.Upstream.Binary})
+	}
+}
+
+// parseSendRequest converts the request to the body of /send
+func (g *gatewayServer) parseSendRequest(req *gatewayv1.SendRequest) (*SendBodyDto, error) {
+	body := &SendBodyDto{
+		Topic:   req.Topic,
+		Type:    req.Type,
+		Headers: req.Headers,
+		Text:    req.Text,
+		Payload: req.Payload,
+		Report:  req.Report,
+	}
+
+	if req.DeviceId != nil {
+		id, err := uuid.Parse(*req.DeviceId)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "device_id is not valid uuid")
+		}
+		body.DeviceID = &id
+	}
+
+	var err error
+	if body.DeviceIDs, err = parseUUIDs(req.DeviceIds); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "device_ids must be valid uuids")
+	}
+	if body.ExcludeDeviceIDs, err = parseUUIDs(req.ExcludeDeviceIds); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "exclude_device_ids must be valid uuids")
+	}
+
+	if len(req.Binary) > 0 {
+		if int64(len(req.Binary)) > g.sender.maxBinarySize {
+			return nil, fiber.ErrRequestEntityTooLarge
+		}
+		body.Binary = req.Binary
+	}
+
+	if req.Ttl != nil {
+		body.TTL = req.Ttl.AsDuration().String()
+	}
+	if req.SendAt != nil {
+		body.SendAt = req.SendAt.AsTime().Format(time.RFC3339Nano)
+	}
+	if req.Delay != nil {
+		body.Delay = req.Delay.AsDuration().String()
+	}
+
+	return body, nil
+}
+
+func parseUUIDs(values []string) ([]uuid.UUID, error) {
+	return utils.MapWithError(values, uuid.Parse)
+}
+
+// grpcError converts the error to the grpc status with the code matching the http status
+func grpcError(err error) error {
+	httpStatus, message := middleware.ErrorStatus(err)
+
+	code, ok := grpcCodes[httpStatus]
+	if !ok {
+		code = codes.Internal
+	}
+
+	return status.Error(code, message)
+}
+
+func newSendResponse(result sendResult) *gatewayv1.SendResponse {
+	if result.scheduled != nil {
+		return &gatewayv1.SendResponse{Scheduled: &gatewayv1.ScheduledMessage{
+			Id:        result.scheduled.ID.String(),
+			State:     result.scheduled.State,
+			SendAt:    timestamppb.New(result.scheduled.SendAt),
+			CreatedAt: timestamppb.New(result.scheduled.CreatedAt),
+		}}
+	}
+
+	response := &gatewayv1.SendResponse{Id: result.sent.ID.String()}
+
+	if report := result.sent.Report; report != nil {
+		response.Report = &gatewayv1.Report{
+			Targets:   int64(report.Targets),
+			Delivered: int64(report.Delivered),
+			Accepted:  int64(report.Accepted),
+			Queued:    int64(report.Queued),
+			Forwarded: int64(report.Forwarded),
+			TimedOut:  int64(report.TimedOut),
+			Dropped:   int64(report.Dropped),
+			NotFound:  int64(report.NotFound),
+			Devices:   make(map[string]string, len(report.Devices)),
+		}
+		for id, outcome := range report.Devices {
+			response.Report.Devices[id.String()] = string(outcome)
+		}
+	}
+
+	return response
+}
+
+func newGatewayDevice(presence device.Presence) *gatewayv1.Device {
+	return &gatewayv1.Device{
+		Id:       presence.DeviceID.String(),
+		Sessions: utils.Map(presence.Sessions, newGatewaySession),
+	}
+}
+
+func newGatewaySession(session device.SessionPresence) *gatewayv1.Session {
+	return &gatewayv1.Session{
+		Id:             session.SessionID.String(),
+		Transport:      string(session.Transport),
+		ConnectedAt:    timestamppb.New(session.ConnectedAt),
+		RemoteIp:       session.RemoteIP,
+		UserAgent:      session.UserAgent,
+		LastInboundAt:  optionalTimestamp(session.LastInboundAt),
+		LastOutboundAt: optionalTimestamp(session.LastOutboundAt),
+		InboundCount:   session.InboundCount,
+		OutboundCount:  session.OutboundCount,
+	}
+}
+
+func newGatewayMessage(msg device.Message) *gatewayv1.Message {
+	messageType := msg.Type
+	if messageType == "" {
+		messageType = defaultMessageType
+	}
+
+	message := &gatewayv1.Message{
+		Id:        msg.ID.String(),
+		Type:      messageType,
+		CreatedAt: timestamppb.New(msg.CreatedAt),
+		Sender:    msg.Sender,
+		Target: &gatewayv1.Target{
+			Kind:  string(msg.Target.Kind()),
+			Topic: msg.Target.Topic,
+		},
+		Headers: msg.Headers,
+		Text:    msg.Text,
+		Payload: msg.Payload,
+		Binary:  msg.Binary,
+	}
+
+	if !msg.ExpiresAt.IsZero() {
+		message.ExpiresAt = timestamppb.New(msg.ExpiresAt)
+	}
+	if msg.Target.DeviceID != nil {
+		deviceID := msg.Target.DeviceID.String()
+		message.Target.DeviceId = &deviceID
+	}
+
+	return message
+}
+
+func optionalTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+
+	return timestamppb.New(*t)
+}
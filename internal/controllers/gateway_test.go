@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	gatewayv1 "tokeon-test-task/pkg/api/gateway/v1"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/go-playground/validator"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	testSendKey = "send-key"
+	testReadKey = "read-key"
+)
+
+// newTestGateway serves the grpc api in memory with the keys that may send to the
+// devices and read them, the client is closed with the test
+func newTestGateway(t *testing.T) (gatewayv1.GatewayClient, *device.Service, disconnects) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	cfg := &config.Config{
+		SendTimeout:   time.Second,
+		MessageMaxTTL: time.Hour,
+		MaxBinarySize: 1024,
+		Mailbox:       config.MailboxConfig{MaxSize: 10, MaxAge: time.Hour},
+		Batch:         config.BatchConfig{MaxSize: 10, Concurrency: 2},
+		API:           config.APIConfig{Keys: []string{"sender:" + testSendKey + ":send:device", "reader:" + testReadKey + ":devices:read"}},
+		Tenant:        config.TenantConfig{Default: "default"},
+	}
+
+	mw, err := middleware.New(log.New(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(disconnects, 8)
+	service := device.New(log.New(), cfg, device.WithEventSubscriber(events))
+
+	gateway := NewGateway(
+		log.New(),
+		cfg,
+		NewSender(cfg, validator.New(), service, nil),
+		NewPresence(cfg, validator.New(), service),
+		NewDevice(log.New(), cfg, service, noUpstream{}),
+		mw,
+	)
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(mw.GRPCAPIKey(map[string][]middleware.Scope{
+		gatewayv1.Gateway_Send_FullMethodName:        {middleware.ScopeSendDevice, middleware.ScopeSendBroadcast},
+		gatewayv1.Gateway_SendBatch_FullMethodName:   {middleware.ScopeSendDevice, middleware.ScopeSendBroadcast},
+		gatewayv1.Gateway_ListDevices_FullMethodName: {middleware.ScopeDevicesRead},
+	})))
+	gatewayv1.RegisterGatewayServer(server, gateway.Server(ctx))
+
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return gatewayv1.NewGatewayClient(conn), service, events
+}
+
+func withKey(key string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), middleware.HeaderAPIKey, key)
+}
+
+// connect opens the stream of the device and waits until the device is listed
+func connect(t *testing.T, client gatewayv1.GatewayClient, id uuid.UUID) gatewayv1.Gateway_ConnectClient {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), metadataDeviceID, id.String()))
+	t.Cleanup(cancel)
+
+	stream, err := client.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := client.ListDevices(withKey(testReadKey), &gatewayv1.ListDevicesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, d := range resp.Devices {
+			if d.Id == id.String() && len(d.Sessions) == 1 && d.Sessions[0].Transport == string(device.TransportGRPC) {
+				return stream
+			}
+		}
+	}
+
+	t.Fatal("device has not been listed")
+	return nil
+}
+
+func receive(t *testing.T, stream gatewayv1.Gateway_ConnectClient) *gatewayv1.ServerFrame {
+	t.Helper()
+
+	frame, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return frame
+}
+
+// Test unary calls are rejected without the key or without its scope
+func TestGatewayScopes(t *testing.T) {
+	client, _, _ := newTestGateway(t)
+	id := uuid.New().String()
+
+	_, err := client.Send(context.Background(), &gatewayv1.SendRequest{DeviceId: &id, Text: "hi"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("call without the key must be unauthenticated: %v", err)
+	}
+
+	_, err = client.Send(withKey("unknown"), &gatewayv1.SendRequest{DeviceId: &id, Text: "hi"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("call with the unknown key must be unauthenticated: %v", err)
+	}
+
+	_, err = client.ListDevices(withKey(testSendKey), &gatewayv1.ListDevicesRequest{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("list with the send key must be denied: %v", err)
+	}
+
+	_, err = client.SendBatch(withKey(testReadKey), &gatewayv1.SendBatchRequest{Items: []*gatewayv1.SendRequest{{DeviceId: &id, Text: "hi"}}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("batch with the read key must be denied: %v", err)
+	}
+
+	// the key may send to the devices only
+	_, err = client.Send(withKey(testSendKey), &gatewayv1.SendRequest{Topic: "news", Text: "hi"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("broadcast with the device scope must be denied: %v", err)
+	}
+
+	if _, err := client.ListDevices(withKey(testReadKey), &gatewayv1.ListDevicesRequest{}); err != nil {
+		t.Errorf("list with the read key has failed: %v", err)
+	}
+}
+
+// Test messages sent by Send and SendBatch reach the stream of the device, the invalid
+// item of the batch fails alone
+func TestGatewaySend(t *testing.T) {
+	client, _, _ := newTestGateway(t)
+	id := uuid.New()
+	deviceID := id.String()
+
+	stream := connect(t, client, id)
+
+	resp, err := client.Send(withKey(testSendKey), &gatewayv1.SendRequest{DeviceId: &deviceID, Text: "one", Report: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Report == nil || resp.Report.Targets != 1 || resp.Report.Devices[deviceID] == "" {
+		t.Errorf("wrong report: %+v", resp.Report)
+	}
+
+	if msg := receive(t, stream).GetMessage(); msg == nil || msg.Id != resp.Id || msg.Text != "one" {
+		t.Errorf("wrong message: %+v", msg)
+	}
+
+	invalid := "not-uuid"
+	batch, err := client.SendBatch(withKey(testSendKey), &gatewayv1.SendBatchRequest{Items: []*gatewayv1.SendRequest{
+		{DeviceId: &invalid, Text: "invalid"},
+		{DeviceId: &deviceID, Text: "two"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Results) != 2 || codes.Code(batch.Results[0].Code) != codes.InvalidArgument || codes.Code(batch.Results[1].Code) != codes.OK {
+		t.Fatalf("wrong results: %+v", batch.Results)
+	}
+
+	if msg := receive(t, stream).GetMessage(); msg == nil || msg.Id != batch.Results[1].Response.Id || msg.Text != "two" {
+		t.Errorf("wrong message: %+v", msg)
+	}
+}
+
+// Test the stream gets messages queued while the device was offline first, the closed
+// session ends the stream with the close frame and the closed stream disconnects the device
+func TestGatewayConnect(t *testing.T) {
+	client, service, events := newTestGateway(t)
+	id := uuid.New()
+	deviceID := id.String()
+
+	queued, err := client.Send(withKey(testSendKey), &gatewayv1.SendRequest{DeviceId: &deviceID, Text: "queued"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := connect(t, client, id)
+
+	if msg := receive(t, stream).GetMessage(); msg == nil || msg.Id != queued.Id {
+		t.Errorf("queued message must be drained first: %+v", msg)
+	}
+
+	frame := device.CloseFrame{Code: 4000, Reason: "bye"}
+	if err := service.Disconnect(context.Background(), "default", id, frame, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := receive(t, stream).GetClose(); c == nil || int(c.Code) != frame.Code || c.Reason != frame.Reason {
+		t.Errorf("wrong close frame: %+v", c)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("stream must end after the close frame: %v", err)
+	}
+
+	if reason := disconnected(t, events); reason != string(device.DisconnectAdmin) {
+		t.Errorf("wrong reason: %s", reason)
+	}
+
+	// the device closing the stream is disconnected normally
+	stream = connect(t, client, id)
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reason := disconnected(t, events); reason != string(device.DisconnectNormal) {
+		t.Errorf("wrong reason: %s", reason)
+	}
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"time"
+	"tokeon-test-task/internal/dto"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/history"
+	"tokeon-test-task/pkg/utils"
+
+	"github.com/go-playground/validator"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type HistoryService interface {
+	List(ctx context.Context, tenant string, deviceID *uuid.UUID, page, pageSize uint64) ([]history.Record, int64, error)
+}
+
+type History struct {
+	validator      *validator.Validate
+	historyService HistoryService
+}
+
+func NewHistory(validator *validator.Validate, historyService HistoryService) *History {
+	return &History{
+		validator,
+		historyService,
+	}
+}
+
+type MessageRecordDto struct {
+	ID uuid.UUID `json:"id"`
+	// DeviceID - target device, null for broadcasts
+	DeviceID *uuid.UUID `json:"device_id"`
+	// DeviceIDs - target devices, omitted if the message is not sent to the device list
+	DeviceIDs []uuid.UUID `json:"device_ids,omitempty"`
+	// Topic - target topic, omitted for direct messages and broadcasts
+	Topic string `json:"topic,omitempty"`
+	// ExcludeDeviceIDs - devices that haven't received the message
+	ExcludeDeviceIDs []uuid.UUID       `json:"exclude_device_ids,omitempty"`
+	Type             string            `json:"type,omitempty"`
+	Sender           string            `json:"sender,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Text             string            `json:"text"`
+	Payload          json.RawMessage   `json:"payload,omitempty" swaggertype:"object"`
+	// BinarySize - size of the binary data, the data itself is not kept
+	BinarySize *int                `json:"binary_size,omitempty"`
+	CreatedAt  time.Time           `json:"created_at"`
+	ExpiresAt  *time.Time          `json:"expires_at,omitempty"`
+	Deliveries []DeliveryStatusDto `json:"deliveries"`
+}
+
+// List godoc
+//
+//	@Summary		messages history
+//	@Description	sent messages from the newest to the oldest with their delivery status
+//	@Param			page		query		int			false	"Page number, starts from 1"
+//	@Param			page_size	query		int			false	"Page size, max 100"
+//	@Param			X-API-Key	header		string	false	"Key of the client with devices:read scope"
+//	@Tags			message
+//	@Accept			json
+//	@Produce		json
+//	@Success		200	{object}	dto.ArrayWithAmountResponse[MessageRecordDto]
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope"
+//	@Failure		501	{object}	ErrorResponse
+//	@Router			/api/v1/messages [get]
+func (ctl *History) List() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return ctl.list(c, nil)
+	}
+}
+
+// DeviceList godoc
+//
+//	@Summary		device messages history
+//	@Description	messages sent to the device from the newest to the oldest with its delivery status
+//	@Param			id			path		string		true	"Unique id of the device"
+//	@Param			page		query		int			false	"Page number, starts from 1"
+//	@Param			page_size	query		int			false	"Page size, max 100"
+//	@Param			X-API-Key	header		string	false	"Key of the client with devices:read scope"
+//	@Tags			message
+//	@Accept			json
+//	@Produce		json
+//	@Success		200	{object}	dto.ArrayWithAmountResponse[MessageRecordDto]
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope"
+//	@Failure		501	{object}	ErrorResponse
+//	@Router			/api/v1/devices/{id}/messages [get]
+func (ctl *History) DeviceList() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := uuid.Parse(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "id is not valid uuid")
+		}
+
+		return ctl.list(c, &id)
+	}
+}
+
+func (ctl *History) list(c *fiber.Ctx, deviceID *uuid.UUID) error {
+	query := new(PageOptionsDto)
+	if err := c.QueryParser(query); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := ctl.validator.Struct(*query); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	records, count, err := ctl.historyService.List(c.Context(), middleware.RequestTenant(c), deviceID, query.GetPage(), query.GetPageSize())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(dto.ArrayWithAmountResponse[MessageRecordDto]{
+		Items: utils.Map(records, func(record history.Record) MessageRecordDto {
+			return MessageRecordDto{
+				ID:               record.ID,
+				DeviceID:         record.DeviceID,
+				DeviceIDs:        record.DeviceIDs,
+				Topic:            record.Topic,
+				ExcludeDeviceIDs: record.ExcludeDeviceIDs,
+				Type:             record.Type,
+				Sender:           record.Sender,
+				Headers:          record.Headers,
+				Text:             record.Text,
+				Payload:          record.Payload,
+				BinarySize:       record.BinarySize,
+				ExpiresAt:        record.ExpiresAt,
+				CreatedAt:        record.CreatedAt,
+				Deliveries:       utils.Map(record.Deliveries, newDeliveryStatusDto),
+			}
+		}),
+		Count: count,
+	})
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"time"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type MessageService interface {
+	Status(tenant string, messageID uuid.UUID) (device.MessageStatus, error)
+}
+
+type Message struct {
+	messageService MessageService
+}
+
+func NewMessage(messageService MessageService) *Message {
+	return &Message{
+		messageService,
+	}
+}
+
+type DeliveryStatusDto struct {
+	DeviceID  uuid.UUID `json:"device_id"`
+	Status    string    `json:"status" enums:"pending,delivered,acked,expired"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newDeliveryStatusDto(delivery device.DeliveryStatus) DeliveryStatusDto {
+	return DeliveryStatusDto{
+		DeviceID:  delivery.DeviceID,
+		Status:    string(delivery.State),
+		UpdatedAt: delivery.UpdatedAt,
+	}
+}
+
+type MessageStatusResponse struct {
+	ID         uuid.UUID           `json:"id"`
+	CreatedAt  time.Time           `json:"created_at"`
+	Deliveries []DeliveryStatusDto `json:"deliveries"`
+}
+
+// Status godoc
+//
+//	@Summary		message delivery status
+//	@Description	delivery status of the message for every target device
+//	@Param			id			path		string		true	"Id of the message returned by send"
+//	@Param			X-API-Key	header		string	false	"Key of the client with devices:read scope"
+//	@Tags			message
+//	@Accept			json
+//	@Produce		json
+//	@Success		200	{object}	MessageStatusResponse
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope"
+//	@Failure		404	{object}	ErrorResponse
+//	@Router			/api/v1/messages/{id} [get]
+func (ctl *Message) Status() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := uuid.Parse(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "id is not valid uuid")
+		}
+
+		status, err := ctl.messageService.Status(middleware.RequestTenant(c), id)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(MessageStatusResponse{
+			ID:         status.ID,
+			CreatedAt:  status.CreatedAt,
+			Deliveries: utils.Map(status.Deliveries, newDeliveryStatusDto),
+		})
+	}
+}
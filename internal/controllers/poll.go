@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// pollLimit - max amount of messages returned by the poll
+const pollLimit = 100
+
+// poller keeps the session of the polling device between its polls
+type poller struct {
+	session *device.Session
+	// mu - held by the poll reading the session
+	mu sync.Mutex
+	// cancel - signalled by the newer poll of the device
+	cancel chan struct{}
+	// polls - outstanding polls, grace - closes the session when there are none for a while.
+	// Both are guarded by the lock of the controller
+	polls int
+	grace *time.Timer
+}
+
+type Poll struct {
+	log           log.Logger
+	streamService StreamService
+	config        config.PollConfig
+
+	mu      sync.Mutex
+	pollers map[uuid.UUID]*poller
+}
+
+func NewPoll(log log.Logger, config *config.Config, streamService StreamService) *Poll {
+	return &Poll{
+		log:           log,
+		streamService: streamService,
+		config:        config.Poll,
+		pollers:       make(map[uuid.UUID]*poller),
+	}
+}
+
+type PollQueryDto struct {
+	// Wait - how long to wait for the message, e.g. 30s
+	Wait string `query:"wait"`
+	// Cursor - id of the last received message
+	Cursor string `query:"cursor"`
+}
+
+type PollMessageDto struct {
+	// Envelope - the message in the format written to the websocket
+	Envelope json.RawMessage `json:"envelope" swaggertype:"object"`
+	// Binary - binary data of the message encoded with base64
+	Binary []byte `json:"binary,omitempty"`
+}
+
+type PollCloseDto struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+type PollResponse struct {
+	Messages []PollMessageDto `json:"messages"`
+	// Cursor - id of the last message to pass to the next poll
+	Cursor *uuid.UUID `json:"cursor"`
+	// Close - set if the server has closed the session, the next poll connects again
+	Close *PollCloseDto `json:"close,omitempty"`
+}
+
+// Connect godoc
+//
+//	@Summary		poll messages of the device
+//	@Description	long-polling transport for the clients that can make plain http requests only
+//	@Description	the request is held until there are messages or the wait expires, the device counts as connected
+//	@Description	while the poll is outstanding and for POLL_GRACE after it, messages sent in between wait for the next poll
+//	@Description	cursor of the response must be passed to the next poll, messages after it are returned again
+//	@Description	if the previous response has been lost and they are kept for REPLAY_TTL
+//	@Description	a newer poll of the device ends the outstanding one with no messages
+//	@Description	the device of the tenant polls /api/v1/{tenant}/poll/{id} the same way as it connects to the websocket
+//	@Param			id		path		string	true	"Unique id of the polling device"
+//	@Param			wait	query		string	false	"How long to wait for the message, e.g. 30s, POLL_WAIT by default"
+//	@Param			cursor	query		string	false	"Cursor of the previous response"
+//	@Param			token	query		string	false	"Token of the device, may be passed in Authorization header"
+//	@Tags			device
+//	@Produce		json
+//	@Success		200	{object}	PollResponse
+//	@Failure		400	{object}	ErrorResponse	"Id, wait or cursor is not valid or the device is connected by another transport"
+//	@Failure		401	{object}	ErrorResponse	"Token is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"Device is banned"
+//	@Failure		404	{object}	ErrorResponse	"Tenant not found"
+//	@Failure		503	{object}	ErrorResponse	"Tenant has reached TENANT_MAX_DEVICES"
+//	@Router			/api/v1/poll/{id} [get]
+func (p *Poll) Connect(ctx context.Context) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := uuid.Parse(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "id is not valid uuid")
+		}
+
+		query := PollQueryDto{}
+		if err := c.QueryParser(&query); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		wait := p.config.Wait
+		if query.Wait != "" {
+			wait, err = time.ParseDuration(query.Wait)
+			if err != nil || wait < 0 {
+				return fiber.NewError(fiber.StatusBadRequest, "wait is not valid duration")
+			}
+			if wait > p.config.MaxWait {
+				wait = p.config.MaxWait
+			}
+		}
+
+		var cursor *uuid.UUID
+		if query.Cursor != "" {
+			parsed, err := uuid.Parse(query.Cursor)
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "cursor is not valid uuid")
+			}
+			cursor = &parsed
+		}
+
+		poller, backlog, err := p.acquire(id, c)
+		if err != nil {
+			return err
+		}
+		defer p.release(id, poller)
+
+		// messages of the lost response go first, the drained ones are already remembered
+		if cursor != nil {
+			if missed, ok := p.streamService.Replay(id, *cursor); ok {
+				backlog = missed
+			}
+		}
+
+		response := PollResponse{Messages: []PollMessageDto{}, Cursor: cursor}
+
+		messages, frame := p.wait(ctx, poller, backlog, wait)
+		for _, msg := range messages {
+			data, err := encodeMessage(msg, false)
+			if err != nil {
+				p.log.Errorf("encode: %v", err)
+				continue
+			}
+
+			response.Messages = append(response.Messages, PollMessageDto{Envelope: data, Binary: msg.Binary})
+			response.Cursor = &msg.ID
+
+			poller.session.CountOutbound()
+
+			if err := p.streamService.Delivered(id, msg.ID); err != nil {
+				p.log.Warnf("failed to mark message %s delivered to device %s: %v", msg.ID, id, err)
+			}
+		}
+
+		if frame != nil {
+			response.Close = &PollCloseDto{Code: frame.Code, Reason: frame.Reason}
+		}
+
+		return c.JSON(response)
+	}
+}
+
+// acquire returns the poller of the device registering it on the first poll, the
+// outstanding poll of the device is cancelled. Messages queued while the device was
+// offline are returned for the new session
+func (p *Poll) acquire(id uuid.UUID, c *fiber.Ctx) (*poller, []device.Message, error) {
+	p.mu.Lock()
+
+	var backlog []device.Message
+
+	tenant := middleware.RequestTenant(c)
+
+	current, ok := p.pollers[id]
+	if ok && current.session.Tenant != tenant {
+		p.mu.Unlock()
+		return nil, nil, errors.ErrDeviceAlreadyRegistered
+	}
+	if !ok {
+		session, err := p.streamService.Register(id, device.ConnectionInfo{
+			RemoteIP:  c.IP(),
+			UserAgent: c.Get(fiber.HeaderUserAgent),
+			Transport: device.TransportPoll,
+			Tenant:    tenant,
+		})
+		if err != nil {
+			p.mu.Unlock()
+			return nil, nil, err
+		}
+
+		current = &poller{session: session, cancel: make(chan struct{}, 1)}
+		p.pollers[id] = current
+		backlog = p.streamService.Drain(id)
+	}
+
+	current.polls++
+	if current.grace != nil {
+		current.grace.Stop()
+	}
+
+	p.mu.Unlock()
+
+	select {
+	case current.cancel <- struct{}{}:
+	default:
+	}
+
+	current.mu.Lock()
+
+	// the signal is meant for the poll that has already returned
+	select {
+	case <-current.cancel:
+	default:
+	}
+
+	return current, backlog, nil
+}
+
+// release lets the next poll read the session, the session is closed if the device
+// doesn't poll again within the grace window
+func (p *Poll) release(id uuid.UUID, current *poller) {
+	current.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current.polls--
+	if current.polls > 0 || p.pollers[id] != current {
+		return
+	}
+
+	current.grace = time.AfterFunc(p.config.Grace, func() {
+		p.mu.Lock()
+		if current.polls > 0 || p.pollers[id] != current {
+			p.mu.Unlock()
+			return
+		}
+		delete(p.pollers, id)
+		p.mu.Unlock()
+
+		if err := p.streamService.Close(current.session, device.DisconnectPollExpired); err != nil {
+			p.log.Errorf("close: %v", err)
+		}
+	})
+}
+
+// wait returns the backlog at once or waits for the message, messages that are ready
+// by then are returned with it. The close frame is returned if the server has closed
+// the session
+func (p *Poll) wait(ctx context.Context, current *poller, backlog []device.Message, wait time.Duration) ([]device.Message, *device.CloseFrame) {
+	session := current.session
+	messages := backlog
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	if len(messages) == 0 {
+		select {
+		case msg := <-session.Messages():
+			messages = append(messages, msg)
+		case frame := <-session.Closed():
+			p.forget(session)
+			return nil, &frame
+		case <-timer.C:
+			return nil, nil
+		case <-current.cancel:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+
+	for len(messages) < pollLimit {
+		select {
+		case msg := <-session.Messages():
+			messages = append(messages, msg)
+		default:
+			return messages, nil
+		}
+	}
+
+	return messages, nil
+}
+
+// forget drops the poller of the session closed by the server
+func (p *Poll) forget(session *device.Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if current, ok := p.pollers[session.DeviceID]; ok && current.session == session {
+		delete(p.pollers, session.DeviceID)
+	}
+}
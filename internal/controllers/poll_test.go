@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// newTestPoll serves polls of the devices with the grace window, disconnect reasons are
+// passed to the returned channel
+func newTestPoll(t *testing.T, grace time.Duration) (string, *device.Service, disconnects) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	events := make(disconnects, 8)
+	cfg := &config.Config{
+		Replay: config.ReplayConfig{Size: 10, TTL: time.Minute},
+		Poll:   config.PollConfig{Wait: time.Second, MaxWait: 5 * time.Second, Grace: grace},
+	}
+	service := device.New(log.New(), cfg, device.WithEventSubscriber(events))
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/poll/:id", NewPoll(log.New(), cfg, service).Connect(ctx))
+
+	return serve(t, app), service, events
+}
+
+func poll(t *testing.T, addr string, id uuid.UUID, wait string, cursor *uuid.UUID) PollResponse {
+	t.Helper()
+
+	url := "http://" + addr + "/poll/" + id.String() + "?wait=" + wait
+	if cursor != nil {
+		url += "&cursor=" + cursor.String()
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("poll has failed with %d", resp.StatusCode)
+	}
+
+	var response PollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
+
+// texts returns texts of the polled messages
+func texts(t *testing.T, response PollResponse) []string {
+	t.Helper()
+
+	result := make([]string, 0, len(response.Messages))
+	for _, msg := range response.Messages {
+		var e envelope
+		if err := json.Unmarshal(msg.Envelope, &e); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, e.Text)
+	}
+
+	return result
+}
+
+func sendText(t *testing.T, service *device.Service, id uuid.UUID, text string) {
+	t.Helper()
+
+	if _, err := service.SendMessage(context.Background(), device.Target{DeviceID: &id}, device.Content{Text: text}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test the newer poll of the device ends the outstanding one with no messages
+func TestPollCancelledByNewer(t *testing.T) {
+	addr, _, _ := newTestPoll(t, time.Minute)
+	id := uuid.New()
+
+	done := make(chan PollResponse, 1)
+	go func() {
+		done <- poll(t, addr, id, "5s", nil)
+	}()
+
+	// the first poll must be outstanding before the newer one
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	poll(t, addr, id, "100ms", nil)
+
+	select {
+	case response := <-done:
+		if len(response.Messages) != 0 {
+			t.Errorf("cancelled poll must have no messages: %v", texts(t, response))
+		}
+		if time.Since(start) > time.Second {
+			t.Error("outstanding poll has been held till the newer one has returned")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("outstanding poll has not been ended by the newer one")
+	}
+}
+
+// Test the session is closed when the device doesn't poll again within the grace window
+// and is kept while it polls
+func TestPollGrace(t *testing.T) {
+	grace := 100 * time.Millisecond
+	addr, _, events := newTestPoll(t, grace)
+	id := uuid.New()
+
+	for i := 0; i < 3; i++ {
+		poll(t, addr, id, "10ms", nil)
+		time.Sleep(grace / 2)
+	}
+
+	select {
+	case reason := <-events:
+		t.Fatalf("polling device has been disconnected: %s", reason)
+	default:
+	}
+
+	if reason := disconnected(t, events); reason != string(device.DisconnectPollExpired) {
+		t.Errorf("wrong reason: %s", reason)
+	}
+}
+
+// Test the poll with the cursor of the lost response gets its messages again once and
+// the ones sent after them
+func TestPollReplay(t *testing.T) {
+	addr, service, _ := newTestPoll(t, time.Minute)
+	id := uuid.New()
+
+	// registers the session
+	poll(t, addr, id, "10ms", nil)
+
+	sendText(t, service, id, "1")
+	response := poll(t, addr, id, "1s", nil)
+	if got := texts(t, response); len(got) != 1 || got[0] != "1" {
+		t.Fatalf("wrong messages: %v", got)
+	}
+	cursor := response.Cursor
+
+	sendText(t, service, id, "2")
+	sendText(t, service, id, "3")
+
+	// the response is lost
+	var lost []string
+	for len(lost) < 2 {
+		lost = append(lost, texts(t, poll(t, addr, id, "1s", cursor))...)
+	}
+
+	sendText(t, service, id, "4")
+
+	var got []string
+	for len(got) < 3 {
+		response = poll(t, addr, id, "1s", cursor)
+		if len(response.Messages) == 0 {
+			t.Fatalf("message has not been polled, got: %v", got)
+		}
+		got = append(got, texts(t, response)...)
+		cursor = response.Cursor
+	}
+
+	if len(got) != 3 || got[0] != "2" || got[1] != "3" || got[2] != "4" {
+		t.Errorf("wrong messages after the lost response: %v", got)
+	}
+
+	if response = poll(t, addr, id, "100ms", cursor); len(response.Messages) != 0 {
+		t.Errorf("messages have been polled again: %v", texts(t, response))
+	}
+}
@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"context"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/dto"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/utils"
+
+	"github.com/go-playground/validator"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type PresenceService interface {
+	Devices(tenant string, page, pageSize uint64) ([]device.Presence, int64)
+	Device(tenant string, id uuid.UUID) (device.Presence, error)
+	Disconnect(ctx context.Context, tenant string, id uuid.UUID, frame device.CloseFrame, ban time.Duration) error
+}
+
+type Presence struct {
+	validator       *validator.Validate
+	presenceService PresenceService
+	// closeFrame - default close frame of the disconnected devices
+	closeFrame device.CloseFrame
+}
+
+func NewPresence(config *config.Config, validator *validator.Validate, presenceService PresenceService) *Presence {
+	return &Presence{
+		validator,
+		presenceService,
+		device.CloseFrame{
+			Code:   config.Disconnect.CloseCode,
+			Reason: config.Disconnect.CloseReason,
+		},
+	}
+}
+
+type DisconnectQueryDto struct {
+	// Code - close code, 1000 or application code 3000-4999
+	Code *int `query:"code"`
+	// Reason - close reason, max 123 bytes
+	Reason *string `query:"reason" validate:"omitempty,max=123"`
+	// Ban - period the device can't reconnect for, e.g. 10m
+	Ban string `query:"ban"`
+}
+
+type DevicePresenceDto struct {
+	ID uuid.UUID `json:"id"`
+	// Sessions - live connections of the device from the oldest to the newest
+	Sessions []SessionPresenceDto `json:"sessions"`
+}
+
+type SessionPresenceDto struct {
+	ID          uuid.UUID        `json:"id"`
+	Transport   device.Transport `json:"transport" enums:"websocket,sse,poll,grpc"`
+	ConnectedAt time.Time        `json:"connected_at"`
+	RemoteIP    string           `json:"remote_ip"`
+	UserAgent   string           `json:"user_agent"`
+	// LastInboundAt - last message from the device, null if none
+	LastInboundAt *time.Time `json:"last_inbound_at"`
+	// LastOutboundAt - last message written to the device, null if none
+	LastOutboundAt *time.Time `json:"last_outbound_at"`
+	InboundCount   uint64     `json:"inbound_count"`
+	OutboundCount  uint64     `json:"outbound_count"`
+}
+
+func newDevicePresenceDto(presence device.Presence) DevicePresenceDto {
+	return DevicePresenceDto{
+		ID:       presence.DeviceID,
+		Sessions: utils.Map(presence.Sessions, newSessionPresenceDto),
+	}
+}
+
+func newSessionPresenceDto(session device.SessionPresence) SessionPresenceDto {
+	return SessionPresenceDto{
+		ID:             session.SessionID,
+		Transport:      session.Transport,
+		ConnectedAt:    session.ConnectedAt,
+		RemoteIP:       session.RemoteIP,
+		UserAgent:      session.UserAgent,
+		LastInboundAt:  session.LastInboundAt,
+		LastOutboundAt: session.LastOutboundAt,
+		InboundCount:   session.InboundCount,
+		OutboundCount:  session.OutboundCount,
+	}
+}
+
+// List godoc
+//
+//	@Summary		connected devices
+//	@Description	devices connected to this instance from the oldest session to the newest
+//	@Param			page		query		int			false	"Page number, starts from 1"
+//	@Param			page_size	query		int			false	"Page size, max 100"
+//	@Param			X-API-Key	header		string	false	"Key of the client with devices:read scope"
+//	@Tags			device
+//	@Accept			json
+//	@Produce		json
+//	@Success		200	{object}	dto.ArrayWithAmountResponse[DevicePresenceDto]
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope"
+//	@Router			/api/v1/devices [get]
+func (ctl *Presence) List() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		query := new(PageOptionsDto)
+		if err := c.QueryParser(query); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err := ctl.validator.Struct(*query); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		devices, count := ctl.presenceService.Devices(middleware.RequestTenant(c), query.GetPage(), query.GetPageSize())
+
+		return c.JSON(dto.ArrayWithAmountResponse[DevicePresenceDto]{
+			Items: utils.Map(devices, newDevicePresenceDto),
+			Count: count,
+		})
+	}
+}
+
+// Get godoc
+//
+//	@Summary		connected device
+//	@Description	sessions of the device connected to this instance
+//	@Param			id			path		string		true	"Unique id of the device"
+//	@Param			X-API-Key	header		string	false	"Key of the client with devices:read scope"
+//	@Tags			device
+//	@Accept			json
+//	@Produce		json
+//	@Success		200	{object}	DevicePresenceDto
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope"
+//	@Failure		404	{object}	ErrorResponse	"Device is not connected"
+//	@Router			/api/v1/devices/{id} [get]
+func (ctl *Presence) Get() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := uuid.Parse(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "id is not valid uuid")
+		}
+
+		presence, err := ctl.presenceService.Device(middleware.RequestTenant(c), id)
+		if err == errors.ErrDeviceNotFound {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(newDevicePresenceDto(presence))
+	}
+}
+
+// Disconnect godoc
+//
+//	@Summary		disconnect device
+//	@Description	close every session of the device with the close frame, the device may be banned from reconnecting
+//	@Description	in cluster mode the device is disconnected and banned on every instance
+//	@Param			id			path		string		true	"Unique id of the device"
+//	@Param			code		query		int			false	"Close code, 1000 or 3000-4999, DISCONNECT_CLOSE_CODE by default"
+//	@Param			reason		query		string		false	"Close reason, DISCONNECT_CLOSE_REASON by default"
+//	@Param			ban			query		string		false	"Period the device can't reconnect for, e.g. 10m"
+//	@Param			X-API-Key	header		string	false	"Key of the client with admin scope"
+//	@Tags			device
+//	@Accept			json
+//	@Produce		json
+//	@Success		204
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope"
+//	@Failure		404	{object}	ErrorResponse	"Device is not connected"
+//	@Router			/api/v1/devices/{id}/connection [delete]
+func (ctl *Presence) Disconnect() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := uuid.Parse(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "id is not valid uuid")
+		}
+
+		query := new(DisconnectQueryDto)
+		if err := c.QueryParser(query); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err := ctl.validator.Struct(*query); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		frame := ctl.closeFrame
+		if query.Code != nil {
+			if !validCloseCode(*query.Code) {
+				return fiber.NewError(fiber.StatusBadRequest, "code must be 1000 or in range 3000-4999")
+			}
+			frame.Code = *query.Code
+		}
+		if query.Reason != nil {
+			frame.Reason = *query.Reason
+		}
+
+		var ban time.Duration
+		if query.Ban != "" {
+			if ban, err = time.ParseDuration(query.Ban); err != nil || ban < 0 {
+				return fiber.NewError(fiber.StatusBadRequest, "ban is not valid duration")
+			}
+		}
+
+		err = ctl.presenceService.Disconnect(c.Context(), middleware.RequestTenant(c), id, frame, ban)
+		if err == errors.ErrDeviceNotFound {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// validCloseCode reports whether the server may close the connection with the code
+func validCloseCode(code int) bool {
+	return code == 1000 || (code >= 3000 && code <= 4999)
+}
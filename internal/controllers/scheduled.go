@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"time"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/internal/services/scheduler"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type SchedulerService interface {
+	Schedule(target device.Target, content device.Content, sendAt time.Time) (scheduler.Item, error)
+	Get(id uuid.UUID) (scheduler.Item, error)
+	Cancel(id uuid.UUID) error
+}
+
+type Scheduled struct {
+	schedulerService SchedulerService
+}
+
+func NewScheduled(schedulerService SchedulerService) *Scheduled {
+	return &Scheduled{
+		schedulerService,
+	}
+}
+
+type ScheduledMessageDto struct {
+	// ID of the scheduled message, not of the sent one
+	ID uuid.UUID `json:"id"`
+	// DeviceID - target device, null for topics and broadcasts
+	DeviceID *uuid.UUID `json:"device_id"`
+	// DeviceIDs - target devices, omitted if the message is not sent to the device list
+	DeviceIDs []uuid.UUID `json:"device_ids,omitempty"`
+	// Topic - target topic, omitted for direct messages and broadcasts
+	Topic string `json:"topic,omitempty"`
+	// ExcludeDeviceIDs - devices that don't receive the message
+	ExcludeDeviceIDs []uuid.UUID `json:"exclude_device_ids,omitempty"`
+	Type             string      `json:"type,omitempty"`
+	State            string      `json:"state" enums:"pending,sent,failed"`
+	SendAt           time.Time   `json:"send_at"`
+	CreatedAt        time.Time   `json:"created_at"`
+	// MessageID - id of the sent message to check its delivery status
+	MessageID *uuid.UUID `json:"message_id,omitempty"`
+	// Error - why the message has failed
+	Error string `json:"error,omitempty"`
+}
+
+func newScheduledMessageDto(item scheduler.Item) ScheduledMessageDto {
+	return ScheduledMessageDto{
+		ID:               item.ID,
+		DeviceID:         item.Target.DeviceID,
+		DeviceIDs:        item.Target.DeviceIDs,
+		Topic:            item.Target.Topic,
+		ExcludeDeviceIDs: item.Target.Exclude,
+		Type:             item.Content.Type,
+		State:            string(item.State),
+		SendAt:           item.SendAt,
+		CreatedAt:        item.CreatedAt,
+		MessageID:        item.MessageID,
+		Error:            item.Error,
+	}
+}
+
+// Get godoc
+//
+//	@Summary		scheduled message
+//	@Description	state of the message scheduled by send with send_at or delay
+//	@Description	sent and failed messages are available while their delivery status is kept
+//	@Param			id			path		string		true	"Id of the scheduled message returned by send"
+//	@Param			X-API-Key	header		string	false	"Key of the client with devices:read scope"
+//	@Tags			scheduled
+//	@Accept			json
+//	@Produce		json
+//	@Success		200	{object}	ScheduledMessageDto
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope"
+//	@Failure		404	{object}	ErrorResponse
+//	@Router			/api/v1/scheduled/{id} [get]
+func (ctl *Scheduled) Get() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := uuid.Parse(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "id is not valid uuid")
+		}
+
+		item, err := ctl.get(c, id)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(newScheduledMessageDto(item))
+	}
+}
+
+// Cancel godoc
+//
+//	@Summary		cancel scheduled message
+//	@Description	cancel the message that has not been sent yet
+//	@Description	the key needs send:device scope for the message to the devices and send:broadcast for the rest
+//	@Param			id			path		string		true	"Id of the scheduled message returned by send"
+//	@Param			X-API-Key	header		string	false	"Key of the client with send:device or send:broadcast scope"
+//	@Tags			scheduled
+//	@Accept			json
+//	@Produce		json
+//	@Success		204
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope of the message target"
+//	@Failure		404	{object}	ErrorResponse
+//	@Failure		409	{object}	ErrorResponse	"Message has already been sent"
+//	@Router			/api/v1/scheduled/{id} [delete]
+func (ctl *Scheduled) Cancel() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := uuid.Parse(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "id is not valid uuid")
+		}
+
+		item, err := ctl.get(c, id)
+		if err != nil {
+			return err
+		}
+
+		// the key that can't send to the target can't cancel the message either
+		if err := authorizeTarget(middleware.RequestAPIKey(c), item.Target); err != nil {
+			return err
+		}
+
+		if err := ctl.schedulerService.Cancel(id); err != nil {
+			return err
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// get returns the message scheduled in the tenant of the request
+func (ctl *Scheduled) get(c *fiber.Ctx, id uuid.UUID) (scheduler.Item, error) {
+	item, err := ctl.schedulerService.Get(id)
+	if err != nil {
+		return scheduler.Item{}, err
+	}
+
+	if item.Target.Tenant != middleware.RequestTenant(c) {
+		return scheduler.Item{}, errors.ErrScheduledNotFound
+	}
+
+	return item, nil
+}
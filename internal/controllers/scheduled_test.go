@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/internal/services/scheduler"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// scheduledItems keeps the items in memory, cancelled items are removed
+type scheduledItems map[uuid.UUID]scheduler.Item
+
+func (s scheduledItems) Schedule(device.Target, device.Content, time.Time) (scheduler.Item, error) {
+	return scheduler.Item{}, nil
+}
+
+func (s scheduledItems) Get(id uuid.UUID) (scheduler.Item, error) {
+	item, ok := s[id]
+	if !ok {
+		return scheduler.Item{}, errors.ErrScheduledNotFound
+	}
+
+	return item, nil
+}
+
+func (s scheduledItems) Cancel(id uuid.UUID) error {
+	delete(s, id)
+
+	return nil
+}
+
+// Test the key may cancel only the messages it may send
+func TestScheduledCancelScope(t *testing.T) {
+	cfg := &config.Config{
+		API:    config.APIConfig{Keys: []string{"device:device-key:send:device", "broadcast:broadcast-key:send:broadcast"}},
+		Tenant: config.TenantConfig{Default: "default"},
+	}
+
+	mw, err := middleware.New(log.New(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceID := uuid.New()
+	direct := scheduler.Item{ID: uuid.New(), Target: device.Target{Tenant: "default", DeviceID: &deviceID}}
+	list := scheduler.Item{ID: uuid.New(), Target: device.Target{Tenant: "default", DeviceIDs: []uuid.UUID{deviceID}}}
+	topic := scheduler.Item{ID: uuid.New(), Target: device.Target{Tenant: "default", Topic: "news"}}
+	broadcast := scheduler.Item{ID: uuid.New(), Target: device.Target{Tenant: "default"}}
+
+	items := scheduledItems{}
+	for _, item := range []scheduler.Item{direct, list, topic, broadcast} {
+		items[item.ID] = item
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: mw.ErrorHandler()})
+	app.Delete("/scheduled/:id", mw.APIKey(middleware.ScopeSendDevice, middleware.ScopeSendBroadcast), NewScheduled(items).Cancel())
+
+	cases := []struct {
+		key    string
+		item   scheduler.Item
+		status int
+	}{
+		{"device-key", topic, fiber.StatusForbidden},
+		{"device-key", broadcast, fiber.StatusForbidden},
+		{"broadcast-key", direct, fiber.StatusForbidden},
+		{"broadcast-key", list, fiber.StatusForbidden},
+		{"device-key", direct, fiber.StatusNoContent},
+		{"device-key", list, fiber.StatusNoContent},
+		{"broadcast-key", topic, fiber.StatusNoContent},
+		{"broadcast-key", broadcast, fiber.StatusNoContent},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(fiber.MethodDelete, "/scheduled/"+c.item.ID.String(), nil)
+		req.Header.Set(middleware.HeaderAPIKey, c.key)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != c.status {
+			t.Errorf("%s cancelling the %s message: expected %d, got %d", c.key, c.item.Target.Kind(), c.status, resp.StatusCode)
+		}
+	}
+
+	if len(items) != 0 {
+		t.Errorf("messages have not been cancelled: %d", len(items))
+	}
+}
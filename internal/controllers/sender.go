@@ -1,62 +1,570 @@
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strconv"
+	"sync"
 	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/dto"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/utils"
 
 	"github.com/go-playground/validator"
+	"github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
 type SenderService interface {
-	SendMessage(ctx context.Context, deviceID *uuid.UUID, text string) error
+	SendMessage(ctx context.Context, target device.Target, content device.Content) (uuid.UUID, error)
+	Send(ctx context.Context, target device.Target, content device.Content) (device.Report, error)
 }
 
 type Sender struct {
-	validator     *validator.Validate
-	senderService SenderService
+	validator        *validator.Validate
+	senderService    SenderService
+	schedulerService SchedulerService
+	sendTimeout      time.Duration
+	maxTTL           time.Duration
+	maxDelay         time.Duration
+	maxBinarySize    int64
+	batch            config.BatchConfig
 }
 
-func NewSender(validator *validator.Validate, senderService SenderService) *Sender {
+func NewSender(
+	config *config.Config,
+	validator *validator.Validate,
+	senderService SenderService,
+	schedulerService SchedulerService,
+) *Sender {
 	return &Sender{
 		validator,
 		senderService,
+		schedulerService,
+		config.SendTimeout,
+		config.MessageMaxTTL,
+		config.Scheduler.MaxDelay,
+		config.MaxBinarySize,
+		config.Batch,
 	}
 }
 
+// defaultSender - sender of the messages received through the api
+const defaultSender = "api"
+
+// maxMetadataSize - max size of the metadata part of the multipart body
+const maxMetadataSize = 1 << 20
+
+const (
+	// multipartMetadata - part of the multipart body with SendBodyDto
+	multipartMetadata = "metadata"
+	// multipartData - part of the multipart body with binary data
+	multipartData = "data"
+)
+
 type SendBodyDto struct {
-	DeviceID *uuid.UUID `json:"device_id"`
-	Text     string     `json:"text" validate:"required"`
+	DeviceID *uuid.UUID `json:"device_id" query:"device_id"`
+	// DeviceIDs - send to the listed devices, can't be used with device_id and topic
+	DeviceIDs []uuid.UUID `json:"device_ids"`
+	// Topic - send to the devices subscribed to the topic, can't be used with device_id
+	Topic string `json:"topic" query:"topic" validate:"max=256"`
+	// ExcludeDeviceIDs - devices that don't receive the message, can't be used with device_id
+	ExcludeDeviceIDs []uuid.UUID `json:"exclude_device_ids"`
+	// Type - kind of the message for the device, e.g. notification or command
+	Type    string            `json:"type" query:"type" validate:"max=64"`
+	Headers map[string]string `json:"headers"`
+	Text    string            `json:"text" validate:"required_without_all=Payload Binary"`
+	// Payload - arbitrary json passed to the device as is
+	Payload json.RawMessage `json:"payload" swaggertype:"object"`
+	// Binary - data of application/octet-stream or multipart body
+	Binary []byte `json:"-" swaggerignore:"true"`
+	// TTL - how long the message may wait for delivery including the time in the mailbox
+	// of the offline device, e.g. 30s or 1h. The request waits for connected devices
+	// to accept the message up to ttl
+	TTL string `json:"ttl" query:"ttl" example:"30s"`
+	// SendAt - RFC 3339 time to send the message at, can't be used with delay
+	SendAt string `json:"send_at" query:"send_at" example:"2030-01-02T15:04:05Z"`
+	// Delay - send the message after the delay, e.g. 10m
+	Delay string `json:"delay" query:"delay" example:"10m"`
+	// Report - return what has happened to the message on every target
+	Report bool `json:"report" query:"report"`
+}
+
+type SendResponse struct {
+	// ID of the message to check its delivery status
+	ID uuid.UUID `json:"id"`
+	// Report - set if requested
+	Report *SendReportDto `json:"report,omitempty"`
+}
+
+// SendReportDto - outcomes of the message on the targets connected to this instance,
+// devices of other instances reached by the broadcast are not counted
+type SendReportDto struct {
+	Targets int `json:"targets"`
+	// Delivered - written to the device connection
+	Delivered int `json:"delivered"`
+	// Accepted - waits in the outbox of the device connection, may still expire or be dropped
+	Accepted int `json:"accepted"`
+	// Queued - kept in the mailbox of the offline device
+	Queued int `json:"queued"`
+	// Forwarded - passed to the instance the device is connected to
+	Forwarded int `json:"forwarded"`
+	// TimedOut - not accepted by the connection within ttl or SEND_TIMEOUT
+	TimedOut int `json:"timed_out"`
+	// Dropped - rejected by the full outbox of the connection
+	Dropped int `json:"dropped"`
+	// NotFound - device is offline and the mailbox is disabled
+	NotFound int `json:"not_found"`
+	// Devices - outcome of every target device, omitted for broadcasts: delivered, accepted,
+	// queued, forwarded, timed_out, dropped or not_found
+	Devices map[uuid.UUID]device.Outcome `json:"devices,omitempty" swaggertype:"object,string"`
+}
+
+func newSendReportDto(report device.Report) *SendReportDto {
+	return &SendReportDto{
+		Targets:   report.Targets,
+		Delivered: report.Delivered,
+		Accepted:  report.Accepted,
+		Queued:    report.Queued,
+		Forwarded: report.Forwarded,
+		TimedOut:  report.TimedOut,
+		Dropped:   report.Dropped,
+		NotFound:  report.NotFound,
+		Devices:   report.Devices,
+	}
 }
 
 // Send godoc
 //
 //	@Summary		send message to the devices
 //	@Description	send message to the device with id in body or to lthe all devices if id is not provided in body
+//	@Description	messages to the offline device are queued and delivered when it reconnects
+//	@Description	if topic is provided the message is sent only to the devices subscribed to it
+//	@Description	with device_ids the message is sent to every listed device, offline ones get it in the mailbox
+//	@Description	and are reported as not found if the mailbox is disabled
+//	@Description	exclude_device_ids are skipped by broadcasts, topic and device_ids messages
+//	@Description	binary data is accepted as application/octet-stream body with device_id, topic and type
+//	@Description	in query or as multipart body with "metadata" json part and "data" part
+//	@Description	message that has not been written to the connection within ttl or SEND_TIMEOUT if ttl is not set
+//	@Description	is expired, messages of the offline device wait in the mailbox for ttl or MAILBOX_MAX_AGE
+//	@Description	messages wait for the connection in the outbox of OUTBOUND_QUEUE_SIZE, when it is full
+//	@Description	OUTBOUND_POLICY drops the oldest or the new message, disconnects the slow device or blocks
+//	@Description	with send_at or delay the message is scheduled and 202 with the scheduled message is returned,
+//	@Description	ttl of the scheduled message counts from the time it is sent
+//	@Description	with report the response has outcome of the message on the targets and the request fails
+//	@Description	only if the message can't be accepted, without report it fails if the message has reached no target
+//	@Description	the device is reported delivered once the message is written to its connection and accepted while
+//	@Description	the message waits in the outbox, the delivery status has the final outcome of the accepted message
 //	@Tags			sender
-//	@Accept			json
+//	@Accept			json,octet-stream,mpfd
 //	@Param			body			body		SendBodyDto	true	"Data"
+//	@Param			device_id		query		string		false	"Target device of the binary message"
+//	@Param			topic			query		string		false	"Target topic of the binary message"
+//	@Param			type			query		string		false	"Type of the binary message"
+//	@Param			ttl				query		string		false	"TTL of the binary message"
+//	@Param			send_at			query		string		false	"Time to send the binary message at"
+//	@Param			delay			query		string		false	"Delay of the binary message"
+//	@Param			report			query		bool		false	"Return delivery report"
+//	@Param			X-API-Key	header		string	false	"Key of the client with send:device or send:broadcast scope"
 //	@Produce		json
-//	@Success		200
+//	@Success		200	{object}	SendResponse
+//	@Success		202	{object}	ScheduledMessageDto
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope, send:broadcast is required for topic and all devices"
+//	@Failure		503	{object}	ErrorResponse	"Outbox of every target device is full"
+//	@Failure		504	{object}	ErrorResponse	"Message has expired before the device accepted it"
 //	@Router			/api/v1/send [post]
 func (ctl *Sender) Send() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		body := new(SendBodyDto)
+		body, err := ctl.parseBody(c)
+		if err != nil {
+			return err
+		}
+
+		result, err := ctl.dispatch(c.Context(), middleware.RequestAPIKey(c), middleware.RequestTenant(c), body, c.QueryBool("report"))
+		if err != nil {
+			return err
+		}
+
+		if result.scheduled != nil {
+			return c.Status(fiber.StatusAccepted).JSON(result.scheduled)
+		}
+
+		return c.JSON(result.sent)
+	}
+}
+
+// sendResult - response to the message sent or scheduled by dispatch
+type sendResult struct {
+	sent      *SendResponse
+	scheduled *ScheduledMessageDto
+}
+
+// dispatch validates the message and sends or schedules it to the devices of the tenant on
+// behalf of the api key
+func (ctl *Sender) dispatch(ctx context.Context, key *middleware.APIKey, tenant string, body *SendBodyDto, report bool) (sendResult, error) {
+	if err := ctl.validator.Struct(*body); err != nil {
+		return sendResult{}, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := ctl.validateTarget(body); err != nil {
+		return sendResult{}, err
+	}
+
+	target := device.Target{
+		Tenant:    tenant,
+		DeviceID:  body.DeviceID,
+		DeviceIDs: body.DeviceIDs,
+		Topic:     body.Topic,
+		Exclude:   body.ExcludeDeviceIDs,
+	}
+	if err := authorizeTarget(key, target); err != nil {
+		return sendResult{}, err
+	}
+	if len(body.Payload) > 0 && !json.Valid(body.Payload) {
+		return sendResult{}, fiber.NewError(fiber.StatusBadRequest, "payload is not valid json")
+	}
+
+	ttl, err := ctl.parseTTL(body.TTL)
+	if err != nil {
+		return sendResult{}, err
+	}
+
+	sendAt, err := ctl.parseSendAt(body.SendAt, body.Delay)
+	if err != nil {
+		return sendResult{}, err
+	}
+
+	content := device.Content{
+		Type:    body.Type,
+		Headers: body.Headers,
+		Text:    body.Text,
+		Payload: body.Payload,
+		Binary:  body.Binary,
+		Sender:  defaultSender,
+		TTL:     ttl,
+	}
+
+	if !sendAt.IsZero() {
+		item, err := ctl.schedulerService.Schedule(target, content, sendAt)
+		if err != nil {
+			return sendResult{}, err
+		}
+
+		scheduled := newScheduledMessageDto(item)
+
+		return sendResult{scheduled: &scheduled}, nil
+	}
+
+	timeout := ctl.sendTimeout
+	if ttl > 0 {
+		timeout = ttl
+	}
+
+	innterCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if body.Report || report {
+		report, err := ctl.senderService.Send(innterCtx, target, content)
+		if err != nil {
+			return sendResult{}, err
+		}
+
+		return sendResult{sent: &SendResponse{ID: report.MessageID, Report: newSendReportDto(report)}}, nil
+	}
+
+	id, err := ctl.senderService.SendMessage(innterCtx, target, content)
+	if err != nil {
+		return sendResult{}, err
+	}
+
+	return sendResult{sent: &SendResponse{ID: id}}, nil
+}
+
+type SendBatchBodyDto struct {
+	// Items - messages of the batch, each is validated and sent as the body of /send
+	Items []SendBodyDto `json:"items" validate:"required,min=1"`
+	// Report - return delivery report of every message
+	Report bool `json:"report"`
+}
+
+type SendBatchResultDto struct {
+	// Status - status /send would have responded with to the message
+	Status int `json:"status"`
+	// Error - why the message has failed
+	Error     string               `json:"error,omitempty"`
+	Message   *SendResponse        `json:"message,omitempty"`
+	Scheduled *ScheduledMessageDto `json:"scheduled,omitempty"`
+}
+
+// SendBatch godoc
+//
+//	@Summary		send batch of messages
+//	@Description	send many distinct messages in one request, every item is the body of /send without binary data
+//	@Description	items are validated and sent concurrently, one failed item doesn't fail the others
+//	@Description	results are in the order of the items, status of the result is the one /send would have responded with
+//	@Tags			sender
+//	@Accept			json
+//	@Param			body			body		SendBatchBodyDto	true	"Data"
+//	@Param			report			query		bool				false	"Return delivery report of every message"
+//	@Param			X-API-Key	header		string	false	"Key of the client with send:device or send:broadcast scope"
+//	@Produce		json
+//	@Success		200	{object}	dto.ArrayResponse[SendBatchResultDto]
+//	@Failure		401	{object}	ErrorResponse	"API key is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"API key doesn't have the scope, send:broadcast is required for topic and all devices"
+//	@Router			/api/v1/send/batch [post]
+func (ctl *Sender) SendBatch() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		body := new(SendBatchBodyDto)
 		if err := c.BodyParser(body); err != nil {
 			return fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
-		if err := ctl.validator.Struct(*body); err != nil {
-			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+
+		results, err := ctl.dispatchBatch(c.Context(), middleware.RequestAPIKey(c), middleware.RequestTenant(c), body.Items, body.Report || c.QueryBool("report"))
+		if err != nil {
+			return err
 		}
 
-		innterCtx, cancel := context.WithTimeout(c.Context(), 10*time.Second)
-		defer cancel()
+		return c.JSON(dto.ArrayResponse[SendBatchResultDto]{Items: utils.Map(results, newSendBatchResultDto)})
+	}
+}
 
-		if err := ctl.senderService.SendMessage(innterCtx, body.DeviceID, body.Text); err != nil {
-			return err
+// batchResult - result of the batch item
+type batchResult struct {
+	sendResult
+	err error
+}
+
+func newSendBatchResultDto(result batchResult) SendBatchResultDto {
+	if result.err != nil {
+		status, message := middleware.ErrorStatus(result.err)
+
+		return SendBatchResultDto{Status: status, Error: message}
+	}
+
+	if result.scheduled != nil {
+		return SendBatchResultDto{Status: fiber.StatusAccepted, Scheduled: result.scheduled}
+	}
+
+	return SendBatchResultDto{Status: fiber.StatusOK, Message: result.sent}
+}
+
+// dispatchBatch dispatches the items concurrently, results are in the order of the items
+func (ctl *Sender) dispatchBatch(ctx context.Context, key *middleware.APIKey, tenant string, items []SendBodyDto, report bool) ([]batchResult, error) {
+	if len(items) == 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "items are required")
+	}
+	if len(items) > ctl.batch.MaxSize {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "batch can't have more than "+strconv.Itoa(ctl.batch.MaxSize)+" items")
+	}
+
+	results := make([]batchResult, len(items))
+
+	wg := sync.WaitGroup{}
+	// slots limits amount of the messages sent at once
+	slots := make(chan struct{}, ctl.batch.Concurrency)
+
+	for i := range items {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			result, err := ctl.dispatch(ctx, key, tenant, &items[i], report)
+			results[i] = batchResult{result, err}
+		}(i)
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
+
+// validateTarget checks the target fields of the body can be used together
+func (ctl *Sender) validateTarget(body *SendBodyDto) error {
+	targets := 0
+	if body.DeviceID != nil {
+		targets++
+	}
+	if len(body.DeviceIDs) > 0 {
+		targets++
+	}
+	if body.Topic != "" {
+		targets++
+	}
+
+	if targets > 1 {
+		return fiber.NewError(fiber.StatusBadRequest, "only one of device_id, device_ids and topic can be used")
+	}
+	if body.DeviceID != nil && len(body.ExcludeDeviceIDs) > 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "exclude_device_ids can't be used with device_id")
+	}
+	if len(body.DeviceIDs) > ctl.batch.MaxSize || len(body.ExcludeDeviceIDs) > ctl.batch.MaxSize {
+		return fiber.NewError(fiber.StatusBadRequest, "device lists can't have more than "+strconv.Itoa(ctl.batch.MaxSize)+" ids")
+	}
+
+	return nil
+}
+
+// authorizeTarget checks the key may send to the target, sending to the topic or all
+// devices is a broadcast and needs its own scope
+func authorizeTarget(key *middleware.APIKey, target device.Target) error {
+	scope := middleware.ScopeSendBroadcast
+	if kind := target.Kind(); kind == device.TargetDevice || kind == device.TargetDevices {
+		scope = middleware.ScopeSendDevice
+	}
+
+	if !key.Allows(scope) {
+		return errors.ErrForbidden
+	}
+
+	return nil
+}
+
+// parseTTL returns ttl of the message, 0 if it is not set
+func (ctl *Sender) parseTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fiber.NewError(fiber.StatusBadRequest, "ttl is not valid duration: "+err.Error())
+	}
+
+	if ttl <= 0 || ttl > ctl.maxTTL {
+		return 0, fiber.NewError(fiber.StatusBadRequest, "ttl must be positive and not greater than "+ctl.maxTTL.String())
+	}
+
+	return ttl, nil
+}
+
+// parseSendAt returns time the message is scheduled to, zero if it must be sent now
+func (ctl *Sender) parseSendAt(sendAt, delay string) (time.Time, error) {
+	if sendAt != "" && delay != "" {
+		return time.Time{}, fiber.NewError(fiber.StatusBadRequest, "send_at and delay can't be used together")
+	}
+
+	var at time.Time
+
+	switch {
+	case sendAt != "":
+		var err error
+		if at, err = time.Parse(time.RFC3339, sendAt); err != nil {
+			return time.Time{}, fiber.NewError(fiber.StatusBadRequest, "send_at is not valid RFC 3339 time: "+err.Error())
+		}
+	case delay != "":
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return time.Time{}, fiber.NewError(fiber.StatusBadRequest, "delay is not valid duration")
+		}
+		at = time.Now().Add(d)
+	default:
+		return time.Time{}, nil
+	}
+
+	if at.After(time.Now().Add(ctl.maxDelay)) {
+		return time.Time{}, fiber.NewError(fiber.StatusBadRequest, "message can't be scheduled later than "+ctl.maxDelay.String())
+	}
+
+	return at, nil
+}
+
+// parseBody reads json, binary or multipart body of the send request
+func (ctl *Sender) parseBody(c *fiber.Ctx) (*SendBodyDto, error) {
+	body := new(SendBodyDto)
+
+	mediaType, params, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	if err != nil {
+		mediaType = fiber.MIMEApplicationJSON
+	}
+
+	switch mediaType {
+	case fiber.MIMEOctetStream:
+		if err := c.QueryParser(body); err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
 
-		return c.SendStatus(fiber.StatusOK)
+		if body.Binary, err = ctl.readBinary(ctl.bodyReader(c)); err != nil {
+			return nil, err
+		}
+	case fiber.MIMEMultipartForm:
+		if err := ctl.parseMultipart(ctl.bodyReader(c), params["boundary"], body); err != nil {
+			return nil, err
+		}
+	default:
+		if err := c.BodyParser(body); err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+	}
+
+	return body, nil
+}
+
+// parseMultipart reads parts of the body one by one without buffering the whole form
+func (ctl *Sender) parseMultipart(r io.Reader, boundary string, body *SendBodyDto) error {
+	if boundary == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "multipart boundary is missing")
 	}
+
+	reader := multipart.NewReader(r, boundary)
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		switch part.FormName() {
+		case multipartMetadata:
+			if err := json.NewDecoder(io.LimitReader(part, maxMetadataSize)).Decode(body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "metadata is not valid json: "+err.Error())
+			}
+		case multipartData:
+			if body.Binary, err = ctl.readBinary(part); err != nil {
+				return err
+			}
+		}
+
+		part.Close()
+	}
+}
+
+// readBinary reads the data up to the max binary size
+func (ctl *Sender) readBinary(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, ctl.maxBinarySize+1))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if int64(len(data)) > ctl.maxBinarySize {
+		return nil, fiber.ErrRequestEntityTooLarge
+	}
+
+	// empty body is not binary message
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	return data, nil
+}
+
+// bodyReader returns stream of the request body, so it is read only once
+func (ctl *Sender) bodyReader(c *fiber.Ctx) io.Reader {
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		return stream
+	}
+
+	return bytes.NewReader(c.Body())
 }
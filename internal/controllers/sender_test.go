@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/services/device"
+
+	"github.com/go-playground/validator"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// textSender remembers the text of every sent message by its id
+type textSender struct {
+	texts sync.Map
+}
+
+func (s *textSender) SendMessage(ctx context.Context, target device.Target, content device.Content) (uuid.UUID, error) {
+	// items finish in random order
+	time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+
+	id := uuid.New()
+	s.texts.Store(id, content.Text)
+
+	return id, nil
+}
+
+func (s *textSender) Send(ctx context.Context, target device.Target, content device.Content) (device.Report, error) {
+	id, err := s.SendMessage(ctx, target, content)
+
+	return device.Report{MessageID: id}, err
+}
+
+func newTestSender(sender SenderService, batch config.BatchConfig) *Sender {
+	return NewSender(&config.Config{SendTimeout: time.Second, Batch: batch}, validator.New(), sender, nil)
+}
+
+// Test results of the batch are in the order of the items and the invalid item doesn't
+// fail the others
+func TestDispatchBatch(t *testing.T) {
+	sender := &textSender{}
+	ctl := newTestSender(sender, config.BatchConfig{MaxSize: 20, Concurrency: 4})
+
+	items := make([]SendBodyDto, 20)
+	for i := range items {
+		items[i] = SendBodyDto{Text: strconv.Itoa(i)}
+	}
+	// neither text nor payload
+	items[7] = SendBodyDto{}
+
+	results, err := ctl.dispatchBatch(context.Background(), nil, "", items, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(items) {
+		t.Fatalf("wrong amount of results: %d", len(results))
+	}
+
+	for i, result := range results {
+		dto := newSendBatchResultDto(result)
+
+		if i == 7 {
+			if dto.Status != fiber.StatusBadRequest || dto.Error == "" {
+				t.Errorf("invalid item must fail with 400: %+v", dto)
+			}
+			continue
+		}
+
+		if dto.Status != fiber.StatusOK {
+			t.Errorf("item %d has failed: %+v", i, dto)
+			continue
+		}
+
+		if text, _ := sender.texts.Load(dto.Message.ID); text != items[i].Text {
+			t.Errorf("result %d is of the item %v", i, text)
+		}
+	}
+}
+
+// Test batch over BATCH_MAX_SIZE is rejected as a whole
+func TestDispatchBatchMaxSize(t *testing.T) {
+	sender := &textSender{}
+	ctl := newTestSender(sender, config.BatchConfig{MaxSize: 2, Concurrency: 2})
+
+	items := []SendBodyDto{{Text: "1"}, {Text: "2"}, {Text: "3"}}
+
+	_, err := ctl.dispatchBatch(context.Background(), nil, "", items, false)
+
+	var fiberErr *fiber.Error
+	if !errors.As(err, &fiberErr) || fiberErr.Code != fiber.StatusBadRequest {
+		t.Errorf("expected 400, got: %v", err)
+	}
+
+	sent := 0
+	sender.texts.Range(func(any, any) bool {
+		sent++
+		return true
+	})
+	if sent != 0 {
+		t.Errorf("no item of the rejected batch must be sent: %d", sent)
+	}
+
+	if _, err := ctl.dispatchBatch(context.Background(), nil, "", items[:2], false); err != nil {
+		t.Errorf("batch of BATCH_MAX_SIZE must be accepted: %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type StreamService interface {
+	Register(id uuid.UUID, info device.ConnectionInfo) (*device.Session, error)
+	Drain(id uuid.UUID) []device.Message
+	Replay(id, messageID uuid.UUID) ([]device.Message, bool)
+	Close(session *device.Session, reason device.DisconnectReason) error
+	Delivered(deviceID, messageID uuid.UUID) error
+}
+
+const (
+	eventMessage = "message"
+	eventBinary  = "binary"
+	eventClose   = "close"
+)
+
+// closeEvent is written to the stream closed by the server
+type closeEvent struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+type Stream struct {
+	log           log.Logger
+	streamService StreamService
+	keepAlive     time.Duration
+	idleTimeout   time.Duration
+}
+
+func NewStream(log log.Logger, config *config.Config, streamService StreamService) *Stream {
+	return &Stream{
+		log,
+		streamService,
+		config.SSE.KeepAlive,
+		config.Heartbeat.IdleTimeout,
+	}
+}
+
+// Connect godoc
+//
+//	@Summary		open connect via server-sent events
+//	@Description	open connect via server-sent events for the clients that can't use websocket
+//	@Description	every message is written as "message" event with the envelope or bare text for format=raw,
+//	@Description	binary data follows in "binary" event encoded with base64, id of the event is id of the message
+//	@Description	reconnecting client sending Last-Event-ID header or last_event_id query parameter gets messages
+//	@Description	it has missed if they are kept for REPLAY_TTL, comment is written every SSE_KEEP_ALIVE
+//	@Description	stream closed by the server ends with "close" event with the code and reason
+//	@Description	the connection is registered the same way as the websocket one and follows SESSION_POLICY
+//	@Description	the device of the tenant connects to /api/v1/{tenant}/sse/{id} the same way as to the websocket
+//	@Param			id				path		string	true	"Unique id of the connecting device"
+//	@Param			format			query		string	false	"Format of the messages" Enums(envelope, raw)
+//	@Param			Last-Event-ID	header		string	false	"Id of the last received message"
+//	@Param			last_event_id	query		string	false	"Id of the last received message"
+//	@Param			token			query		string	false	"Token of the device, may be passed in Authorization header"
+//	@Tags			device
+//	@Produce		text/event-stream
+//	@Success		200
+//	@Failure		400	{object}	ErrorResponse	"Id is not valid or the device is already connected"
+//	@Failure		401	{object}	ErrorResponse	"Token is missing or invalid"
+//	@Failure		403	{object}	ErrorResponse	"Device is banned"
+//	@Failure		404	{object}	ErrorResponse	"Tenant not found"
+//	@Failure		503	{object}	ErrorResponse	"Tenant has reached TENANT_MAX_DEVICES"
+//	@Router			/api/v1/sse/{id} [get]
+func (s *Stream) Connect(ctx context.Context) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := uuid.Parse(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "id is not valid uuid")
+		}
+
+		var lastEventID *uuid.UUID
+		if value := c.Get(fiber.HeaderLastEventID, c.Query("last_event_id")); value != "" {
+			parsed, err := uuid.Parse(value)
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "last event id is not valid uuid")
+			}
+			lastEventID = &parsed
+		}
+
+		session, err := s.streamService.Register(id, device.ConnectionInfo{
+			RemoteIP:  c.IP(),
+			UserAgent: c.Get(fiber.HeaderUserAgent),
+			Transport: device.TransportSSE,
+			Tenant:    middleware.RequestTenant(c),
+		})
+		if err != nil {
+			return err
+		}
+
+		raw := c.Query("format") == protocolRaw
+
+		// messages missed since the last event go before the ones queued while offline
+		var backlog []device.Message
+		if lastEventID != nil {
+			if missed, ok := s.streamService.Replay(id, *lastEventID); ok {
+				backlog = missed
+			}
+		}
+		backlog = append(backlog, s.streamService.Drain(id)...)
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Set("X-Accel-Buffering", "no")
+
+		// the writer outlives the handler, fiber.Ctx must not be used inside
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			s.stream(ctx, w, session, backlog, raw)
+		})
+
+		return nil
+	}
+}
+
+func (s *Stream) stream(ctx context.Context, w *bufio.Writer, session *device.Session, backlog []device.Message, raw bool) {
+	// the comment opens the stream so the client sees the connection established
+	if err := s.flush(w, []byte(": connected\n\n")); err != nil {
+		s.disconnect(session, device.DisconnectWriteError)
+		return
+	}
+
+	for _, msg := range backlog {
+		if err := s.write(w, session, msg, raw); err != nil {
+			s.log.Errorf("write: %v", err)
+			s.disconnect(session, device.DisconnectWriteError)
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(s.keepAlive)
+	defer keepAlive.Stop()
+
+	// idle fires when there have been no messages for the idle timeout, nil if disabled
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if s.idleTimeout > 0 {
+		idleTimer = time.NewTimer(s.idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	active := func() {
+		if idleTimer == nil {
+			return
+		}
+
+		if !idleTimer.Stop() {
+			select {
+			case <-idleTimer.C:
+			default:
+			}
+		}
+		idleTimer.Reset(s.idleTimeout)
+	}
+
+	for {
+		select {
+		case msg := <-session.Messages():
+			if err := s.write(w, session, msg, raw); err != nil {
+				s.log.Errorf("write: %v", err)
+				s.disconnect(session, device.DisconnectWriteError)
+				return
+			}
+
+			active()
+		case <-keepAlive.C:
+			// the client is gone when the comment can't be written
+			if err := s.flush(w, []byte(": ping\n\n")); err != nil {
+				s.disconnect(session, device.DisconnectNormal)
+				return
+			}
+		case <-idle:
+			s.log.Infof("device %s has been idle for %s", session.DeviceID, s.idleTimeout)
+			s.disconnect(session, device.DisconnectIdle)
+			s.writeClose(w, idleFrame)
+			return
+		case frame := <-session.Closed():
+			// session has been closed by the server and is already unregistered
+			s.writeClose(w, frame)
+			return
+		case <-ctx.Done():
+			s.disconnect(session, device.DisconnectShutdown)
+			return
+		}
+	}
+}
+
+// write writes the message event, binary data follows in the separate event. Id is set
+// on the last event of the message, so the resumed client doesn't lose its part
+func (s *Stream) write(w *bufio.Writer, session *device.Session, msg device.Message, raw bool) error {
+	data, err := encodeMessage(msg, raw)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if data != nil {
+		var eventID *uuid.UUID
+		if msg.Binary == nil {
+			eventID = &msg.ID
+		}
+		writeEvent(&buf, eventID, eventMessage, data)
+	}
+
+	if msg.Binary != nil {
+		writeEvent(&buf, &msg.ID, eventBinary, []byte(base64.StdEncoding.EncodeToString(msg.Binary)))
+	}
+
+	if err := s.flush(w, buf.Bytes()); err != nil {
+		return err
+	}
+
+	session.CountOutbound()
+
+	if err := s.streamService.Delivered(session.DeviceID, msg.ID); err != nil {
+		s.log.Warnf("failed to mark message %s delivered to device %s: %v", msg.ID, session.DeviceID, err)
+	}
+
+	return nil
+}
+
+// writeClose writes the close event, the stream is closed by the caller
+func (s *Stream) writeClose(w *bufio.Writer, frame device.CloseFrame) {
+	data, err := json.Marshal(closeEvent{Code: frame.Code, Reason: frame.Reason})
+	if err != nil {
+		s.log.Errorf("close: %v", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	writeEvent(&buf, nil, eventClose, data)
+
+	if err := s.flush(w, buf.Bytes()); err != nil {
+		s.log.Errorf("close: %v", err)
+	}
+}
+
+func (s *Stream) flush(w *bufio.Writer, data []byte) error {
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func (s *Stream) disconnect(session *device.Session, reason device.DisconnectReason) {
+	if err := s.streamService.Close(session, reason); err != nil {
+		s.log.Errorf("close: %v", err)
+	}
+}
+
+// writeEvent formats the event, every line of the data gets its own data field
+func writeEvent(buf *bytes.Buffer, id *uuid.UUID, event string, data []byte) {
+	if id != nil {
+		buf.WriteString("id: " + id.String() + "\n")
+	}
+	buf.WriteString("event: " + event + "\n")
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,292 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/middleware"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// sseEvent is the event or the comment read from the stream
+type sseEvent struct {
+	id      string
+	event   string
+	data    string
+	comment string
+}
+
+// newTestStream serves server-sent events of the devices, disconnect reasons are passed
+// to the returned channel
+func newTestStream(t *testing.T, policy string) (string, *device.Service, disconnects) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	cfg := &config.Config{
+		SessionPolicy: policy,
+		Replay:        config.ReplayConfig{Size: 10, TTL: time.Minute},
+		SSE:           config.SSEConfig{KeepAlive: 20 * time.Millisecond},
+	}
+
+	mw, err := middleware.New(log.New(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(disconnects, 8)
+	service := device.New(log.New(), cfg, device.WithEventSubscriber(events))
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true, ErrorHandler: mw.ErrorHandler()})
+	app.Get("/sse/:id", NewStream(log.New(), cfg, service).Connect(ctx))
+
+	return serve(t, app), service, events
+}
+
+// openStream connects the device and passes events of the stream to the returned channel,
+// the channel is closed when the stream ends
+func openStream(t *testing.T, addr string, id uuid.UUID, query string, lastEventID string) (chan sseEvent, func()) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/sse/"+id.String()+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set(fiber.HeaderLastEventID, lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		resp.Body.Close()
+	})
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream has failed with %d", resp.StatusCode)
+	}
+
+	events := make(chan sseEvent, 64)
+	go func() {
+		defer close(events)
+
+		reader := bufio.NewReader(resp.Body)
+		event := sseEvent{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+
+			switch {
+			case line == "":
+				events <- event
+				event = sseEvent{}
+			case strings.HasPrefix(line, ":"):
+				event.comment = strings.TrimSpace(line[1:])
+			case strings.HasPrefix(line, "id: "):
+				event.id = line[len("id: "):]
+			case strings.HasPrefix(line, "event: "):
+				event.event = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				// lines of the data are joined back
+				if event.data != "" {
+					event.data += "\n"
+				}
+				event.data += line[len("data: "):]
+			}
+		}
+	}()
+
+	return events, func() {
+		resp.Body.Close()
+	}
+}
+
+// opened waits for the comment opening the stream, the device is connected by then
+func opened(t *testing.T, events chan sseEvent) {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if event.comment != "connected" {
+			t.Fatalf("stream must be opened by the comment: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream has not been opened")
+	}
+}
+
+// nextEvent returns the next event of the stream skipping the comments
+func nextEvent(t *testing.T, events chan sseEvent) sseEvent {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("stream has ended")
+			}
+			if event.comment != "" {
+				continue
+			}
+			return event
+		case <-timeout:
+			t.Fatal("no event in the stream")
+		}
+	}
+}
+
+func eventText(t *testing.T, event sseEvent) string {
+	t.Helper()
+
+	var e envelope
+	if err := json.Unmarshal([]byte(event.data), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	return e.Text
+}
+
+// Test the reconnecting client gets the messages after Last-Event-ID again
+func TestStreamResume(t *testing.T) {
+	addr, service, events := newTestStream(t, "reject")
+	id := uuid.New()
+
+	stream, closeStream := openStream(t, addr, id, "", "")
+	opened(t, stream)
+
+	sendText(t, service, id, "1")
+	first := nextEvent(t, stream)
+	sendText(t, service, id, "2")
+	second := nextEvent(t, stream)
+
+	if first.event != eventMessage || first.id == "" || eventText(t, first) != "1" || eventText(t, second) != "2" {
+		t.Fatalf("wrong events: %+v, %+v", first, second)
+	}
+
+	// the server finds the client gone by the keepalive
+	closeStream()
+	if reason := disconnected(t, events); reason != string(device.DisconnectNormal) {
+		t.Errorf("wrong reason: %s", reason)
+	}
+
+	stream, _ = openStream(t, addr, id, "", first.id)
+	opened(t, stream)
+
+	if replayed := nextEvent(t, stream); replayed.id != second.id || eventText(t, replayed) != "2" {
+		t.Errorf("message after the last event must be replayed: %+v", replayed)
+	}
+}
+
+// Test the comment is written to the idle stream every SSE_KEEP_ALIVE
+func TestStreamKeepAlive(t *testing.T) {
+	addr, _, _ := newTestStream(t, "reject")
+
+	stream, _ := openStream(t, addr, uuid.New(), "", "")
+
+	comments := map[string]int{}
+	timeout := time.After(5 * time.Second)
+	for comments["ping"] < 2 {
+		select {
+		case event := <-stream:
+			comments[event.comment]++
+		case <-timeout:
+			t.Fatalf("keepalive comments have not been written: %v", comments)
+		}
+	}
+
+	if comments["connected"] != 1 {
+		t.Errorf("stream must be opened by the comment: %v", comments)
+	}
+}
+
+// Test the raw stream gets bare text of the messages
+func TestStreamRaw(t *testing.T) {
+	addr, service, _ := newTestStream(t, "reject")
+	id := uuid.New()
+
+	stream, _ := openStream(t, addr, id, "?format=raw", "")
+	opened(t, stream)
+
+	sendText(t, service, id, "hello\nworld")
+
+	if event := nextEvent(t, stream); event.event != eventMessage || event.data != "hello\nworld" {
+		t.Errorf("wrong raw event: %+v", event)
+	}
+}
+
+// Test the connected device connecting again is rejected with the default policy
+func TestStreamReject(t *testing.T) {
+	addr, _, _ := newTestStream(t, "reject")
+	id := uuid.New()
+
+	stream, _ := openStream(t, addr, id, "", "")
+	opened(t, stream)
+
+	resp, err := http.Get("http://" + addr + "/sse/" + id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("second connection must be rejected, got %d", resp.StatusCode)
+	}
+}
+
+// Test the new connection replaces the old one with takeover policy and the closed stream
+// ends with the close event
+func TestStreamClose(t *testing.T) {
+	addr, service, events := newTestStream(t, "takeover")
+	id := uuid.New()
+
+	old, _ := openStream(t, addr, id, "", "")
+	opened(t, old)
+
+	stream, _ := openStream(t, addr, id, "", "")
+	opened(t, stream)
+
+	var frame closeEvent
+	if event := nextEvent(t, old); event.event != eventClose || json.Unmarshal([]byte(event.data), &frame) != nil || frame.Code != 4409 {
+		t.Errorf("replaced stream must be closed: %+v", event)
+	}
+	if reason := disconnected(t, events); reason != string(device.DisconnectReplaced) {
+		t.Errorf("wrong reason: %s", reason)
+	}
+
+	if err := service.Disconnect(context.Background(), "", id, device.CloseFrame{Code: 4000, Reason: "bye"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	event := nextEvent(t, stream)
+	if event.event != eventClose || json.Unmarshal([]byte(event.data), &frame) != nil || frame.Code != 4000 || frame.Reason != "bye" {
+		t.Errorf("wrong close event: %+v", event)
+	}
+	if reason := disconnected(t, events); reason != string(device.DisconnectAdmin) {
+		t.Errorf("wrong reason: %s", reason)
+	}
+
+	select {
+	case _, ok := <-stream:
+		if ok {
+			t.Error("stream must end after the close event")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("stream has not ended after the close event")
+	}
+}
@@ -6,3 +6,15 @@ import (
 
 var ErrDeviceAlreadyRegistered = e.New("device already registered")
 var ErrDeviceNotFound = e.New("device not found")
+var ErrMessageNotFound = e.New("message not found")
+var ErrHistoryDisabled = e.New("message history is disabled")
+var ErrMessageExpired = e.New("message expired before delivery")
+var ErrScheduledNotFound = e.New("scheduled message not found")
+var ErrScheduledNotPending = e.New("scheduled message has already been sent")
+var ErrDeviceBanned = e.New("device is banned")
+var ErrDeviceQueueFull = e.New("outbound queue of the device is full")
+var ErrUnauthorized = e.New("device token is missing or invalid")
+var ErrInvalidAPIKey = e.New("api key is missing or invalid")
+var ErrForbidden = e.New("api key is not allowed to do this")
+var ErrTenantNotFound = e.New("tenant not found")
+var ErrTenantLimit = e.New("tenant has reached the limit of connected devices")
@@ -0,0 +1,258 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Scope - what the api key allows
+type Scope string
+
+const (
+	// ScopeSendDevice - send messages to the listed devices
+	ScopeSendDevice Scope = "send:device"
+	// ScopeSendBroadcast - send messages to the topics and all devices
+	ScopeSendBroadcast Scope = "send:broadcast"
+	// ScopeDevicesRead - read devices, messages and their status
+	ScopeDevicesRead Scope = "devices:read"
+	// ScopeAdmin - everything including disconnecting the devices
+	ScopeAdmin Scope = "admin"
+)
+
+// HeaderAPIKey - header of the request with the api key, metadata of the grpc call as well
+const HeaderAPIKey = "X-API-Key"
+
+// apiKeyLocal - local of the request with the api key
+const apiKeyLocal = "api_key"
+
+// apiKeyContext - key of the grpc call context with the api key
+type apiKeyContext struct{}
+
+// tenantContext - key of the grpc call context with the tenant of the api key
+type tenantContext struct{}
+
+// APIKey is the client of the api
+type APIKey struct {
+	Name string
+	// Tenant - the key sends to and reads devices of the tenant only
+	Tenant string
+	Scopes []Scope
+}
+
+// Allows reports whether the key has the scope. The api is open if no keys are
+// configured, then the key is nil and allows everything
+func (k *APIKey) Allows(scope Scope) bool {
+	if k == nil {
+		return true
+	}
+
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// storedAPIKey - entry of API_KEYS_FILE
+type storedAPIKey struct {
+	Name      string  `json:"name"`
+	Tenant    string  `json:"tenant"`
+	KeySHA256 string  `json:"key_sha256"`
+	Scopes    []Scope `json:"scopes"`
+}
+
+// loadAPIKeys returns keys by sha256 of the key, nil if no keys are configured. Keys
+// without tenant belong to the default one
+func loadAPIKeys(cfg config.APIConfig, tenants config.TenantConfig) (map[string]*APIKey, error) {
+	if len(cfg.Keys) == 0 && cfg.KeysFile == "" {
+		return nil, nil
+	}
+
+	keys := make(map[string]*APIKey)
+
+	for _, entry := range cfg.Keys {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("api key must be name:key:scopes")
+		}
+
+		tenant, name, ok := strings.Cut(parts[0], "/")
+		if !ok {
+			tenant, name = tenants.Default, parts[0]
+		}
+		if !tenants.Allows(tenant) {
+			return nil, fmt.Errorf("api key %s: %w", name, errors.ErrTenantNotFound)
+		}
+
+		hash := sha256.Sum256([]byte(parts[1]))
+		keys[hex.EncodeToString(hash[:])] = &APIKey{Name: name, Tenant: tenant, Scopes: parseScopes(parts[2])}
+	}
+
+	if cfg.KeysFile != "" {
+		data, err := os.ReadFile(cfg.KeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read api keys: %w", err)
+		}
+
+		var stored []storedAPIKey
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("failed to parse api keys: %w", err)
+		}
+
+		for _, key := range stored {
+			if key.Name == "" || len(key.KeySHA256) != sha256.Size*2 {
+				return nil, fmt.Errorf("api key %q must have name and hex key_sha256", key.Name)
+			}
+
+			if key.Tenant == "" {
+				key.Tenant = tenants.Default
+			}
+			if !tenants.Allows(key.Tenant) {
+				return nil, fmt.Errorf("api key %s: %w", key.Name, errors.ErrTenantNotFound)
+			}
+
+			keys[strings.ToLower(key.KeySHA256)] = &APIKey{Name: key.Name, Tenant: key.Tenant, Scopes: key.Scopes}
+		}
+	}
+
+	return keys, nil
+}
+
+func parseScopes(value string) []Scope {
+	scopes := []Scope{}
+	for _, scope := range strings.Split(value, "|") {
+		scopes = append(scopes, Scope(scope))
+	}
+
+	return scopes
+}
+
+// apiKey returns the key by its value, error if the key is unknown
+func (m *Middleware) apiKey(value string) (*APIKey, error) {
+	if m.apiKeys == nil {
+		return nil, nil
+	}
+
+	if value == "" {
+		return nil, errors.ErrInvalidAPIKey
+	}
+
+	hash := sha256.Sum256([]byte(value))
+
+	key, ok := m.apiKeys[hex.EncodeToString(hash[:])]
+	if !ok {
+		return nil, errors.ErrInvalidAPIKey
+	}
+
+	return key, nil
+}
+
+// authorize returns the key if it has any of the scopes
+func (m *Middleware) authorize(value string, scopes []Scope) (*APIKey, error) {
+	key, err := m.apiKey(value)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, scope := range scopes {
+		if key.Allows(scope) {
+			return key, nil
+		}
+	}
+
+	return nil, errors.ErrForbidden
+}
+
+// APIKey rejects the request without the key having any of the scopes, the key and its
+// tenant are available to the handler by RequestAPIKey and RequestTenant
+func (m *Middleware) APIKey(scopes ...Scope) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		key, err := m.authorize(ctx.Get(HeaderAPIKey), scopes)
+		if err != nil {
+			return err
+		}
+
+		ctx.Locals(apiKeyLocal, key)
+		ctx.Locals(TenantLocal, m.keyTenant(key))
+
+		return ctx.Next()
+	}
+}
+
+// keyTenant returns tenant of the key, the default one if the api is open
+func (m *Middleware) keyTenant(key *APIKey) string {
+	if key == nil {
+		return m.config.Tenant.Default
+	}
+
+	return key.Tenant
+}
+
+// RequestAPIKey returns the key of the request, nil if the api is open
+func RequestAPIKey(ctx *fiber.Ctx) *APIKey {
+	key, _ := ctx.Locals(apiKeyLocal).(*APIKey)
+
+	return key
+}
+
+// ContextAPIKey returns the key of the grpc call, nil if the api is open
+func ContextAPIKey(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContext{}).(*APIKey)
+
+	return key
+}
+
+// ContextTenant returns tenant of the api key of the grpc call
+func ContextTenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContext{}).(string)
+
+	return tenant
+}
+
+// GRPCAPIKey rejects unary calls without the key having any of the scopes of the
+// method. Methods without scopes, e.g. device streams, are not checked
+func (m *Middleware) GRPCAPIKey(methods map[string][]Scope) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		scopes, ok := methods[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		var value string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(HeaderAPIKey); len(values) > 0 {
+				value = values[0]
+			}
+		}
+
+		key, err := m.authorize(value, scopes)
+		if err != nil {
+			code := codes.PermissionDenied
+			if err == errors.ErrInvalidAPIKey {
+				code = codes.Unauthenticated
+			}
+
+			return nil, status.Error(code, err.Error())
+		}
+
+		ctx = context.WithValue(ctx, apiKeyContext{}, key)
+		ctx = context.WithValue(ctx, tenantContext{}, m.keyTenant(key))
+
+		return handler(ctx, req)
+	}
+}
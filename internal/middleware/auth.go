@@ -0,0 +1,260 @@
+package middleware
+
+import (
+	e "errors"
+	"fmt"
+	"os"
+	"strings"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// DeviceAuthError - error of the device token or tenant, set for the websocket connection
+// that must be closed before registering the device
+const DeviceAuthError = "device_auth_error"
+
+// TenantLocal - tenant of the device or the api key, set by the device auth and api key
+// middlewares
+const TenantLocal = "tenant"
+
+// tenantClaim - claim of the device token with the tenant the device may connect to
+const tenantClaim = "tenant"
+
+const (
+	// tokenQuery - query parameter with the device token
+	tokenQuery = "token"
+	// bearerPrefix - prefix of the token in the Authorization header
+	bearerPrefix = "Bearer "
+	// protocolBearer - prefix of the websocket subprotocol with the token for the
+	// browsers that can't set headers, e.g. "envelope.v1, bearer.<token>"
+	protocolBearer = "bearer."
+)
+
+// verificationKey - key verifying tokens of one algorithm
+type verificationKey struct {
+	alg string
+	key interface{}
+}
+
+// deviceAuth verifies tokens of the devices
+type deviceAuth struct {
+	keys map[string]verificationKey
+	opts []jwt.ParserOption
+}
+
+func newDeviceAuth(cfg config.JWTConfig) (*deviceAuth, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, nil
+	}
+
+	auth := &deviceAuth{keys: make(map[string]verificationKey, len(cfg.Keys))}
+
+	algs := make([]string, 0, len(cfg.Keys))
+	for _, entry := range cfg.Keys {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("jwt key must be kid:alg:key")
+		}
+
+		kid, alg, value := parts[0], parts[1], parts[2]
+
+		key, err := parseVerificationKey(alg, value)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %s: %w", kid, err)
+		}
+
+		auth.keys[kid] = verificationKey{alg: alg, key: key}
+		algs = append(algs, alg)
+	}
+
+	auth.opts = []jwt.ParserOption{jwt.WithValidMethods(algs), jwt.WithLeeway(cfg.Leeway)}
+	if cfg.Issuer != "" {
+		auth.opts = append(auth.opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		auth.opts = append(auth.opts, jwt.WithAudience(cfg.Audience))
+	}
+
+	return auth, nil
+}
+
+// parseVerificationKey returns the secret or reads the public key from the PEM file
+func parseVerificationKey(alg, value string) (interface{}, error) {
+	if alg == jwt.SigningMethodHS256.Alg() {
+		return []byte(value), nil
+	}
+
+	data, err := os.ReadFile(value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		return jwt.ParseRSAPublicKeyFromPEM(data)
+	case jwt.SigningMethodEdDSA.Alg():
+		return jwt.ParseEdPublicKeyFromPEM(data)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", alg)
+	}
+}
+
+// verify checks the token is signed by one of the keys and issued to the device. Returns
+// tenant of the token, empty if the token doesn't have the claim
+func (a *deviceAuth) verify(token string, id uuid.UUID) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("%w: token is missing", errors.ErrUnauthorized)
+	}
+
+	opts := append([]jwt.ParserOption{jwt.WithSubject(id.String())}, a.opts...)
+
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		alg := t.Method.Alg()
+
+		// tokens without kid are verified by the key of their algorithm if it is the only one
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			var found interface{}
+			for _, key := range a.keys {
+				if key.alg == alg {
+					if found != nil {
+						return nil, fmt.Errorf("kid is required")
+					}
+					found = key.key
+				}
+			}
+			if found == nil {
+				return nil, fmt.Errorf("no key for %s", alg)
+			}
+
+			return found, nil
+		}
+
+		key, ok := a.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %s", kid)
+		}
+		if key.alg != alg {
+			return nil, fmt.Errorf("key %s is not for %s", kid, alg)
+		}
+
+		return key.key, nil
+	}, opts...)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errors.ErrUnauthorized, err)
+	}
+
+	claims, _ := parsed.Claims.(jwt.MapClaims)
+	tenant, _ := claims[tenantClaim].(string)
+
+	return tenant, nil
+}
+
+// AuthorizeDevice checks the token allows the device to connect and returns the tenant
+// the device connects to. Any token is allowed if no keys are configured
+func (m *Middleware) AuthorizeDevice(token, tenant string, id uuid.UUID) (string, error) {
+	var claim string
+	if m.deviceAuth != nil {
+		var err error
+		if claim, err = m.deviceAuth.verify(token, id); err != nil {
+			return "", err
+		}
+
+		// the token without the claim is issued for the default tenant only
+		if claim == "" {
+			claim = m.config.Tenant.Default
+		}
+	}
+
+	return m.deviceTenant(tenant, claim)
+}
+
+// deviceTenant returns tenant of the path or of the token claim, they must be the same
+// if both are set. The device connects to the default tenant without either, the claim
+// is always set if the tokens are verified
+func (m *Middleware) deviceTenant(path, claim string) (string, error) {
+	if path != "" && claim != "" && path != claim {
+		return "", fmt.Errorf("%w: token is issued for another tenant", errors.ErrUnauthorized)
+	}
+
+	tenant := path
+	if tenant == "" {
+		tenant = claim
+	}
+	if tenant == "" {
+		tenant = m.config.Tenant.Default
+	}
+
+	if !m.config.Tenant.Allows(tenant) {
+		return "", errors.ErrTenantNotFound
+	}
+
+	return tenant, nil
+}
+
+// DeviceAuth rejects the request of the device without valid token in the query or
+// Authorization header, the tenant of the device is available by RequestTenant
+func (m *Middleware) DeviceAuth() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		if err := m.authenticate(ctx, false); err != nil {
+			if !e.Is(err, errors.ErrUnauthorized) {
+				return err
+			}
+
+			m.logger.Warnf("device %s: %v", ctx.Params("id"), err)
+			return errors.ErrUnauthorized
+		}
+
+		return ctx.Next()
+	}
+}
+
+// authenticate verifies the token of the device with id in the path and sets the tenant
+// of the device. The websocket client may pass the token in the subprotocol as well
+func (m *Middleware) authenticate(ctx *fiber.Ctx, websocket bool) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "id is not valid uuid")
+	}
+
+	tenant, err := m.AuthorizeDevice(deviceToken(ctx, websocket), ctx.Params("tenant"), id)
+	if err != nil {
+		return err
+	}
+
+	ctx.Locals(TenantLocal, tenant)
+
+	return nil
+}
+
+// RequestTenant returns tenant of the device or the api key of the request
+func RequestTenant(ctx *fiber.Ctx) string {
+	tenant, _ := ctx.Locals(TenantLocal).(string)
+
+	return tenant
+}
+
+// deviceToken returns the token from the query, subprotocol or Authorization header
+func deviceToken(ctx *fiber.Ctx, websocket bool) string {
+	if token := ctx.Query(tokenQuery); token != "" {
+		return token
+	}
+
+	if websocket {
+		for _, protocol := range strings.Split(ctx.Get(fiber.HeaderSecWebSocketProtocol), ",") {
+			if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), protocolBearer); ok {
+				return token
+			}
+		}
+	}
+
+	if header := ctx.Get(fiber.HeaderAuthorization); strings.HasPrefix(header, bearerPrefix) {
+		return strings.TrimPrefix(header, bearerPrefix)
+	}
+
+	return ""
+}
@@ -0,0 +1,177 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	e "errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestDeviceAuth(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ed.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := newDeviceAuth(config.JWTConfig{
+		Keys:   []string{"main:HS256:secret", "next:HS256:other", "ed:EdDSA:" + path},
+		Issuer: "issuer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid.New()
+	claims := func(sub string) jwt.MapClaims {
+		return jwt.MapClaims{"sub": sub, "iss": "issuer", "exp": time.Now().Add(time.Minute).Unix()}
+	}
+	sign := func(method jwt.SigningMethod, kid string, claims jwt.MapClaims, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signed
+	}
+
+	expired := claims(id.String())
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"hs256", sign(jwt.SigningMethodHS256, "next", claims(id.String()), []byte("other")), true},
+		{"eddsa", sign(jwt.SigningMethodEdDSA, "ed", claims(id.String()), private), true},
+		{"eddsa without kid", sign(jwt.SigningMethodEdDSA, "", claims(id.String()), private), true},
+		{"hs256 without kid", sign(jwt.SigningMethodHS256, "", claims(id.String()), []byte("secret")), false},
+		{"wrong secret", sign(jwt.SigningMethodHS256, "main", claims(id.String()), []byte("other")), false},
+		{"algorithm of another key", sign(jwt.SigningMethodHS256, "ed", claims(id.String()), []byte("secret")), false},
+		{"unknown kid", sign(jwt.SigningMethodHS256, "old", claims(id.String()), []byte("secret")), false},
+		{"another device", sign(jwt.SigningMethodHS256, "main", claims(uuid.NewString()), []byte("secret")), false},
+		{"expired", sign(jwt.SigningMethodHS256, "main", expired, []byte("secret")), false},
+		{"missing", "", false},
+	}
+
+	for _, test := range tests {
+		if _, err := auth.verify(test.token, id); (err == nil) != test.valid {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+
+	withTenant := claims(id.String())
+	withTenant["tenant"] = "shop"
+	withOther := claims(id.String())
+	withOther["tenant"] = "other"
+
+	m := &Middleware{config: &config.Config{Tenant: config.TenantConfig{Names: []string{"shop"}, Default: "default"}}, deviceAuth: auth}
+
+	tenants := []struct {
+		name   string
+		token  string
+		path   string
+		tenant string
+		err    error
+	}{
+		{"default", sign(jwt.SigningMethodHS256, "main", claims(id.String()), []byte("secret")), "", "default", nil},
+		{"path of the default tenant", sign(jwt.SigningMethodHS256, "main", claims(id.String()), []byte("secret")), "default", "default", nil},
+		{"path of another tenant without claim", sign(jwt.SigningMethodHS256, "main", claims(id.String()), []byte("secret")), "shop", "", errors.ErrUnauthorized},
+		{"path of the claim", sign(jwt.SigningMethodHS256, "main", withTenant, []byte("secret")), "shop", "shop", nil},
+		{"claim", sign(jwt.SigningMethodHS256, "main", withTenant, []byte("secret")), "", "shop", nil},
+		{"claim of another tenant", sign(jwt.SigningMethodHS256, "main", withTenant, []byte("secret")), "default", "", errors.ErrUnauthorized},
+		{"unknown tenant", sign(jwt.SigningMethodHS256, "main", withOther, []byte("secret")), "other", "", errors.ErrTenantNotFound},
+	}
+
+	for _, test := range tenants {
+		tenant, err := m.AuthorizeDevice(test.token, test.path, id)
+		if tenant != test.tenant || !e.Is(err, test.err) {
+			t.Errorf("%s: expected %q %v, got %q %v", test.name, test.tenant, test.err, tenant, err)
+		}
+	}
+
+	// any tenant of the path is trusted without the keys
+	open := &Middleware{config: m.config}
+	if tenant, err := open.AuthorizeDevice("", "shop", id); tenant != "shop" || err != nil {
+		t.Errorf("open tenant: expected shop, got %q %v", tenant, err)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	hash := sha256.Sum256([]byte("stored"))
+	path := filepath.Join(t.TempDir(), "keys.json")
+	stored := `[{"name":"ops","key_sha256":"` + hex.EncodeToString(hash[:]) + `","scopes":["admin"]}]`
+	if err := os.WriteFile(path, []byte(stored), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadAPIKeys(config.APIConfig{
+		Keys:     []string{"backend:secret:send:device|devices:read", "shop/marketing:promo:send:broadcast"},
+		KeysFile: path,
+	}, config.TenantConfig{Default: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Middleware{apiKeys: keys}
+
+	for value, tenant := range map[string]string{"secret": "default", "promo": "shop", "stored": "default"} {
+		if key, _ := m.apiKey(value); key == nil || key.Tenant != tenant {
+			t.Errorf("key %s: expected tenant %s, got %+v", value, tenant, key)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		scopes []Scope
+		err    error
+	}{
+		{"targeted send", "secret", []Scope{ScopeSendDevice}, nil},
+		{"any of the scopes", "secret", []Scope{ScopeSendDevice, ScopeSendBroadcast}, nil},
+		{"broadcast without the scope", "secret", []Scope{ScopeSendBroadcast}, errors.ErrForbidden},
+		{"broadcast", "promo", []Scope{ScopeSendBroadcast}, nil},
+		{"read without the scope", "promo", []Scope{ScopeDevicesRead}, errors.ErrForbidden},
+		{"admin from the file", "stored", []Scope{ScopeSendBroadcast}, nil},
+		{"unknown", "other", []Scope{ScopeSendDevice}, errors.ErrInvalidAPIKey},
+		{"missing", "", []Scope{ScopeSendDevice}, errors.ErrInvalidAPIKey},
+	}
+
+	for _, test := range tests {
+		if _, err := m.authorize(test.key, test.scopes); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	// the api is open without keys
+	if _, err := (&Middleware{}).authorize("", []Scope{ScopeAdmin}); err != nil {
+		t.Errorf("open api: unexpected error %v", err)
+	}
+}
@@ -2,7 +2,6 @@ package middleware
 
 import (
 	"fmt"
-	"slices"
 
 	"tokeon-test-task/internal/errors"
 
@@ -13,35 +12,46 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-func (m *Middleware) ErrorHandler() fiber.ErrorHandler {
-	return func(ctx *fiber.Ctx, err error) error {
-		// Status code defaults to 500
-		code := fiber.StatusInternalServerError
-		response := ErrorResponse{
-			Error: "Internal server error",
-		}
+// errorCodes - statuses of the service errors
+var errorCodes = map[error]int{
+	errors.ErrDeviceAlreadyRegistered: fiber.StatusBadRequest,
+	errors.ErrDeviceNotFound:          fiber.StatusBadRequest,
+	errors.ErrMessageNotFound:         fiber.StatusNotFound,
+	errors.ErrHistoryDisabled:         fiber.StatusNotImplemented,
+	errors.ErrMessageExpired:          fiber.StatusGatewayTimeout,
+	errors.ErrScheduledNotFound:       fiber.StatusNotFound,
+	errors.ErrScheduledNotPending:     fiber.StatusConflict,
+	errors.ErrDeviceQueueFull:         fiber.StatusServiceUnavailable,
+	errors.ErrDeviceBanned:            fiber.StatusForbidden,
+	errors.ErrUnauthorized:            fiber.StatusUnauthorized,
+	errors.ErrInvalidAPIKey:           fiber.StatusUnauthorized,
+	errors.ErrForbidden:               fiber.StatusForbidden,
+	errors.ErrTenantNotFound:          fiber.StatusNotFound,
+	errors.ErrTenantLimit:             fiber.StatusServiceUnavailable,
+}
 
-		e0, ok := err.(*fiber.Error)
-		if ok {
-			code = e0.Code
-			response = ErrorResponse{
-				Error: e0.Message,
-			}
-		}
+// ErrorStatus returns status code and message of the error the api responds with
+func ErrorStatus(err error) (int, string) {
+	if errCode, ok := errorCodes[err]; ok {
+		return errCode, err.Error()
+	}
 
-		badRequestErrors := []error{
-			errors.ErrDeviceAlreadyRegistered,
-			errors.ErrDeviceNotFound,
-		}
+	if e0, ok := err.(*fiber.Error); ok {
+		return e0.Code, e0.Message
+	}
+
+	// Status code defaults to 500
+	return fiber.StatusInternalServerError, "Internal server error"
+}
 
-		if slices.Contains(badRequestErrors, err) {
-			code = fiber.StatusBadRequest
-			response = ErrorResponse{
-				Error: err.Error(),
-			}
+func (m *Middleware) ErrorHandler() fiber.ErrorHandler {
+	return func(ctx *fiber.Ctx, err error) error {
+		code, message := ErrorStatus(err)
+		response := ErrorResponse{
+			Error: message,
 		}
 
-		loggerExtendedFields := []any{"status_code", code, "ip", ctx.Get("X-Real-IP", ""), "method", ctx.Method(), "url", ctx.OriginalURL()}
+		loggerExtendedFields := []any{"status_code", code, "ip", ctx.Get("X-Real-IP", ""), "method", ctx.Method(), "url", logURL(ctx)}
 
 		errText := fmt.Sprintf("%+v", err)
 
@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"net/url"
+
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -11,7 +13,7 @@ func (m *Middleware) Logger() fiber.Handler {
 		response := ctx.Response()
 		code := response.StatusCode()
 
-		loggerExtendedFields := []any{"status_code", code, "ip", ctx.Get("X-Real-IP", ""), "method", ctx.Method(), "url", ctx.OriginalURL()}
+		loggerExtendedFields := []any{"status_code", code, "ip", ctx.Get("X-Real-IP", ""), "method", ctx.Method(), "url", logURL(ctx)}
 
 		if code < 400 {
 			m.logger.With(loggerExtendedFields...).Info("API request")
@@ -20,3 +22,28 @@ func (m *Middleware) Logger() fiber.Handler {
 		return err
 	}
 }
+
+// logURL returns the url of the request without the device token, so tokens passed in
+// the query don't end up in the logs
+func logURL(ctx *fiber.Ctx) string {
+	query := string(ctx.Request().URI().QueryString())
+	if query == "" {
+		return ctx.Path()
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return ctx.Path()
+	}
+
+	if !values.Has(tokenQuery) {
+		return ctx.OriginalURL()
+	}
+
+	values.Del(tokenQuery)
+	if len(values) == 0 {
+		return ctx.Path()
+	}
+
+	return ctx.Path() + "?" + values.Encode()
+}
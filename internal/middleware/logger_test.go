@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Test the device token is not logged with the url
+func TestLogURL(t *testing.T) {
+	app := fiber.New()
+	app.Get("/*", func(c *fiber.Ctx) error {
+		return c.SendString(logURL(c))
+	})
+
+	cases := map[string]string{
+		"/ws/1":                            "/ws/1",
+		"/ws/1?token=secret":               "/ws/1",
+		"/poll/1?wait=5s&token=secret":     "/poll/1?wait=5s",
+		"/poll/1?token=a&cursor=2&token=b": "/poll/1?cursor=2",
+		"/api/v1/devices?page=2":           "/api/v1/devices?page=2",
+	}
+
+	for url, expected := range cases {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, url, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(body) != expected {
+			t.Errorf("%s is logged as %s", url, body)
+		}
+	}
+}
@@ -9,11 +9,35 @@ import (
 type Middleware struct {
 	logger log.Logger
 	config *config.Config
+	// deviceAuth - nil if devices connect without tokens
+	deviceAuth *deviceAuth
+	// apiKeys - keys by sha256 of the key, nil if the api is open
+	apiKeys map[string]*APIKey
 }
 
-func New(logger log.Logger, config *config.Config) *Middleware {
-	return &Middleware{
-		logger: logger,
-		config: config,
+func New(logger log.Logger, config *config.Config) (*Middleware, error) {
+	deviceAuth, err := newDeviceAuth(config.JWT)
+	if err != nil {
+		return nil, err
+	}
+
+	if deviceAuth == nil {
+		logger.Warn("JWT_KEYS are not set, devices connect without tokens")
+	}
+
+	apiKeys, err := loadAPIKeys(config.API, config.Tenant)
+	if err != nil {
+		return nil, err
 	}
+
+	if apiKeys == nil {
+		logger.Warn("API_KEYS are not set, the api is open")
+	}
+
+	return &Middleware{
+		logger:     logger,
+		config:     config,
+		deviceAuth: deviceAuth,
+		apiKeys:    apiKeys,
+	}, nil
 }
@@ -7,12 +7,23 @@ import (
 
 const WebsocketAllowed = "ws_allowed"
 
+// WebsocketRemoteIP - ip of the client, the connection itself knows only the proxy address
+const WebsocketRemoteIP = "ws_remote_ip"
+
 func (m *Middleware) Websocket() fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
 		// IsWebSocketUpgrade returns true if the client
 		// requested upgrade to the WebSocket protocol.
 		if websocket_pkg.IsWebSocketUpgrade(ctx) {
 			ctx.Locals(WebsocketAllowed, true)
+			ctx.Locals(WebsocketRemoteIP, ctx.IP())
+
+			// the connection is upgraded anyway, so the client gets the close code
+			if err := m.authenticate(ctx, true); err != nil {
+				m.logger.Warnf("device %s: %v", ctx.Params("id"), err)
+				ctx.Locals(DeviceAuthError, err)
+			}
+
 			return ctx.Next()
 		}
 		return fiber.ErrUpgradeRequired
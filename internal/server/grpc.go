@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"tokeon-test-task/internal/controllers"
+	"tokeon-test-task/internal/middleware"
+	gatewayv1 "tokeon-test-task/pkg/api/gateway/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// grpcMessageOverhead - space for the fields of the message with the largest binary data
+const grpcMessageOverhead = 1 << 20
+
+// startGRPC serves the grpc api on its own port
+func (s *Server) startGRPC(ctx context.Context, mw *middleware.Middleware, controllers *controllers.Controllers) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.GRPCPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen grpc port: %w", err)
+	}
+
+	heartbeat := s.config.Heartbeat
+
+	s.grpc = grpc.NewServer(
+		grpc.MaxRecvMsgSize(int(s.config.MaxBinarySize)+grpcMessageOverhead),
+		grpc.MaxSendMsgSize(int(s.config.MaxBinarySize)+grpcMessageOverhead),
+		// connected devices are pinged the same way the websocket ones are
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    heartbeat.PingInterval,
+			Timeout: heartbeat.PongTimeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             heartbeat.PingInterval / 2,
+			PermitWithoutStream: true,
+		}),
+		// the api key is checked as for the http api, Connect is authorized by the device token
+		grpc.UnaryInterceptor(mw.GRPCAPIKey(map[string][]middleware.Scope{
+			gatewayv1.Gateway_Send_FullMethodName:        {middleware.ScopeSendDevice, middleware.ScopeSendBroadcast},
+			gatewayv1.Gateway_SendBatch_FullMethodName:   {middleware.ScopeSendDevice, middleware.ScopeSendBroadcast},
+			gatewayv1.Gateway_ListDevices_FullMethodName: {middleware.ScopeDevicesRead},
+		})),
+	)
+
+	gatewayv1.RegisterGatewayServer(s.grpc, controllers.Gateway().Server(ctx))
+
+	go func() {
+		if err := s.grpc.Serve(listener); err != nil {
+			s.logger.Fatalf("failed to start grpc server: %v", err)
+		}
+	}()
+
+	return nil
+}
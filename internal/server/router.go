@@ -24,11 +24,32 @@ func (s *Server) applyRoutes(
 	apiV1Router.Get("/swagger/*", swagger.HandlerDefault)
 
 	apiV1Router.Get("/health-check", controllers.Common().HealthCheck())
-	apiV1Router.Post("/send", controllers.Sender().Send())
 
-	wsRouter := apiV1Router.Group("/ws", mw.Websocket())
-
-	wsRouter.Get("/:id", controllers.Device().Connect(ctx))
+	// the key must have the scope of the route, the target of the message is checked by the
+	// sender and by the cancel of the scheduled message
+	send := mw.APIKey(middleware.ScopeSendDevice, middleware.ScopeSendBroadcast)
+	read := mw.APIKey(middleware.ScopeDevicesRead)
+	admin := mw.APIKey(middleware.ScopeAdmin)
+
+	apiV1Router.Post("/send", send, controllers.Sender().Send())
+	apiV1Router.Post("/send/batch", send, controllers.Sender().SendBatch())
+	apiV1Router.Get("/messages", read, controllers.History().List())
+	apiV1Router.Get("/messages/:id", read, controllers.Message().Status())
+	apiV1Router.Get("/devices", read, controllers.Presence().List())
+	apiV1Router.Get("/devices/:id", read, controllers.Presence().Get())
+	apiV1Router.Delete("/devices/:id/connection", admin, controllers.Presence().Disconnect())
+	apiV1Router.Get("/devices/:id/messages", read, controllers.History().DeviceList())
+	apiV1Router.Get("/scheduled/:id", read, controllers.Scheduled().Get())
+	apiV1Router.Delete("/scheduled/:id", send, controllers.Scheduled().Cancel())
+
+	// the device token is verified against the id in the path, the device connects to the
+	// tenant of the path or of the token, the default one without either
+	apiV1Router.Get("/ws/:id", mw.Websocket(), controllers.Device().Connect(ctx))
+	apiV1Router.Get("/sse/:id", mw.DeviceAuth(), controllers.Stream().Connect(ctx))
+	apiV1Router.Get("/poll/:id", mw.DeviceAuth(), controllers.Poll().Connect(ctx))
+	apiV1Router.Get("/:tenant/ws/:id", mw.Websocket(), controllers.Device().Connect(ctx))
+	apiV1Router.Get("/:tenant/sse/:id", mw.DeviceAuth(), controllers.Stream().Connect(ctx))
+	apiV1Router.Get("/:tenant/poll/:id", mw.DeviceAuth(), controllers.Poll().Connect(ctx))
 
 	s.app.Use(func(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusNotFound) // => 404 "Not Found"
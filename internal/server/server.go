@@ -17,6 +17,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"google.golang.org/grpc"
 )
 
 type Server struct {
@@ -25,7 +26,8 @@ type Server struct {
 
 	hc *hc.Server
 
-	app *fiber.App
+	app  *fiber.App
+	grpc *grpc.Server
 
 	// Dependencies
 	services *services.Services
@@ -68,6 +70,11 @@ func (s *Server) Start(ctx context.Context) error {
 }
 
 func (s *Server) Stop() {
+	// device streams end with the context, so the graceful stop doesn't hang on them
+	if s.grpc != nil {
+		s.grpc.GracefulStop()
+	}
+
 	// stop hc
 	if s.hc != nil {
 		s.hc.Stop(context.Background())
@@ -90,13 +97,16 @@ func (s *Server) startHealthCheckServer() {
 func (s *Server) initInternalServices(ctx context.Context) error {
 	// Init services
 	var err error
-	s.services, err = services.New(s.logger, s.config)
+	s.services, err = services.New(ctx, s.logger, s.config)
 	if err != nil {
 		return fmt.Errorf("failed to init services: %w", err)
 	}
 
 	// init middleware
-	mw := middleware.New(s.logger, s.config)
+	mw, err := middleware.New(s.logger, s.config)
+	if err != nil {
+		return fmt.Errorf("failed to init middleware: %w", err)
+	}
 
 	// Create http server
 	s.app = fiber.New(fiber.Config{
@@ -136,7 +146,20 @@ func (s *Server) initInternalServices(ctx context.Context) error {
 	validator := validator.New()
 
 	// init and apply controllers
-	controllers := controllers.New(s.logger, validator, s.services.Device(), s.services.Device())
+	controllers := controllers.New(
+		s.logger,
+		s.config,
+		validator,
+		s.services.Device(),
+		s.services.Device(),
+		s.services.Device(),
+		s.services.Device(),
+		s.services.History(),
+		s.services.Upstream(),
+		s.services.Scheduler(),
+		s.services.Device(),
+		mw,
+	)
 
 	s.applyRoutes(
 		ctx,
@@ -151,5 +174,11 @@ func (s *Server) initInternalServices(ctx context.Context) error {
 		}
 	}()
 
+	if s.config.GRPCPort != 0 {
+		if err := s.startGRPC(ctx, mw, controllers); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,331 @@
+package cluster
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// claimScript adds the node to the presence of the device. Presence is a hash of the
+// nodes the device is connected to with the time their claim expires. Exclusive claim
+// fails if the device is connected to another node. Returns 0 if the claim has failed
+var claimScript = redis.NewScript(`
+local now = tonumber(ARGV[2])
+local fields = redis.call("HGETALL", KEYS[1])
+for i = 1, #fields, 2 do
+	if tonumber(fields[i + 1]) <= now then
+		redis.call("HDEL", KEYS[1], fields[i])
+	elseif ARGV[4] == "1" and fields[i] ~= ARGV[1] then
+		return 0
+	end
+end
+redis.call("HSET", KEYS[1], ARGV[1], now + tonumber(ARGV[3]))
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// refreshScript prolongs the claim of the node if it still has one
+var refreshScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	redis.call("HSET", KEYS[1], ARGV[1], tonumber(ARGV[2]) + tonumber(ARGV[3]))
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return 0
+`)
+
+// handlerWorkers - events are handled by the workers, events of one device go to the
+// same worker in the order they were published
+const handlerWorkers = 16
+
+// handlerQueue - events waiting for the worker
+const handlerQueue = 64
+
+type Handler interface {
+	HandleClusterEvent(ctx context.Context, event device.ClusterEvent)
+}
+
+// Cluster keeps presence of the devices in redis and passes events between
+// instances through redis pub/sub
+type Cluster struct {
+	logger log.Logger
+	config config.ClusterConfig
+	client *redis.Client
+	nodeID string
+
+	mu      sync.Mutex
+	claimed map[uuid.UUID]struct{}
+}
+
+func New(logger log.Logger, cfg config.ClusterConfig) (*Cluster, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.RedisAddr,
+		Password: cfg.RedisPassword,
+		DB:       cfg.RedisDB,
+	})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	nodeID := cfg.NodeID
+	if nodeID == "" {
+		nodeID = uuid.NewString()
+	}
+
+	return &Cluster{
+		logger:  logger,
+		config:  cfg,
+		client:  client,
+		nodeID:  nodeID,
+		claimed: make(map[uuid.UUID]struct{}),
+	}, nil
+}
+
+func (c *Cluster) NodeID() string {
+	return c.nodeID
+}
+
+// Start subscribes to the events of the node and passes them to the handler until
+// ctx is done
+func (c *Cluster) Start(ctx context.Context, handler Handler) error {
+	pubsub := c.client.Subscribe(ctx, c.nodeChannel(c.nodeID), c.broadcastChannel())
+
+	// wait for subscription, so no event is lost after Start returns
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	go c.refreshPresence(ctx)
+
+	workers := make([]chan device.ClusterEvent, handlerWorkers)
+	for i := range workers {
+		workers[i] = make(chan device.ClusterEvent, handlerQueue)
+		go c.handle(ctx, handler, workers[i])
+	}
+
+	go func() {
+		defer c.stop(pubsub)
+
+		ch := pubsub.Channel()
+
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				var event device.ClusterEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					c.logger.Errorf("failed to decode cluster event: %v", err)
+					continue
+				}
+
+				// broadcasts come back to the sender too
+				if event.Origin == c.nodeID {
+					continue
+				}
+
+				select {
+				case workers[worker(event)] <- event:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// handle passes events of the worker to the handler one at a time
+func (c *Cluster) handle(ctx context.Context, handler Handler, events <-chan device.ClusterEvent) {
+	for {
+		select {
+		case event := <-events:
+			handler.HandleClusterEvent(ctx, event)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// worker returns worker of the event, events without device share the first one
+func worker(event device.ClusterEvent) int {
+	if event.DeviceID == nil {
+		return 0
+	}
+
+	id := *event.DeviceID
+	return int(binary.BigEndian.Uint32(id[12:]) % handlerWorkers)
+}
+
+// Claim adds the node to the presence of the device. Claims of the nodes expire unless
+// they are refreshed, so clocks of the nodes must not drift apart for PresenceTTL
+func (c *Cluster) Claim(ctx context.Context, id uuid.UUID, exclusive bool) error {
+	flag := "0"
+	if exclusive {
+		flag = "1"
+	}
+
+	ok, err := claimScript.Run(
+		ctx, c.client, []string{c.presenceKey(id)},
+		c.nodeID, time.Now().UnixMilli(), c.config.PresenceTTL.Milliseconds(), flag,
+	).Int()
+	if err != nil {
+		return err
+	}
+
+	if ok == 0 {
+		return errors.ErrDeviceAlreadyRegistered
+	}
+
+	c.mu.Lock()
+	c.claimed[id] = struct{}{}
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *Cluster) Release(ctx context.Context, id uuid.UUID) error {
+	c.mu.Lock()
+	delete(c.claimed, id)
+	c.mu.Unlock()
+
+	return c.client.HDel(ctx, c.presenceKey(id), c.nodeID).Err()
+}
+
+// Locate looks up the devices in one pipeline
+func (c *Cluster) Locate(ctx context.Context, ids ...uuid.UUID) (map[uuid.UUID][]string, error) {
+	located := make(map[uuid.UUID][]string, len(ids))
+	if len(ids) == 0 {
+		return located, nil
+	}
+
+	pipe := c.client.Pipeline()
+	claims := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		claims[i] = pipe.HGetAll(ctx, c.presenceKey(id))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+
+	for i, id := range ids {
+		var nodes []string
+		for node, expires := range claims[i].Val() {
+			if until, err := strconv.ParseInt(expires, 10, 64); err == nil && until > now {
+				nodes = append(nodes, node)
+			}
+		}
+
+		if len(nodes) > 0 {
+			sort.Strings(nodes)
+			located[id] = nodes
+		}
+	}
+
+	return located, nil
+}
+
+func (c *Cluster) Publish(ctx context.Context, node string, event device.ClusterEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	channel := c.broadcastChannel()
+	if node != "" {
+		channel = c.nodeChannel(node)
+	}
+
+	return c.client.Publish(ctx, channel, payload).Err()
+}
+
+// refreshPresence prolongs presence of the local devices while the node is alive
+func (c *Cluster) refreshPresence(ctx context.Context) {
+	ticker := time.NewTicker(c.config.PresenceTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			ids := make([]uuid.UUID, 0, len(c.claimed))
+			for id := range c.claimed {
+				ids = append(ids, id)
+			}
+			c.mu.Unlock()
+
+			now := time.Now().UnixMilli()
+
+			pipe := c.client.Pipeline()
+			for _, id := range ids {
+				refreshScript.Eval(ctx, pipe, []string{c.presenceKey(id)}, c.nodeID, now, c.config.PresenceTTL.Milliseconds())
+			}
+
+			if _, err := pipe.Exec(ctx); err != nil && ctx.Err() == nil {
+				c.logger.Errorf("failed to refresh devices presence: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Cluster) stop(pubsub *redis.PubSub) {
+	if err := pubsub.Close(); err != nil {
+		c.logger.Errorf("failed to close cluster subscription: %v", err)
+	}
+
+	c.mu.Lock()
+	ids := make([]uuid.UUID, 0, len(c.claimed))
+	for id := range c.claimed {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+
+	// devices of the stopped node are offline for the others
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, id := range ids {
+		if err := c.Release(ctx, id); err != nil {
+			c.logger.Errorf("failed to release device %s: %v", id, err)
+		}
+	}
+
+	if err := c.client.Close(); err != nil {
+		c.logger.Errorf("failed to close redis client: %v", err)
+	}
+}
+
+func (c *Cluster) presenceKey(id uuid.UUID) string {
+	return fmt.Sprintf("%s:presence:%s", c.config.KeyPrefix, id)
+}
+
+func (c *Cluster) nodeChannel(node string) string {
+	return fmt.Sprintf("%s:node:%s", c.config.KeyPrefix, node)
+}
+
+func (c *Cluster) broadcastChannel() string {
+	return fmt.Sprintf("%s:broadcast", c.config.KeyPrefix)
+}
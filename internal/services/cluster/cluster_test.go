@@ -0,0 +1,258 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/google/uuid"
+)
+
+// redisAddr returns the redis from CLUSTER_REDIS_ADDR or the local redis-server
+func redisAddr() string {
+	if addr := os.Getenv("CLUSTER_REDIS_ADDR"); addr != "" {
+		return addr
+	}
+
+	return "localhost:6379"
+}
+
+// newTestNode starts a node with the session policy against the redis from redisAddr.
+// The test is skipped if redis is not available
+func newTestNode(t *testing.T, ctx context.Context, prefix string, policy device.SessionPolicy) *device.Service {
+	t.Helper()
+
+	addr := redisAddr()
+
+	cfg := &config.Config{
+		Mailbox:          config.MailboxConfig{MaxSize: 10, MaxAge: time.Hour},
+		MessageStatusTTL: time.Hour,
+		SessionPolicy:    string(policy),
+		Cluster: config.ClusterConfig{
+			Enabled:     true,
+			RedisAddr:   addr,
+			KeyPrefix:   prefix,
+			PresenceTTL: 3 * time.Second,
+		},
+	}
+
+	logger := log.New()
+
+	c, err := New(logger, cfg.Cluster)
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+
+	s := device.New(logger, cfg, device.WithCluster(c))
+
+	if err := c.Start(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func receive(t *testing.T, ch <-chan device.Message) device.Message {
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("message has not been received")
+	}
+
+	return device.Message{}
+}
+
+// Test the devices are located at once, devices without presence are left out
+func TestLocate(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.ClusterConfig{RedisAddr: redisAddr(), KeyPrefix: "test-" + uuid.NewString(), PresenceTTL: 3 * time.Second}
+
+	nodes := make([]*Cluster, 2)
+	for i := range nodes {
+		c, err := New(log.New(), cfg)
+		if err != nil {
+			t.Skipf("redis is not available: %v", err)
+		}
+		t.Cleanup(func() {
+			c.client.Close()
+		})
+
+		nodes[i] = c
+	}
+
+	shared, single, absent := uuid.New(), uuid.New(), uuid.New()
+	claims := []struct {
+		node *Cluster
+		id   uuid.UUID
+	}{{nodes[0], shared}, {nodes[1], shared}, {nodes[1], single}}
+
+	for _, claim := range claims {
+		if err := claim.node.Claim(ctx, claim.id, false); err != nil {
+			t.Fatal(err)
+		}
+		node, id := claim.node, claim.id
+		t.Cleanup(func() {
+			node.Release(context.Background(), id)
+		})
+	}
+
+	located, err := nodes[0].Locate(ctx, shared, single, absent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(located) != 2 || len(located[shared]) != 2 || len(located[single]) != 1 || located[single][0] != nodes[1].NodeID() {
+		t.Errorf("wrong nodes of the devices: %v", located)
+	}
+}
+
+// Test targeted and broadcast messages reach the device connected to another node
+func TestSendAcrossNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prefix := "test-" + uuid.NewString()
+	a := newTestNode(t, ctx, prefix, device.SessionReject)
+	b := newTestNode(t, ctx, prefix, device.SessionReject)
+
+	id := uuid.New()
+	session, err := b.Register(id, device.ConnectionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close(session, device.DisconnectNormal)
+
+	if _, err := a.Register(id, device.ConnectionInfo{}); err == nil {
+		t.Error("device must not be registered on two nodes")
+	}
+
+	ch := session.Messages()
+
+	messageID, err := a.SendMessage(ctx, device.Target{DeviceID: &id}, device.Content{Text: "targeted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, ch)
+	if msg.ID != messageID || msg.Text != "targeted" {
+		t.Errorf("wrong message: %+v", msg)
+	}
+
+	// delivery status is reported back to the node that accepted the message
+	if err := b.Ack(id, messageID); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := a.Status("", messageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(status.Deliveries) == 1 && status.Deliveries[0].State == device.DeliveryAcked {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("status has not been updated: %+v", status)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	go a.SendMessage(ctx, device.Target{}, device.Content{Text: "broadcast"})
+
+	if msg := receive(t, ch); msg.Text != "broadcast" {
+		t.Errorf("wrong message: %+v", msg)
+	}
+}
+
+// Test messages reach the device connected to another node in the order they were sent,
+// both queued while it was offline and sent after it has connected
+func TestOrderAcrossNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prefix := "test-" + uuid.NewString()
+	a := newTestNode(t, ctx, prefix, device.SessionReject)
+	b := newTestNode(t, ctx, prefix, device.SessionReject)
+
+	id := uuid.New()
+
+	const queued, sent = 5, 20
+	for i := 0; i < queued; i++ {
+		if _, err := a.SendMessage(ctx, device.Target{DeviceID: &id}, device.Content{Text: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session, err := b.Register(id, device.ConnectionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close(session, device.DisconnectNormal)
+
+	ch := session.Messages()
+
+	for i := 0; i < queued; i++ {
+		if msg := receive(t, ch); msg.Text != fmt.Sprint(i) {
+			t.Fatalf("queued message %d is out of order: %+v", i, msg)
+		}
+	}
+
+	for i := 0; i < sent; i++ {
+		if _, err := a.SendMessage(ctx, device.Target{DeviceID: &id}, device.Content{Text: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < sent; i++ {
+		if msg := receive(t, ch); msg.Text != fmt.Sprint(i) {
+			t.Fatalf("sent message %d is out of order: %+v", i, msg)
+		}
+	}
+}
+
+// Test the device with multi policy has sessions on several nodes and gets messages on all
+func TestMultiSessionsAcrossNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prefix := "test-" + uuid.NewString()
+	a := newTestNode(t, ctx, prefix, device.SessionMulti)
+	b := newTestNode(t, ctx, prefix, device.SessionMulti)
+
+	id := uuid.New()
+	phone, err := a.Register(id, device.ConnectionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close(phone, device.DisconnectNormal)
+
+	tablet, err := b.Register(id, device.ConnectionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close(tablet, device.DisconnectNormal)
+
+	for _, node := range []*device.Service{a, b} {
+		if _, err := node.SendMessage(ctx, device.Target{DeviceID: &id}, device.Content{Text: "targeted"}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, session := range []*device.Session{phone, tablet} {
+			if msg := receive(t, session.Messages()); msg.Text != "targeted" {
+				t.Errorf("wrong message: %+v", msg)
+			}
+		}
+	}
+}
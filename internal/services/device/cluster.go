@@ -0,0 +1,216 @@
+package device
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Cluster connects instances of the service, so a message accepted by one of
+// them reaches the device connected to any other
+type Cluster interface {
+	// NodeID returns id of the current instance
+	NodeID() string
+	// Claim marks the device as connected to the current instance, exclusive claim fails
+	// if the device is connected to another instance
+	Claim(ctx context.Context, id uuid.UUID, exclusive bool) error
+	// Release removes presence of the device connected to the current instance
+	Release(ctx context.Context, id uuid.UUID) error
+	// Locate returns ids of the instances each of the devices is connected to, devices
+	// that are not connected are left out
+	Locate(ctx context.Context, ids ...uuid.UUID) (map[uuid.UUID][]string, error)
+	// Publish sends the event to the instance or to all instances if node is empty
+	Publish(ctx context.Context, node string, event ClusterEvent) error
+}
+
+type ClusterEventKind string
+
+const (
+	// ClusterEventMessage - deliver the message to the device or to all local devices
+	ClusterEventMessage ClusterEventKind = "message"
+	// ClusterEventStatus - delivery status of the message accepted by the receiving node
+	ClusterEventStatus ClusterEventKind = "status"
+	// ClusterEventConnected - device has connected, hand over its queued messages
+	ClusterEventConnected ClusterEventKind = "connected"
+	// ClusterEventDisconnect - disconnect the device and ban it until BanUntil
+	ClusterEventDisconnect ClusterEventKind = "disconnect"
+)
+
+type ClusterEvent struct {
+	Kind ClusterEventKind `json:"kind"`
+	// Origin - node that has sent the event
+	Origin string `json:"origin"`
+	// Tenant - tenant of the device or the message
+	Tenant   string     `json:"tenant,omitempty"`
+	DeviceID *uuid.UUID `json:"device_id,omitempty"`
+	Topic    string     `json:"topic,omitempty"`
+	// Exclude - devices that don't receive the broadcast
+	Exclude []uuid.UUID `json:"exclude,omitempty"`
+	Message *Message    `json:"message,omitempty"`
+	// Messages - mailbox of the device handed over by another instance, the oldest first
+	Messages []Message `json:"messages,omitempty"`
+	// Deadline - time until the message may wait for the device
+	Deadline  time.Time     `json:"deadline,omitempty"`
+	MessageID uuid.UUID     `json:"message_id,omitempty"`
+	State     DeliveryState `json:"state,omitempty"`
+	Close     *CloseFrame   `json:"close,omitempty"`
+	BanUntil  time.Time     `json:"ban_until,omitempty"`
+	// Reason - why the device is disconnected
+	Reason DisconnectReason `json:"reason,omitempty"`
+}
+
+// HandleClusterEvent processes the event received from another instance
+func (s *Service) HandleClusterEvent(ctx context.Context, event ClusterEvent) {
+	switch event.Kind {
+	case ClusterEventMessage:
+		target := Target{Tenant: event.Tenant, DeviceID: event.DeviceID, Topic: event.Topic, Exclude: event.Exclude}
+
+		if event.Message != nil {
+			s.deliverBefore(ctx, event.Origin, target, *event.Message, event.Deadline)
+		}
+
+		for _, msg := range event.Messages {
+			s.deliverBefore(ctx, event.Origin, target, msg, msg.ExpiresAt)
+		}
+	case ClusterEventStatus:
+		if event.DeviceID == nil {
+			return
+		}
+
+		origin, changed, err := s.tracker.upsert(event.MessageID, *event.DeviceID, event.State)
+		if err != nil || !changed {
+			return
+		}
+
+		s.stateChanged(origin, *event.DeviceID, event.MessageID, event.State)
+	case ClusterEventConnected:
+		if event.DeviceID == nil {
+			return
+		}
+
+		s.handOver(ctx, event.Origin, event.Tenant, *event.DeviceID)
+	case ClusterEventDisconnect:
+		if event.DeviceID == nil || event.Close == nil {
+			return
+		}
+
+		reason := event.Reason
+		if reason == "" {
+			reason = DisconnectAdmin
+		}
+
+		s.disconnectLocal(event.Tenant, *event.DeviceID, *event.Close, event.BanUntil, reason)
+	}
+}
+
+// deliverBefore delivers the message accepted by another instance if it reaches the device
+// before the deadline, zero deadline doesn't limit the delivery
+func (s *Service) deliverBefore(ctx context.Context, origin string, target Target, msg Message, deadline time.Time) {
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	s.deliverRemote(ctx, origin, target, msg)
+}
+
+// deliverRemote delivers the message accepted by another instance to the local devices
+// of the target tenant
+func (s *Service) deliverRemote(ctx context.Context, origin string, target Target, msg Message) {
+	if deviceID := target.DeviceID; deviceID != nil {
+		s.mu.Lock()
+
+		recipients := recipients{seq: s.sessionSeq}
+		if s.connectedTo(target.Tenant, *deviceID) {
+			recipients = s.deviceRecipients(*deviceID)
+		}
+		if len(recipients.sessions) == 0 {
+			// device has gone in the meantime, keep the message for it
+			s.track(msg, []uuid.UUID{*deviceID}, origin)
+			if err := s.enqueue(target.Tenant, *deviceID, msg); err != nil {
+				s.expire(*deviceID, []Message{msg})
+			}
+			s.mu.Unlock()
+
+			return
+		}
+
+		s.mu.Unlock()
+
+		s.track(msg, recipients.devices, origin)
+		s.deliver(ctx, recipients, msg)
+
+		return
+	}
+
+	recipients := s.localRecipients(target.Tenant, target.Topic, target.Exclude)
+
+	s.track(msg, recipients.devices, origin)
+
+	// let the origin know which devices the message is waiting for
+	for _, id := range recipients.devices {
+		s.publishStatus(ctx, origin, id, msg.ID, DeliveryPending)
+	}
+
+	s.deliver(ctx, recipients, msg)
+}
+
+// handOver sends messages queued for the device of the tenant to the instance it has
+// connected to in one event, so they are delivered in the order they were queued
+func (s *Service) handOver(ctx context.Context, node, tenant string, id uuid.UUID) {
+	s.mu.Lock()
+	messages := s.drain(tenant, id)
+	s.mu.Unlock()
+
+	if len(messages) == 0 {
+		return
+	}
+
+	if err := s.cluster.Publish(ctx, node, ClusterEvent{
+		Kind:     ClusterEventMessage,
+		Origin:   s.cluster.NodeID(),
+		Tenant:   tenant,
+		DeviceID: &id,
+		Messages: messages,
+	}); err != nil {
+		s.logger.Errorf("failed to hand over %d messages to device %s: %v", len(messages), id, err)
+	}
+}
+
+// remoteNodes returns other instances each of the devices is connected to, devices that
+// are connected only to this instance are left out
+func (s *Service) remoteNodes(ctx context.Context, ids ...uuid.UUID) (map[uuid.UUID][]string, error) {
+	located, err := s.cluster.Locate(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := make(map[uuid.UUID][]string, len(located))
+	for id, nodes := range located {
+		for _, node := range nodes {
+			if node != s.cluster.NodeID() {
+				remote[id] = append(remote[id], node)
+			}
+		}
+	}
+
+	return remote, nil
+}
+
+func (s *Service) publishStatus(ctx context.Context, node string, deviceID, messageID uuid.UUID, state DeliveryState) {
+	if s.cluster == nil || node == "" {
+		return
+	}
+
+	if err := s.cluster.Publish(ctx, node, ClusterEvent{
+		Kind:      ClusterEventStatus,
+		Origin:    s.cluster.NodeID(),
+		DeviceID:  &deviceID,
+		MessageID: messageID,
+		State:     state,
+	}); err != nil {
+		s.logger.Errorf("failed to publish status of message %s: %v", messageID, err)
+	}
+}
@@ -0,0 +1,81 @@
+package device
+
+import (
+	"context"
+	"time"
+	"tokeon-test-task/internal/errors"
+
+	"github.com/google/uuid"
+)
+
+// CloseFrame is written to the device disconnected by the server
+type CloseFrame struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// Disconnect closes every session of the device of the tenant with the close frame. If
+// ban is set the device can't reconnect to the tenant for the ban period. In cluster mode
+// the device is disconnected and banned on every instance
+func (s *Service) Disconnect(ctx context.Context, tenant string, id uuid.UUID, frame CloseFrame, ban time.Duration) error {
+	var banUntil time.Time
+	if ban > 0 {
+		banUntil = time.Now().Add(ban)
+	}
+
+	connected := s.disconnectLocal(tenant, id, frame, banUntil, DisconnectAdmin)
+
+	if s.cluster != nil {
+		nodes, err := s.remoteNodes(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		remote := len(nodes[id]) > 0
+
+		if remote || ban > 0 {
+			if err := s.cluster.Publish(ctx, "", ClusterEvent{
+				Kind:     ClusterEventDisconnect,
+				Origin:   s.cluster.NodeID(),
+				Tenant:   tenant,
+				DeviceID: &id,
+				Close:    &frame,
+				BanUntil: banUntil,
+				Reason:   DisconnectAdmin,
+			}); err != nil {
+				return err
+			}
+		}
+
+		connected = connected || remote
+	}
+
+	if !connected && ban == 0 {
+		return errors.ErrDeviceNotFound
+	}
+
+	return nil
+}
+
+// disconnectLocal bans the device in the tenant and closes its local sessions if it is
+// connected to the tenant. Returns whether the device has been connected
+func (s *Service) disconnectLocal(tenant string, id uuid.UUID, frame CloseFrame, banUntil time.Time, reason DisconnectReason) bool {
+	s.mu.Lock()
+	if !banUntil.IsZero() {
+		s.openRegistry(tenant).bans[id] = banUntil
+	}
+	var sessions []*Session
+	if s.connectedTo(tenant, id) {
+		sessions = s.deviceSessions(id)
+	}
+	s.mu.Unlock()
+
+	connected := false
+	for _, session := range sessions {
+		if s.close(session, reason, &frame) == nil {
+			connected = true
+		}
+	}
+
+	return connected
+}
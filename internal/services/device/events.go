@@ -0,0 +1,85 @@
+package device
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type EventType string
+
+const (
+	EventDeviceConnected    EventType = "device.connected"
+	EventDeviceDisconnected EventType = "device.disconnected"
+	EventMessageDelivered   EventType = "message.delivered"
+	EventMessageFailed      EventType = "message.failed"
+)
+
+// DisconnectReason - why the device connection has been closed
+type DisconnectReason string
+
+const (
+	DisconnectNormal     DisconnectReason = "normal_close"
+	DisconnectReadError  DisconnectReason = "read_error"
+	DisconnectWriteError DisconnectReason = "write_error"
+	DisconnectShutdown   DisconnectReason = "server_shutdown"
+	DisconnectAdmin      DisconnectReason = "admin_disconnect"
+	DisconnectReplaced   DisconnectReason = "replaced"
+	// DisconnectTimeout - device hasn't answered the ping in time
+	DisconnectTimeout DisconnectReason = "heartbeat_timeout"
+	// DisconnectIdle - no messages in both directions for the idle timeout
+	DisconnectIdle DisconnectReason = "idle_timeout"
+	// DisconnectSlowConsumer - outbox of the session is full
+	DisconnectSlowConsumer DisconnectReason = "slow_consumer"
+	// DisconnectPollExpired - polling device hasn't polled again within the grace window
+	DisconnectPollExpired DisconnectReason = "poll_expired"
+)
+
+// failedExpired - reason of message.failed for messages that will never reach the device
+const failedExpired = "expired"
+
+// Event describes a change of the device connection or the message delivery
+type Event struct {
+	ID       uuid.UUID `json:"id"`
+	Type     EventType `json:"type"`
+	At       time.Time `json:"at"`
+	DeviceID uuid.UUID `json:"device_id"`
+	// Tenant - tenant the device is connected to
+	Tenant string `json:"tenant"`
+	// SessionID - set for connection events
+	SessionID *uuid.UUID `json:"session_id,omitempty"`
+	// MessageID - set for message events
+	MessageID *uuid.UUID `json:"message_id,omitempty"`
+	// Reason - why the device has disconnected or the message has failed
+	Reason string `json:"reason,omitempty"`
+}
+
+// EventSubscriber receives events of the service. HandleEvent is called with the
+// service locks held, so it must not block
+type EventSubscriber interface {
+	HandleEvent(event Event)
+}
+
+// emit passes the event to every subscriber
+func (s *Service) emit(event Event) {
+	if len(s.subscribers) == 0 {
+		return
+	}
+
+	event.ID = uuid.New()
+	event.At = time.Now()
+
+	for _, subscriber := range s.subscribers {
+		subscriber.HandleEvent(event)
+	}
+}
+
+// emitState reports delivery outcome of the message sent in the tenant
+func (s *Service) emitState(tenant string, deviceID, messageID uuid.UUID, state DeliveryState) {
+	switch state {
+	case DeliveryDelivered:
+		s.emit(Event{Type: EventMessageDelivered, Tenant: tenant, DeviceID: deviceID, MessageID: &messageID})
+	case DeliveryExpired:
+		s.emit(Event{Type: EventMessageFailed, Tenant: tenant, DeviceID: deviceID, MessageID: &messageID, Reason: failedExpired})
+	}
+}
@@ -0,0 +1,16 @@
+package device
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// History stores sent messages and their delivery outcome
+type History interface {
+	// SaveMessage stores the message accepted for sending to the target
+	SaveMessage(ctx context.Context, msg Message, target Target) error
+	// SaveState stores delivery status of the message in background
+	SaveState(messageID, deviceID uuid.UUID, state DeliveryState, at time.Time)
+}
@@ -0,0 +1,63 @@
+package device
+
+import (
+	"time"
+)
+
+type mailboxItem struct {
+	message  Message
+	queuedAt time.Time
+}
+
+// mailbox keeps messages for a device that is not connected right now
+type mailbox struct {
+	items []mailboxItem
+}
+
+// push adds the message to the mailbox and returns the messages dropped to make room for it
+func (m *mailbox) push(message Message, now time.Time, maxSize int) []Message {
+	var dropped []Message
+
+	if len(m.items) >= maxSize {
+		// drop the oldest messages to make room for the new one
+		n := len(m.items) - maxSize + 1
+		dropped = m.messages(m.items[:n])
+		m.items = m.items[n:]
+	}
+
+	m.items = append(m.items, mailboxItem{message, now})
+
+	return dropped
+}
+
+// prune removes and returns messages that are older than maxAge or have expired
+func (m *mailbox) prune(now time.Time, maxAge time.Duration) []Message {
+	var dropped []Message
+
+	kept := m.items[:0]
+	for _, item := range m.items {
+		if (maxAge > 0 && now.Sub(item.queuedAt) > maxAge) || item.message.expired(now) {
+			dropped = append(dropped, item.message)
+			continue
+		}
+
+		kept = append(kept, item)
+	}
+
+	m.items = kept
+
+	return dropped
+}
+
+func (m *mailbox) empty() bool {
+	return len(m.items) == 0
+}
+
+func (m *mailbox) messages(items []mailboxItem) []Message {
+	messages := make([]Message, 0, len(items))
+	for _, item := range items {
+		messages = append(messages, item.message)
+	}
+
+	return messages
+}
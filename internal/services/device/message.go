@@ -0,0 +1,94 @@
+package device
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type TargetKind string
+
+const (
+	TargetDevice    TargetKind = "device"
+	TargetDevices   TargetKind = "devices"
+	TargetTopic     TargetKind = "topic"
+	TargetBroadcast TargetKind = "broadcast"
+)
+
+// Target describes devices of the tenant the message is sent to. Target without devices
+// and topic means all devices of the tenant
+type Target struct {
+	// Tenant - tenant of the sender, the message doesn't reach devices of other tenants
+	Tenant string `json:"tenant,omitempty"`
+	// DeviceID - the only device to send the message to
+	DeviceID *uuid.UUID `json:"device_id,omitempty"`
+	// DeviceIDs - the devices to send the message to
+	DeviceIDs []uuid.UUID `json:"device_ids,omitempty"`
+	// Topic - send the message to the devices subscribed to the topic
+	Topic string `json:"topic,omitempty"`
+	// Exclude - devices that don't receive the message
+	Exclude []uuid.UUID `json:"exclude_device_ids,omitempty"`
+}
+
+// Content is what the sender wants to pass to the devices
+type Content struct {
+	// Type - kind of the message defined by the sender, e.g. notification or command
+	Type    string            `json:"type,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Text    string            `json:"text,omitempty"`
+	// Payload - arbitrary json
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Binary - opaque data written to the device as a binary frame
+	Binary []byte `json:"binary,omitempty"`
+	// Sender - who has sent the message
+	Sender string `json:"sender,omitempty"`
+	// TTL - how long the message may wait for delivery, 0 means the message waits
+	// in the mailbox as long as the mailbox allows
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// Message is a single message sent to one or many devices
+type Message struct {
+	Content
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt - when the message is dropped if it has not been delivered, zero if
+	// the message has no ttl
+	ExpiresAt time.Time `json:"expires_at"`
+	Target    Target    `json:"target"`
+}
+
+func newMessage(target Target, content Content) Message {
+	msg := Message{
+		Content:   content,
+		ID:        uuid.New(),
+		CreatedAt: time.Now(),
+		Target:    target,
+	}
+
+	if content.TTL > 0 {
+		msg.ExpiresAt = msg.CreatedAt.Add(content.TTL)
+	}
+
+	return msg
+}
+
+// expired reports whether the message ttl has passed
+func (m Message) expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
+// Kind returns kind of the target
+func (t Target) Kind() TargetKind {
+	switch {
+	case t.DeviceID != nil:
+		return TargetDevice
+	case len(t.DeviceIDs) > 0:
+		return TargetDevices
+	case t.Topic != "":
+		return TargetTopic
+	default:
+		return TargetBroadcast
+	}
+}
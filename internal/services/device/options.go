@@ -0,0 +1,30 @@
+package device
+
+type Option func(*Options)
+
+type Options struct {
+	Cluster     Cluster
+	History     History
+	Subscribers []EventSubscriber
+}
+
+// WithCluster enables delivery to the devices connected to other instances
+func WithCluster(v Cluster) Option {
+	return func(o *Options) {
+		o.Cluster = v
+	}
+}
+
+// WithHistory enables storing of the sent messages
+func WithHistory(v History) Option {
+	return func(o *Options) {
+		o.History = v
+	}
+}
+
+// WithEventSubscriber adds the receiver of connection and delivery events
+func WithEventSubscriber(v EventSubscriber) Option {
+	return func(o *Options) {
+		o.Subscribers = append(o.Subscribers, v)
+	}
+}
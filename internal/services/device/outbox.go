@@ -0,0 +1,190 @@
+package device
+
+import (
+	e "errors"
+	"sync"
+	"time"
+)
+
+// OutboxPolicy - what happens to the message sent to the session with the full outbox
+type OutboxPolicy string
+
+const (
+	// OutboxDropOldest - the oldest queued message is expired to make space
+	OutboxDropOldest OutboxPolicy = "drop_oldest"
+	// OutboxDropNewest - the sent message is expired
+	OutboxDropNewest OutboxPolicy = "drop_newest"
+	// OutboxDisconnect - the slow session is closed, its messages go to the mailbox
+	OutboxDisconnect OutboxPolicy = "disconnect"
+	// OutboxBlock - the sender waits for space until the block timeout
+	OutboxBlock OutboxPolicy = "block"
+)
+
+const defaultOutboxSize = 256
+
+// slowConsumerFrame - close frame of the session that doesn't keep up with its messages
+var slowConsumerFrame = CloseFrame{Code: 4429, Reason: "too many pending messages"}
+
+var (
+	errOutboxFull   = e.New("outbox is full")
+	errOutboxClosed = e.New("outbox is closed")
+)
+
+// queued is the message waiting in the outbox
+type queued struct {
+	message Message
+	// seq - seq of the last session registered before the message has been sent
+	seq uint64
+	// deadline - the message is expired if it hasn't been written by then, zero if never
+	deadline time.Time
+}
+
+// outbox is a bounded queue of the messages waiting to be written to the session
+type outbox struct {
+	mu       sync.Mutex
+	items    []queued
+	capacity int
+	policy   OutboxPolicy
+	// sendTimeout - how long the message without ttl may wait, 0 if unlimited
+	sendTimeout time.Duration
+	closed      bool
+	// ready - signalled when the message is pushed, space - when the message is popped
+	ready chan struct{}
+	space chan struct{}
+}
+
+func newOutbox(capacity int, policy OutboxPolicy, sendTimeout time.Duration) *outbox {
+	return &outbox{
+		capacity:    capacity,
+		policy:      policy,
+		sendTimeout: sendTimeout,
+		ready:       make(chan struct{}, 1),
+		space:       make(chan struct{}, 1),
+	}
+}
+
+// push appends the message. Returns the message dropped to make space or errOutboxFull
+// if the policy doesn't allow dropping. The message without deadline gets its ttl or the
+// send timeout
+func (o *outbox) push(item queued) (*queued, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil, errOutboxClosed
+	}
+
+	if item.deadline.IsZero() {
+		item.deadline = item.message.ExpiresAt
+		if item.deadline.IsZero() && o.sendTimeout > 0 {
+			item.deadline = time.Now().Add(o.sendTimeout)
+		}
+	}
+
+	var dropped *queued
+	if len(o.items) >= o.capacity {
+		if o.policy != OutboxDropOldest {
+			return nil, errOutboxFull
+		}
+
+		oldest := o.items[0]
+		dropped = &oldest
+		o.items = o.items[1:]
+	}
+
+	o.items = append(o.items, item)
+	signal(o.ready)
+
+	return dropped, nil
+}
+
+// pop removes the oldest message, waits for one until stop is closed
+func (o *outbox) pop(stop <-chan struct{}) (queued, bool) {
+	for {
+		o.mu.Lock()
+		if len(o.items) > 0 {
+			item := o.items[0]
+			o.items = o.items[1:]
+			o.mu.Unlock()
+
+			signal(o.space)
+
+			return item, true
+		}
+		o.mu.Unlock()
+
+		select {
+		case <-o.ready:
+		case <-stop:
+			return queued{}, false
+		}
+	}
+}
+
+// unshift returns the popped message to the head of the queue
+func (o *outbox) unshift(item queued) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.items = append([]queued{item}, o.items...)
+}
+
+// close rejects further messages and returns the queued ones
+func (o *outbox) close() []queued {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	items := o.items
+	o.items = nil
+
+	return items
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// pump writes messages of the outbox to the session until it is stopped
+func (s *Service) pump(session *Session) {
+	defer close(session.pumped)
+
+	for {
+		item, ok := session.outbox.pop(session.stop)
+		if !ok {
+			return
+		}
+
+		// message may expire while the connection is busy
+		var expiry <-chan time.Time
+		var timer *time.Timer
+		if !item.deadline.IsZero() {
+			timer = time.NewTimer(time.Until(item.deadline))
+			expiry = timer.C
+		}
+
+		stopped := false
+		select {
+		case session.messages <- item.message:
+			if session.conn.info.Transport.resumable() {
+				s.replays.remember(session.DeviceID, item.message)
+			}
+		case <-expiry:
+			s.expire(session.DeviceID, []Message{item.message})
+		case <-session.stop:
+			session.outbox.unshift(item)
+			stopped = true
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if stopped {
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package device
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+	"tokeon-test-task/internal/errors"
+
+	"github.com/google/uuid"
+)
+
+// Transport - how the device connection receives messages
+type Transport string
+
+const (
+	TransportWebsocket Transport = "websocket"
+	TransportSSE       Transport = "sse"
+	TransportPoll      Transport = "poll"
+	TransportGRPC      Transport = "grpc"
+)
+
+// ConnectionInfo describes the client that has opened the connection
+type ConnectionInfo struct {
+	RemoteIP  string
+	UserAgent string
+	Transport Transport
+	// Tenant - tenant the device connects to
+	Tenant string
+}
+
+// connection keeps metadata and counters of the live connection
+type connection struct {
+	info        ConnectionInfo
+	connectedAt time.Time
+	// lastInbound, lastOutbound - unix nano of the last message, 0 if none
+	lastInbound   atomic.Int64
+	lastOutbound  atomic.Int64
+	inboundCount  atomic.Uint64
+	outboundCount atomic.Uint64
+}
+
+// Presence is a snapshot of the device sessions
+type Presence struct {
+	DeviceID uuid.UUID
+	// Sessions - from the oldest session to the newest
+	Sessions []SessionPresence
+}
+
+// SessionPresence is a snapshot of the session connection
+type SessionPresence struct {
+	SessionID      uuid.UUID
+	Transport      Transport
+	ConnectedAt    time.Time
+	RemoteIP       string
+	UserAgent      string
+	LastInboundAt  *time.Time
+	LastOutboundAt *time.Time
+	InboundCount   uint64
+	OutboundCount  uint64
+}
+
+func newConnection(info ConnectionInfo) *connection {
+	return &connection{
+		info:        info,
+		connectedAt: time.Now(),
+	}
+}
+
+func (c *connection) presence(sessionID uuid.UUID) SessionPresence {
+	return SessionPresence{
+		SessionID:      sessionID,
+		Transport:      c.info.Transport,
+		ConnectedAt:    c.connectedAt,
+		RemoteIP:       c.info.RemoteIP,
+		UserAgent:      c.info.UserAgent,
+		LastInboundAt:  unixNano(c.lastInbound.Load()),
+		LastOutboundAt: unixNano(c.lastOutbound.Load()),
+		InboundCount:   c.inboundCount.Load(),
+		OutboundCount:  c.outboundCount.Load(),
+	}
+}
+
+func unixNano(v int64) *time.Time {
+	if v == 0 {
+		return nil
+	}
+
+	t := time.Unix(0, v)
+
+	return &t
+}
+
+// presence returns sessions of the device. Must be called with the lock held
+func (s *Service) presence(id uuid.UUID) Presence {
+	sessions := make([]SessionPresence, 0, len(s.sessions[id]))
+	for _, session := range s.sessions[id] {
+		sessions = append(sessions, session.conn.presence(session.ID))
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].ConnectedAt.Equal(sessions[j].ConnectedAt) {
+			return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+		}
+
+		return sessions[i].SessionID.String() < sessions[j].SessionID.String()
+	})
+
+	return Presence{DeviceID: id, Sessions: sessions}
+}
+
+// Devices returns page of the devices of the tenant connected to this instance from the
+// oldest session to the newest and total amount of connected devices of the tenant
+func (s *Service) Devices(tenant string, page, pageSize uint64) ([]Presence, int64) {
+	s.mu.RLock()
+	reg := s.registry(tenant)
+	list := make([]Presence, 0, len(reg.devices))
+	for id := range reg.devices {
+		list = append(list, s.presence(id))
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].Sessions[0].ConnectedAt, list[j].Sessions[0].ConnectedAt
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+
+		return list[i].DeviceID.String() < list[j].DeviceID.String()
+	})
+
+	total := int64(len(list))
+
+	from := (page - 1) * pageSize
+	if from >= uint64(len(list)) {
+		return []Presence{}, total
+	}
+
+	return list[from:min(from+pageSize, uint64(len(list)))], total
+}
+
+// Device returns sessions of the device of the tenant connected to this instance
+func (s *Service) Device(tenant string, id uuid.UUID) (Presence, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.connectedTo(tenant, id) {
+		return Presence{}, errors.ErrDeviceNotFound
+	}
+
+	return s.presence(id), nil
+}
@@ -0,0 +1,108 @@
+package device
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// resumable reports whether the transport may ask for the messages it has missed
+func (t Transport) resumable() bool {
+	return t != "" && t != TransportWebsocket
+}
+
+// replayEntry is the message handed to the resumable session
+type replayEntry struct {
+	message Message
+	at      time.Time
+}
+
+// replays keeps the last messages handed to the resumable sessions of every device,
+// so the client that has lost the connection can resume after the last message it has got
+type replays struct {
+	mu        sync.Mutex
+	devices   map[uuid.UUID][]replayEntry
+	size      int
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+func newReplays(size int, ttl time.Duration) *replays {
+	return &replays{
+		devices:   make(map[uuid.UUID][]replayEntry),
+		size:      size,
+		ttl:       ttl,
+		lastSweep: time.Now(),
+	}
+}
+
+// remember appends the message to the log of the device
+func (r *replays) remember(id uuid.UUID, msg Message) {
+	if r.size == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	// drop logs of the devices that have never come back
+	if now.Sub(r.lastSweep) > r.ttl {
+		for deviceID, entries := range r.devices {
+			if now.Sub(entries[len(entries)-1].at) > r.ttl {
+				delete(r.devices, deviceID)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	entries := append(r.prune(r.devices[id], now), replayEntry{msg, now})
+	if len(entries) > r.size {
+		entries = entries[len(entries)-r.size:]
+	}
+
+	r.devices[id] = entries
+}
+
+// after returns messages handed to the device after the message. Returns false if the
+// message is not in the log anymore
+func (r *replays) after(id, messageID uuid.UUID) ([]Message, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := r.prune(r.devices[id], time.Now())
+
+	for i, entry := range entries {
+		if entry.message.ID != messageID {
+			continue
+		}
+
+		messages := make([]Message, 0, len(entries)-i-1)
+		for _, entry := range entries[i+1:] {
+			if !entry.message.expired(time.Now()) {
+				messages = append(messages, entry.message)
+			}
+		}
+
+		return messages, true
+	}
+
+	return nil, false
+}
+
+// prune drops entries older than ttl
+func (r *replays) prune(entries []replayEntry, now time.Time) []replayEntry {
+	for len(entries) > 0 && now.Sub(entries[0].at) > r.ttl {
+		entries = entries[1:]
+	}
+
+	return entries
+}
+
+// Replay returns messages handed to the resumable sessions of the device after the
+// message with the id. Returns false if the message is unknown or too old
+func (s *Service) Replay(id, messageID uuid.UUID) ([]Message, bool) {
+	return s.replays.after(id, messageID)
+}
@@ -0,0 +1,120 @@
+package device
+
+import (
+	"sync"
+	"tokeon-test-task/internal/errors"
+
+	"github.com/google/uuid"
+)
+
+// Outcome - what has happened to the message sent to the device
+type Outcome string
+
+const (
+	// OutcomeDelivered - the message has been written to the device connection
+	OutcomeDelivered Outcome = "delivered"
+	// OutcomeAccepted - the message waits in the outbox of the device connection, it may
+	// still expire or be dropped by OUTBOUND_POLICY
+	OutcomeAccepted Outcome = "accepted"
+	// OutcomeQueued - the device is offline, the message waits in its mailbox
+	OutcomeQueued Outcome = "queued"
+	// OutcomeForwarded - the message has been passed to the instance the device is connected to
+	OutcomeForwarded Outcome = "forwarded"
+	// OutcomeTimedOut - the connection hasn't accepted the message in time
+	OutcomeTimedOut Outcome = "timed_out"
+	// OutcomeDropped - the outbox of the connection is full
+	OutcomeDropped Outcome = "dropped"
+	// OutcomeNotFound - the device is offline and the mailbox is disabled
+	OutcomeNotFound Outcome = "not_found"
+)
+
+// rank orders outcomes of the device sessions, the best one is reported for the device
+var rank = map[Outcome]int{
+	OutcomeNotFound:  0,
+	OutcomeDropped:   1,
+	OutcomeTimedOut:  2,
+	OutcomeQueued:    3,
+	OutcomeForwarded: 4,
+	OutcomeAccepted:  5,
+	OutcomeDelivered: 6,
+}
+
+// Report describes what has happened to the sent message on this instance. Devices of
+// other instances reached by the broadcast are not counted
+type Report struct {
+	MessageID uuid.UUID
+	Targets   int
+	Delivered int
+	Accepted  int
+	Queued    int
+	Forwarded int
+	TimedOut  int
+	Dropped   int
+	NotFound  int
+	// Devices - outcome of every target device, only for messages sent to the devices
+	Devices map[uuid.UUID]Outcome
+}
+
+func newReport(messageID uuid.UUID, outcomes map[uuid.UUID]Outcome, perDevice bool) Report {
+	report := Report{
+		MessageID: messageID,
+		Targets:   len(outcomes),
+	}
+
+	for _, outcome := range outcomes {
+		switch outcome {
+		case OutcomeDelivered:
+			report.Delivered++
+		case OutcomeAccepted:
+			report.Accepted++
+		case OutcomeQueued:
+			report.Queued++
+		case OutcomeForwarded:
+			report.Forwarded++
+		case OutcomeTimedOut:
+			report.TimedOut++
+		case OutcomeDropped:
+			report.Dropped++
+		case OutcomeNotFound:
+			report.NotFound++
+		}
+	}
+
+	if perDevice {
+		report.Devices = outcomes
+	}
+
+	return report
+}
+
+// Err returns error if the message has reached none of the targets
+func (r Report) Err() error {
+	if r.Targets == 0 || r.Delivered+r.Accepted+r.Queued+r.Forwarded > 0 {
+		return nil
+	}
+
+	switch {
+	case r.NotFound > 0:
+		return errors.ErrDeviceNotFound
+	case r.TimedOut > 0:
+		return errors.ErrMessageExpired
+	default:
+		return errors.ErrDeviceQueueFull
+	}
+}
+
+// outcomes collects outcomes of the sessions the message is fanned out to
+type outcomes struct {
+	mu      sync.Mutex
+	devices map[uuid.UUID]Outcome
+}
+
+// add keeps the best outcome of the device sessions
+func (o *outcomes) add(id uuid.UUID, outcome Outcome) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if current, ok := o.devices[id]; !ok || rank[outcome] > rank[current] {
+		o.devices[id] = outcome
+	}
+}
@@ -3,133 +3,708 @@ package device
 import (
 	"context"
 	"sync"
-	"sync/atomic"
+	"time"
+	"tokeon-test-task/internal/config"
 	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/pkg/log"
 
 	"github.com/google/uuid"
 )
 
-type channel struct {
-	message chan string
-	stop    chan struct{}
-}
-
 type Service struct {
-	devicesChannels map[uuid.UUID]channel
-	mu              sync.RWMutex
+	logger log.Logger
+
+	// sessions - live sessions of every connected device
+	sessions map[uuid.UUID]map[uuid.UUID]*Session
+	// sessionSeq - seq of the last registered session
+	sessionSeq    uint64
+	sessionPolicy SessionPolicy
+	outboxSize    int
+	outboxPolicy  OutboxPolicy
+	// blockTimeout - how long the sender waits for space in the outbox with block policy
+	blockTimeout time.Duration
+	// sendTimeout - how long the message without ttl may wait in the outbox
+	sendTimeout time.Duration
+	// tenants - registries of the tenants, broadcasts and presence don't cross them
+	tenants map[string]*registry
+	// maxDevices - max amount of devices connected to the tenant, 0 if unlimited
+	maxDevices    int
+	lastSweep     time.Time
+	mailboxConfig config.MailboxConfig
+	mu            sync.RWMutex
+
+	// replays - messages sent to the resumable sessions, has its own lock
+	replays *replays
+
+	tracker     *tracker
+	cluster     Cluster
+	history     History
+	subscribers []EventSubscriber
 }
 
-func New() *Service {
+func New(logger log.Logger, config *config.Config, opts ...Option) *Service {
+	options := Options{}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	policy := SessionPolicy(config.SessionPolicy)
+	if policy == "" {
+		policy = SessionReject
+	}
+
+	outboxSize := config.Outbound.QueueSize
+	if outboxSize <= 0 {
+		outboxSize = defaultOutboxSize
+	}
+
+	outboxPolicy := OutboxPolicy(config.Outbound.Policy)
+	if outboxPolicy == "" {
+		outboxPolicy = OutboxDisconnect
+	}
+
 	return &Service{
-		devicesChannels: make(map[uuid.UUID]channel),
-		mu:              sync.RWMutex{},
+		logger:        logger,
+		sessions:      make(map[uuid.UUID]map[uuid.UUID]*Session),
+		sessionPolicy: policy,
+		outboxSize:    outboxSize,
+		outboxPolicy:  outboxPolicy,
+		blockTimeout:  config.Outbound.BlockTimeout,
+		sendTimeout:   config.SendTimeout,
+		tenants:       make(map[string]*registry),
+		maxDevices:    config.Tenant.MaxDevices,
+		lastSweep:     time.Now(),
+		mailboxConfig: config.Mailbox,
+		replays:       newReplays(config.Replay.Size, config.Replay.TTL),
+		mu:            sync.RWMutex{},
+		tracker:       newTracker(config.MessageStatusTTL),
+		cluster:       options.Cluster,
+		history:       options.History,
+		subscribers:   options.Subscribers,
 	}
 }
 
-func (s *Service) Register(id uuid.UUID) error {
+// Start forgets delivery status of the messages after MESSAGE_STATUS_TTL until ctx is done
+func (s *Service) Start(ctx context.Context) {
+	s.tracker.start(ctx)
+}
+
+// Register opens a new session of the device in the tenant of info, info is reported
+// by the presence. If the device already has sessions, the session policy decides
+// whether the new session is rejected, replaces them or is added to them. The device
+// connected to another tenant is rejected
+func (s *Service) Register(id uuid.UUID, info ConnectionInfo) (*Session, error) {
+	tenant := info.Tenant
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
-	_, ok := s.devicesChannels[id]
-	if ok {
-		return errors.ErrDeviceAlreadyRegistered
+	reg := s.openRegistry(tenant)
+
+	if reg.banned(id) {
+		s.pruneRegistry(tenant)
+		s.mu.Unlock()
+		return nil, errors.ErrDeviceBanned
 	}
 
-	s.devicesChannels[id] = channel{
-		make(chan string),
-		make(chan struct{}, 1),
+	first := !s.connected(id)
+
+	if first && s.maxDevices > 0 && len(reg.devices) >= s.maxDevices {
+		s.pruneRegistry(tenant)
+		s.mu.Unlock()
+		return nil, errors.ErrTenantLimit
 	}
 
-	return nil
+	var replaced []*Session
+	if !first {
+		if current, _ := s.tenantOf(id); current != tenant {
+			s.pruneRegistry(tenant)
+			s.mu.Unlock()
+			return nil, errors.ErrDeviceAlreadyRegistered
+		}
+
+		switch s.sessionPolicy {
+		case SessionTakeover:
+			replaced = s.deviceSessions(id)
+		case SessionMulti:
+		default:
+			s.mu.Unlock()
+			return nil, errors.ErrDeviceAlreadyRegistered
+		}
+	}
+
+	s.sessionSeq++
+	session := newSession(id, info, s.sessionSeq, newOutbox(s.outboxSize, s.outboxPolicy, s.sendTimeout))
+	go s.pump(session)
+
+	if first {
+		s.sessions[id] = make(map[uuid.UUID]*Session)
+		reg.devices[id] = struct{}{}
+	}
+	s.sessions[id][session.ID] = session
+
+	// messages queued for the replaced sessions go to the new one
+	for _, old := range replaced {
+		s.stopSession(old, &replacedFrame)
+	}
+
+	s.mu.Unlock()
+
+	for _, old := range replaced {
+		s.emit(Event{Type: EventDeviceDisconnected, Tenant: old.Tenant, DeviceID: id, SessionID: &old.ID, Reason: string(DisconnectReplaced)})
+	}
+
+	if first && s.cluster != nil {
+		if err := s.claim(tenant, id); err != nil {
+			s.mu.Lock()
+			s.stopSession(session, nil)
+			if !s.connected(id) {
+				s.unregister(tenant, id)
+			}
+			s.mu.Unlock()
+
+			return nil, err
+		}
+	}
+
+	s.emit(Event{Type: EventDeviceConnected, Tenant: session.Tenant, DeviceID: id, SessionID: &session.ID})
+
+	return session, nil
 }
 
-func (s *Service) Get(id uuid.UUID) (<-chan string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// claim marks the device as connected to this instance. With takeover policy the
+// session of the device on another instance is closed, with multi policy the device
+// may be connected to several instances
+func (s *Service) claim(tenant string, id uuid.UUID) error {
+	ctx := context.Background()
 
-	ch, ok := s.devicesChannels[id]
-	if !ok {
-		return nil, errors.ErrDeviceNotFound
+	err := s.cluster.Claim(ctx, id, s.sessionPolicy != SessionMulti)
+	if err == errors.ErrDeviceAlreadyRegistered && s.sessionPolicy == SessionTakeover {
+		err = s.takeOver(ctx, tenant, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	// ask other nodes to hand over messages queued while the device was offline
+	if err := s.cluster.Publish(ctx, "", ClusterEvent{
+		Kind:     ClusterEventConnected,
+		Origin:   s.cluster.NodeID(),
+		Tenant:   tenant,
+		DeviceID: &id,
+	}); err != nil {
+		s.logger.Errorf("failed to publish device %s connection: %v", id, err)
 	}
 
-	return ch.message, nil
+	return nil
 }
 
-func (s *Service) Close(id uuid.UUID) error {
+// Drain returns messages queued for the device in its tenant while it was offline in the
+// order they were sent and empties its mailbox. The mailbox of the device that is not
+// connected is the one without tenant
+func (s *Service) Drain(id uuid.UUID) []Message {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	ch, ok := s.devicesChannels[id]
+	tenant, _ := s.tenantOf(id)
+
+	return s.drain(tenant, id)
+}
+
+// drain empties mailbox of the device in the tenant. Must be called with the write lock held
+func (s *Service) drain(tenant string, id uuid.UUID) []Message {
+	reg := s.registry(tenant)
+
+	box, ok := reg.mailboxes[id]
 	if !ok {
+		return nil
+	}
+
+	delete(reg.mailboxes, id)
+	s.pruneRegistry(tenant)
+
+	s.expire(id, box.prune(time.Now(), s.mailboxConfig.MaxAge))
+
+	messages := box.messages(box.items)
+
+	// resumable clients may lose the drained messages as well
+	for _, session := range s.deviceSessions(id) {
+		if session.conn.info.Transport.resumable() {
+			for _, msg := range messages {
+				s.replays.remember(id, msg)
+			}
+			break
+		}
+	}
+
+	return messages
+}
+
+// Close closes the session, reason is reported to the event subscribers
+func (s *Service) Close(session *Session, reason DisconnectReason) error {
+	return s.close(session, reason, nil)
+}
+
+// close unregisters the session and passes the close frame to its connection if set.
+// The device is released when its last session is closed
+func (s *Service) close(session *Session, reason DisconnectReason, frame *CloseFrame) error {
+	id := session.DeviceID
+
+	s.mu.Lock()
+
+	if _, ok := s.sessions[id][session.ID]; !ok {
+		s.mu.Unlock()
 		return errors.ErrDeviceNotFound
 	}
 
-	ch.stop <- struct{}{}
-	close(ch.stop)
-	delete(s.devicesChannels, id)
+	s.stopSession(session, frame)
+
+	last := !s.connected(id)
+	if last {
+		s.unregister(session.Tenant, id)
+	}
+
+	s.mu.Unlock()
+
+	if last && s.cluster != nil {
+		if err := s.cluster.Release(context.Background(), id); err != nil {
+			s.logger.Errorf("failed to release device %s: %v", id, err)
+		}
+	}
+
+	s.emit(Event{Type: EventDeviceDisconnected, Tenant: session.Tenant, DeviceID: id, SessionID: &session.ID, Reason: string(reason)})
 
 	return nil
 }
 
-func (s *Service) SendMessage(ctx context.Context, deviceID *uuid.UUID, text string) error {
-	var channels []channel
+// Delivered marks the message as written to the device connection
+func (s *Service) Delivered(deviceID, messageID uuid.UUID) error {
+	return s.updateState(deviceID, messageID, DeliveryDelivered)
+}
+
+// Ack marks the message as confirmed by the device
+func (s *Service) Ack(deviceID, messageID uuid.UUID) error {
+	return s.updateState(deviceID, messageID, DeliveryAcked)
+}
+
+// Status returns delivery status of the message sent in the tenant for every target device
+func (s *Service) Status(tenant string, messageID uuid.UUID) (MessageStatus, error) {
+	return s.tracker.get(tenant, messageID)
+}
+
+// SendMessage sends the content to the target devices. Returns id of the message to
+// track its delivery status or error if the message has reached none of the targets
+func (s *Service) SendMessage(ctx context.Context, target Target, content Content) (uuid.UUID, error) {
+	report, err := s.Send(ctx, target, content)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := report.Err(); err != nil {
+		return uuid.Nil, err
+	}
+
+	return report.MessageID, nil
+}
+
+// Send sends the content to the target devices and reports what has happened to the
+// message on every target. Connected devices must accept the message before ctx is
+// done and before the message ttl, otherwise the message is expired
+func (s *Service) Send(ctx context.Context, target Target, content Content) (Report, error) {
+	msg := newMessage(target, content)
 
-	if deviceID != nil {
-		s.mu.RLock()
+	if !msg.ExpiresAt.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, msg.ExpiresAt)
+		defer cancel()
+	}
+
+	switch target.Kind() {
+	case TargetDevice:
+		return s.sendDevices(ctx, msg, target, []uuid.UUID{*target.DeviceID})
+	case TargetDevices:
+		return s.sendDevices(ctx, msg, target, target.DeviceIDs)
+	}
+
+	if err := s.saveMessage(ctx, msg, target); err != nil {
+		return Report{}, err
+	}
+
+	if s.cluster != nil {
+		if err := s.publishMessage(ctx, "", target, msg); err != nil {
+			return Report{}, err
+		}
+	}
+
+	recipients := s.localRecipients(target.Tenant, target.Topic, target.Exclude)
+
+	s.track(msg, recipients.devices, "")
+
+	return newReport(msg.ID, s.deliver(ctx, recipients, msg), false), nil
+}
+
+// sendDevices sends the message to the listed devices of the target tenant. Devices that
+// are not connected to this instance get the message through the instance they are
+// connected to or in their mailbox, if neither is possible they are reported as not found
+func (s *Service) sendDevices(ctx context.Context, msg Message, target Target, ids []uuid.UUID) (Report, error) {
+	tenant := target.Tenant
+
+	skip := make(map[uuid.UUID]struct{}, len(ids)+len(target.Exclude))
+	for _, id := range target.Exclude {
+		skip[id] = struct{}{}
+	}
+
+	var absent []uuid.UUID
 
-		ch, ok := s.devicesChannels[*deviceID]
-		if !ok {
-			return errors.ErrDeviceNotFound
+	s.mu.RLock()
+	recipients := recipients{seq: s.sessionSeq}
+	for _, id := range ids {
+		if _, ok := skip[id]; ok {
+			continue
 		}
+		skip[id] = struct{}{}
 
-		s.mu.RUnlock()
+		if s.connectedTo(tenant, id) {
+			recipients.add(id, s.sessions[id])
+		} else {
+			absent = append(absent, id)
+		}
+	}
+	s.mu.RUnlock()
 
-		channels = []channel{ch}
-	} else {
-		s.mu.RLock()
+	outcomes := make(map[uuid.UUID]Outcome, len(ids))
 
-		channels = make([]channel, 0, len(s.devicesChannels))
-		for _, ch := range s.devicesChannels {
-			channels = append(channels, ch)
+	// nodes of the cluster the devices are connected to, with multi policy the local
+	// devices may have sessions on other nodes as well
+	remote := make(map[uuid.UUID][]string)
+	if s.cluster != nil {
+		lookup := absent
+		if s.sessionPolicy == SessionMulti {
+			lookup = append(append([]uuid.UUID{}, absent...), recipients.devices...)
 		}
 
-		s.mu.RUnlock()
+		if len(lookup) > 0 {
+			var err error
+			if remote, err = s.remoteNodes(ctx, lookup...); err != nil {
+				return Report{}, err
+			}
+		}
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(len(channels))
+	if len(recipients.sessions) == 0 && len(remote) == 0 && s.mailboxConfig.MaxSize == 0 {
+		for _, id := range absent {
+			outcomes[id] = OutcomeNotFound
+		}
 
-	var lastErr error
-	var errCount int32
+		return newReport(uuid.Nil, outcomes, true), nil
+	}
 
-	for _, ch := range channels {
+	if err := s.saveMessage(ctx, msg, target); err != nil {
+		return Report{}, err
+	}
 
-		go func(ctx context.Context, channel channel) {
-			defer wg.Done()
+	var queue []uuid.UUID
+
+	s.mu.Lock()
 
-			if err := s.send(ctx, channel, text); err != nil {
-				lastErr = err
-				atomic.AddInt32(&errCount, 1)
+	for _, id := range absent {
+		if _, ok := remote[id]; ok {
+			continue
+		}
+
+		// device may have connected while we were looking for it
+		switch {
+		case s.connectedTo(tenant, id):
+			recipients.add(id, s.sessions[id])
+		case s.mailboxConfig.MaxSize == 0:
+			outcomes[id] = OutcomeNotFound
+		default:
+			queue = append(queue, id)
+		}
+	}
+
+	tracked := append(append([]uuid.UUID{}, recipients.devices...), queue...)
+	for id := range remote {
+		tracked = append(tracked, id)
+	}
+
+	s.track(msg, tracked, "")
+
+	for _, id := range queue {
+		if err := s.enqueue(tenant, id, msg); err != nil {
+			s.expire(id, []Message{msg})
+			outcomes[id] = OutcomeNotFound
+			continue
+		}
+
+		outcomes[id] = OutcomeQueued
+	}
+
+	s.mu.Unlock()
+
+	for id, nodes := range remote {
+		id := id
+		for _, node := range nodes {
+			if err := s.publishMessage(ctx, node, Target{Tenant: tenant, DeviceID: &id}, msg); err != nil {
+				return Report{}, err
+			}
+		}
+
+		outcomes[id] = OutcomeForwarded
+	}
+
+	for id, outcome := range s.deliver(ctx, recipients, msg) {
+		outcomes[id] = outcome
+	}
+
+	return newReport(msg.ID, outcomes, true), nil
+}
+
+// recipients - local sessions the message is fanned out to
+type recipients struct {
+	devices  []uuid.UUID
+	sessions []*Session
+	// seq - seq of the last session registered before the fan out
+	seq uint64
+}
+
+func (r *recipients) add(id uuid.UUID, sessions map[uuid.UUID]*Session) {
+	r.devices = append(r.devices, id)
+	for _, session := range sessions {
+		r.sessions = append(r.sessions, session)
+	}
+}
+
+// localRecipients returns sessions of the devices of the tenant subscribed to the topic or
+// of all devices of the tenant if topic is empty, excluded devices are skipped
+func (s *Service) localRecipients(tenant, topic string, exclude []uuid.UUID) recipients {
+	skip := make(map[uuid.UUID]struct{}, len(exclude))
+	for _, id := range exclude {
+		skip[id] = struct{}{}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reg := s.registry(tenant)
+	r := recipients{seq: s.sessionSeq}
+
+	if topic != "" {
+		for id := range reg.topics[topic] {
+			if _, ok := skip[id]; !ok {
+				r.add(id, s.sessions[id])
 			}
-		}(ctx, ch)
+		}
+
+		return r
+	}
+
+	for id := range reg.devices {
+		if _, ok := skip[id]; !ok {
+			r.add(id, s.sessions[id])
+		}
+	}
+
+	return r
+}
+
+// deviceRecipients returns sessions of the device. Must be called with the lock held
+func (s *Service) deviceRecipients(id uuid.UUID) recipients {
+	return recipients{
+		devices:  []uuid.UUID{id},
+		sessions: s.deviceSessions(id),
+		seq:      s.sessionSeq,
+	}
+}
+
+// deliver hands the message over to the device sessions. Returns outcome of every device,
+// the message is reported delivered if it has been written to the device in the meantime
+func (s *Service) deliver(ctx context.Context, recipients recipients, msg Message) map[uuid.UUID]Outcome {
+	result := &outcomes{devices: make(map[uuid.UUID]Outcome, len(recipients.devices))}
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(recipients.sessions))
+
+	for _, session := range recipients.sessions {
+
+		go func(ctx context.Context, session *Session) {
+			defer wg.Done()
+
+			result.add(session.DeviceID, s.send(ctx, session, msg, recipients.seq))
+		}(ctx, session)
 	}
 
 	wg.Wait()
 
-	if lastErr != nil && len(channels) == int(errCount) {
-		return lastErr
+	for id, outcome := range result.devices {
+		if outcome == OutcomeAccepted && s.tracker.delivered(msg.ID, id) {
+			result.devices[id] = OutcomeDelivered
+		}
 	}
 
-	return nil
+	return result.devices
 }
 
-func (s *Service) send(ctx context.Context, channel channel, text string) error {
-	select {
-	case channel.message <- text:
-		return nil
-	case <-channel.stop:
+// send queues the message in the session outbox, the full outbox is handled by the
+// outbox policy. Sessions registered after seq haven't received the message from the
+// fan out, so it is passed to them if the session is closed
+func (s *Service) send(ctx context.Context, session *Session, msg Message, seq uint64) Outcome {
+	id := session.DeviceID
+
+	var deadline <-chan time.Time
+
+	for {
+		dropped, err := session.outbox.push(queued{message: msg, seq: seq})
+		if dropped != nil {
+			s.expire(id, []Message{dropped.message})
+		}
+
+		switch err {
+		case nil:
+			return OutcomeAccepted
+		case errOutboxClosed:
+			// session has gone while we were sending
+			s.mu.Lock()
+			outcome := s.rerouteOne(session, queued{message: msg, seq: seq})
+			s.mu.Unlock()
+
+			return outcome
+		}
+
+		switch s.outboxPolicy {
+		case OutboxDropNewest:
+			s.expire(id, []Message{msg})
+			return OutcomeDropped
+		case OutboxDisconnect:
+			s.logger.Warnf("session %s of device %s is too slow, disconnecting", session.ID, id)
+			s.close(session, DisconnectSlowConsumer, &slowConsumerFrame)
+
+			continue
+		}
+
+		if deadline == nil {
+			timer := time.NewTimer(s.blockTimeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		select {
+		case <-session.outbox.space:
+		case <-session.stop:
+		case <-deadline:
+			s.expire(id, []Message{msg})
+			return OutcomeDropped
+		case <-ctx.Done():
+			s.expire(id, []Message{msg})
+			return OutcomeTimedOut
+		}
+	}
+}
+
+func (s *Service) publishMessage(ctx context.Context, node string, target Target, msg Message) error {
+	event := ClusterEvent{
+		Kind:     ClusterEventMessage,
+		Origin:   s.cluster.NodeID(),
+		Tenant:   target.Tenant,
+		DeviceID: target.DeviceID,
+		Topic:    target.Topic,
+		Exclude:  target.Exclude,
+		Message:  &msg,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		event.Deadline = deadline
+	}
+
+	return s.cluster.Publish(ctx, node, event)
+}
+
+// enqueue stores the message in mailbox of the device in the tenant. Must be called with
+// the write lock held
+func (s *Service) enqueue(tenant string, id uuid.UUID, msg Message) error {
+	if s.mailboxConfig.MaxSize == 0 {
 		return errors.ErrDeviceNotFound
-	case <-ctx.Done():
+	}
+
+	now := time.Now()
+
+	// drop expired mailboxes of the devices that have never come back
+	if s.mailboxConfig.MaxAge > 0 && now.Sub(s.lastSweep) > s.mailboxConfig.MaxAge {
+		for name, reg := range s.tenants {
+			for boxID, box := range reg.mailboxes {
+				s.expire(boxID, box.prune(now, s.mailboxConfig.MaxAge))
+				if box.empty() {
+					delete(reg.mailboxes, boxID)
+				}
+			}
+			s.pruneRegistry(name)
+		}
+		s.lastSweep = now
+	}
+
+	reg := s.openRegistry(tenant)
+
+	box, ok := reg.mailboxes[id]
+	if !ok {
+		box = &mailbox{}
+		reg.mailboxes[id] = box
+	}
+
+	s.expire(id, box.prune(now, s.mailboxConfig.MaxAge))
+	s.expire(id, box.push(msg, now, s.mailboxConfig.MaxSize))
+
+	return nil
+}
+
+// expire marks messages that will never reach the device
+func (s *Service) expire(id uuid.UUID, messages []Message) {
+	for _, msg := range messages {
+		s.updateState(id, msg.ID, DeliveryExpired)
+	}
+}
+
+func (s *Service) saveMessage(ctx context.Context, msg Message, target Target) error {
+	if s.history == nil {
 		return nil
 	}
+
+	return s.history.SaveMessage(ctx, msg, target)
+}
+
+func (s *Service) track(msg Message, targets []uuid.UUID, origin string) {
+	s.tracker.track(msg, targets, origin)
+
+	if s.history != nil && origin == "" {
+		for _, id := range targets {
+			s.history.SaveState(msg.ID, id, DeliveryPending, msg.CreatedAt)
+		}
+	}
+}
+
+// updateState changes delivery status of the message
+func (s *Service) updateState(deviceID, messageID uuid.UUID, state DeliveryState) error {
+	origin, tenant, changed, err := s.tracker.update(messageID, deviceID, state)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		s.stateChanged(origin, deviceID, messageID, state)
+		s.emitState(tenant, deviceID, messageID, state)
+	}
+
+	return nil
+}
+
+// stateChanged stores the new status of the message or reports it to the node that
+// has accepted the message
+func (s *Service) stateChanged(origin string, deviceID, messageID uuid.UUID, state DeliveryState) {
+	if origin != "" {
+		s.publishStatus(context.Background(), origin, deviceID, messageID, state)
+		return
+	}
+
+	if s.history != nil {
+		s.history.SaveState(messageID, deviceID, state, time.Now())
+	}
 }
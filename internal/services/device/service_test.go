@@ -0,0 +1,895 @@
+package device
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/google/uuid"
+)
+
+func newTestService(mailbox config.MailboxConfig) *Service {
+	return New(log.New(), &config.Config{Mailbox: mailbox})
+}
+
+// Test messages for offline device are queued and drained in order
+func TestMailboxDrain(t *testing.T) {
+	s := newTestService(config.MailboxConfig{MaxSize: 2, MaxAge: time.Hour})
+	id := uuid.New()
+
+	for _, text := range []string{"first", "second", "third"} {
+		if _, err := s.SendMessage(context.Background(), Target{DeviceID: &id}, Content{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.Register(id, ConnectionInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := s.Drain(id)
+	if len(messages) != 2 || messages[0].Text != "second" || messages[1].Text != "third" {
+		t.Errorf("wrong drained messages: %v", messages)
+	}
+
+	if messages := s.Drain(id); len(messages) != 0 {
+		t.Errorf("mailbox must be empty after drain: %v", messages)
+	}
+}
+
+// Test expired messages are not delivered
+func TestMailboxMaxAge(t *testing.T) {
+	s := newTestService(config.MailboxConfig{MaxSize: 10, MaxAge: time.Millisecond})
+	id := uuid.New()
+
+	if _, err := s.SendMessage(context.Background(), Target{DeviceID: &id}, Content{Text: "old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if messages := s.Drain(id); len(messages) != 0 {
+		t.Errorf("expired messages must be dropped: %v", messages)
+	}
+}
+
+// Test disabled mailbox keeps the old behaviour
+func TestMailboxDisabled(t *testing.T) {
+	s := newTestService(config.MailboxConfig{})
+	id := uuid.New()
+
+	if _, err := s.SendMessage(context.Background(), Target{DeviceID: &id}, Content{Text: "text"}); err != errors.ErrDeviceNotFound {
+		t.Errorf("expected %v, got %v", errors.ErrDeviceNotFound, err)
+	}
+}
+
+// Test delivery status goes through pending, delivered and acked
+func TestMessageStatus(t *testing.T) {
+	s := newTestService(config.MailboxConfig{MaxSize: 10, MaxAge: time.Hour})
+	id := uuid.New()
+
+	messageID, err := s.SendMessage(context.Background(), Target{DeviceID: &id}, Content{Text: "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertState := func(state DeliveryState) {
+		t.Helper()
+
+		status, err := s.Status("", messageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(status.Deliveries) != 1 || status.Deliveries[0].State != state {
+			t.Errorf("expected %s, got %+v", state, status.Deliveries)
+		}
+	}
+
+	assertState(DeliveryPending)
+
+	if err := s.Delivered(id, messageID); err != nil {
+		t.Fatal(err)
+	}
+	assertState(DeliveryDelivered)
+
+	if err := s.Ack(id, messageID); err != nil {
+		t.Fatal(err)
+	}
+	assertState(DeliveryAcked)
+
+	// status never goes backwards
+	if err := s.Delivered(id, messageID); err != nil {
+		t.Fatal(err)
+	}
+	assertState(DeliveryAcked)
+
+	if err := s.Ack(uuid.New(), messageID); err != errors.ErrMessageNotFound {
+		t.Errorf("expected %v, got %v", errors.ErrMessageNotFound, err)
+	}
+}
+
+// Test expired status doesn't replace delivered and acked ones, delivered replaces expired
+func TestStatusOrder(t *testing.T) {
+	cases := []struct {
+		states   []DeliveryState
+		expected DeliveryState
+	}{
+		{[]DeliveryState{DeliveryDelivered, DeliveryExpired}, DeliveryDelivered},
+		{[]DeliveryState{DeliveryAcked, DeliveryExpired}, DeliveryAcked},
+		{[]DeliveryState{DeliveryExpired, DeliveryDelivered}, DeliveryDelivered},
+		{[]DeliveryState{DeliveryExpired, DeliveryAcked}, DeliveryAcked},
+	}
+
+	for _, c := range cases {
+		tr := newTracker(time.Hour)
+		msg := Message{ID: uuid.New(), CreatedAt: time.Now()}
+		id := uuid.New()
+		tr.track(msg, []uuid.UUID{id}, "")
+
+		for _, state := range c.states {
+			if _, _, _, err := tr.update(msg.ID, id, state); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		status, err := tr.get("", msg.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state := status.Deliveries[0].State; state != c.expected {
+			t.Errorf("%v: expected %s, got %s", c.states, c.expected, state)
+		}
+	}
+}
+
+// Test topic message reaches only subscribers and subscriptions are removed on close
+func TestTopic(t *testing.T) {
+	s := newTestService(config.MailboxConfig{})
+	subscriber, other := uuid.New(), uuid.New()
+
+	session, err := s.Register(subscriber, ConnectionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register(other, ConnectionInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Subscribe(subscriber, "news"); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.SendMessage(context.Background(), Target{Topic: "news"}, Content{Text: "text"})
+
+	if msg := <-session.Messages(); msg.Text != "text" {
+		t.Errorf("wrong message: %+v", msg)
+	}
+
+	if err := s.Close(session, DisconnectNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	if reg := s.registry(""); len(reg.topics) != 0 || len(reg.deviceTopics) != 0 {
+		t.Errorf("subscriptions must be removed on close: %v", reg.topics)
+	}
+}
+
+// Test subscriptions belong to the device, so they are shared by its sessions with multi
+// policy and are kept until the last session is closed
+func TestTopicSessions(t *testing.T) {
+	s := New(log.New(), &config.Config{SessionPolicy: string(SessionMulti), MessageStatusTTL: time.Hour})
+	id := uuid.New()
+
+	sessions := make([]*Session, 2)
+	for i := range sessions {
+		var err error
+		if sessions[i], err = s.Register(id, ConnectionInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the subscription made through one session reaches both of them
+	if err := s.Subscribe(id, "news"); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.SendMessage(context.Background(), Target{Topic: "news"}, Content{Text: "both"})
+
+	for _, session := range sessions {
+		if msg := <-session.Messages(); msg.Text != "both" {
+			t.Errorf("wrong message: %+v", msg)
+		}
+	}
+
+	if err := s.Close(sessions[0], DisconnectNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.SendMessage(context.Background(), Target{Topic: "news"}, Content{Text: "left"})
+
+	if msg := <-sessions[1].Messages(); msg.Text != "left" {
+		t.Errorf("subscription must be kept for the session left: %+v", msg)
+	}
+
+	// unsubscribe of any session removes the subscription of the device
+	if err := s.Unsubscribe(id, "news"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Send(context.Background(), Target{Topic: "news"}, Content{Text: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Targets != 0 {
+		t.Errorf("unsubscribed device must not be targeted: %+v", report)
+	}
+}
+
+type eventRecorder []Event
+
+func (r *eventRecorder) HandleEvent(event Event) {
+	*r = append(*r, event)
+}
+
+// Test connection and delivery events are emitted in order with the tenant of the device
+func TestEvents(t *testing.T) {
+	events := &eventRecorder{}
+	s := New(
+		log.New(),
+		&config.Config{Mailbox: config.MailboxConfig{MaxSize: 1, MaxAge: time.Hour}, MessageStatusTTL: time.Hour},
+		WithEventSubscriber(events),
+	)
+	id := uuid.New()
+
+	// the second message pushes the first one out of the mailbox
+	first, err := s.SendMessage(context.Background(), Target{Tenant: "shop", DeviceID: &id}, Content{Text: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SendMessage(context.Background(), Target{Tenant: "shop", DeviceID: &id}, Content{Text: "second"}); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := s.Register(id, ConnectionInfo{Tenant: "shop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := s.Drain(id)
+	if err := s.Delivered(id, messages[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(session, DisconnectReadError); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []EventType{EventMessageFailed, EventDeviceConnected, EventMessageDelivered, EventDeviceDisconnected}
+	if len(*events) != len(expected) {
+		t.Fatalf("wrong events: %+v", *events)
+	}
+
+	for i, event := range *events {
+		if event.Type != expected[i] || event.DeviceID != id || event.Tenant != "shop" {
+			t.Errorf("wrong event %d: %+v", i, event)
+		}
+	}
+
+	if failed := (*events)[0]; *failed.MessageID != first || failed.Reason != failedExpired {
+		t.Errorf("wrong failed event: %+v", failed)
+	}
+
+	if disconnected := (*events)[3]; disconnected.Reason != string(DisconnectReadError) || *disconnected.SessionID != session.ID {
+		t.Errorf("wrong disconnected event: %+v", disconnected)
+	}
+}
+
+// Test messages that have not been accepted within ttl are reported as expired
+func TestMessageTTL(t *testing.T) {
+	s := New(log.New(), &config.Config{Mailbox: config.MailboxConfig{MaxSize: 10, MaxAge: time.Hour}, MessageStatusTTL: time.Hour})
+
+	connected, offline := uuid.New(), uuid.New()
+	if _, err := s.Register(connected, ConnectionInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody reads the channel of the connected device, the message expires in the outbox
+	queued, err := s.SendMessage(context.Background(), Target{DeviceID: &connected}, Content{Text: "text", TTL: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.SendMessage(context.Background(), Target{DeviceID: &offline}, Content{Text: "text", TTL: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := s.Register(offline, ConnectionInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if messages := s.Drain(offline); len(messages) != 0 {
+		t.Errorf("expired messages must not be drained: %v", messages)
+	}
+
+	// the outbox expires the message once its timer has fired
+	deadline := time.Now().Add(time.Second)
+	for _, id := range []uuid.UUID{queued, id} {
+		for {
+			status, err := s.Status("", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status.Deliveries[0].State == DeliveryExpired {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("wrong status: %+v", status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// Test the message without ttl that the connection hasn't taken within the send timeout is
+// reported as expired
+func TestSendTimeout(t *testing.T) {
+	s := New(log.New(), &config.Config{SendTimeout: 20 * time.Millisecond, MessageStatusTTL: time.Hour})
+
+	id := uuid.New()
+	session, err := s.Register(id, ConnectionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody reads the channel of the connected device
+	stale, err := s.SendMessage(context.Background(), Target{DeviceID: &id}, Content{Text: "stale"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		status, err := s.Status("", stale)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status.Deliveries[0].State == DeliveryExpired {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong status: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the message taken in time is delivered
+	fresh, err := s.SendMessage(context.Background(), Target{DeviceID: &id}, Content{Text: "fresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-session.Messages(); msg.ID != fresh {
+		t.Fatalf("expired message has been written: %+v", msg)
+	}
+	if err := s.Delivered(id, fresh); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := s.Status("", fresh); status.Deliveries[0].State != DeliveryDelivered {
+		t.Errorf("wrong status: %+v", status)
+	}
+}
+
+// Test connected devices are listed with their connection info and counters
+func TestPresence(t *testing.T) {
+	s := newTestService(config.MailboxConfig{})
+
+	first, second := uuid.New(), uuid.New()
+	sessions := make(map[uuid.UUID]*Session)
+	for _, id := range []uuid.UUID{first, second} {
+		session, err := s.Register(id, ConnectionInfo{RemoteIP: "10.0.0.1", UserAgent: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions[id] = session
+	}
+
+	sessions[first].CountInbound()
+	sessions[first].CountOutbound()
+
+	devices, count := s.Devices("", 1, 1)
+	if count != 2 || len(devices) != 1 || devices[0].DeviceID != first {
+		t.Fatalf("wrong first page: %+v, count %d", devices, count)
+	}
+
+	if p := devices[0].Sessions[0]; p.SessionID != sessions[first].ID || p.RemoteIP != "10.0.0.1" || p.InboundCount != 1 || p.OutboundCount != 1 || p.LastInboundAt == nil {
+		t.Errorf("wrong presence: %+v", p)
+	}
+
+	if devices, _ := s.Devices("", 3, 1); len(devices) != 0 {
+		t.Errorf("page out of range must be empty: %+v", devices)
+	}
+
+	if err := s.Close(sessions[second], DisconnectNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Device("", second); err != errors.ErrDeviceNotFound {
+		t.Errorf("closed device must not be present, got: %v", err)
+	}
+}
+
+// Test disconnected device receives the close frame and can't reconnect while banned
+func TestDisconnect(t *testing.T) {
+	s := newTestService(config.MailboxConfig{})
+	id := uuid.New()
+
+	session, err := s.Register(id, ConnectionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := CloseFrame{Code: 4000, Reason: "bye"}
+	if err := s.Disconnect(context.Background(), "", id, frame, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-session.Closed(); got != frame {
+		t.Errorf("wrong close frame: %+v", got)
+	}
+
+	if _, err := s.Register(id, ConnectionInfo{}); err != errors.ErrDeviceBanned {
+		t.Errorf("banned device must not connect, got: %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if _, err := s.Register(id, ConnectionInfo{}); err != nil {
+		t.Errorf("device must connect after ban: %v", err)
+	}
+
+	if err := s.Disconnect(context.Background(), "", uuid.New(), frame, 0); err != errors.ErrDeviceNotFound {
+		t.Errorf("wrong error of not connected device: %v", err)
+	}
+}
+
+// Test duplicate connection is rejected, replaces the old session or is added to it
+func TestSessionPolicy(t *testing.T) {
+	newService := func(policy SessionPolicy) *Service {
+		return New(log.New(), &config.Config{SessionPolicy: string(policy), MessageStatusTTL: time.Hour})
+	}
+
+	id := uuid.New()
+
+	s := newService(SessionReject)
+	if _, err := s.Register(id, ConnectionInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register(id, ConnectionInfo{}); err != errors.ErrDeviceAlreadyRegistered {
+		t.Errorf("duplicate connection must be rejected, got: %v", err)
+	}
+
+	s = newService(SessionTakeover)
+	old, err := s.Register(id, ConnectionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Subscribe(id, "news"); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := s.Register(id, ConnectionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame := <-old.Closed(); frame != replacedFrame {
+		t.Errorf("wrong close frame of the replaced session: %+v", frame)
+	}
+
+	// the replaced session is already closed, subscriptions are kept for the new one
+	if err := s.Close(old, DisconnectNormal); err != errors.ErrDeviceNotFound {
+		t.Errorf("replaced session must be unregistered, got: %v", err)
+	}
+
+	go s.SendMessage(context.Background(), Target{Topic: "news"}, Content{Text: "text"})
+
+	if msg := <-current.Messages(); msg.Text != "text" {
+		t.Errorf("wrong message: %+v", msg)
+	}
+
+	s = newService(SessionMulti)
+	sessions := make([]*Session, 2)
+	for i := range sessions {
+		if sessions[i], err = s.Register(id, ConnectionInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go s.SendMessage(context.Background(), Target{DeviceID: &id}, Content{Text: "text"})
+
+	for _, session := range sessions {
+		if msg := <-session.Messages(); msg.Text != "text" {
+			t.Errorf("wrong message: %+v", msg)
+		}
+	}
+
+	presence, err := s.Device("", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presence.Sessions) != 2 {
+		t.Errorf("every session must be present: %+v", presence)
+	}
+
+	if err := s.Close(sessions[0], DisconnectNormal); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Device("", id); err != nil {
+		t.Errorf("device must stay connected with the other session: %v", err)
+	}
+}
+
+// Test full outbox of the slow session is handled by the outbox policy
+func TestOutboxPolicy(t *testing.T) {
+	newService := func(policy OutboxPolicy) *Service {
+		return New(log.New(), &config.Config{
+			Mailbox:          config.MailboxConfig{MaxSize: 10, MaxAge: time.Hour},
+			MessageStatusTTL: time.Hour,
+			Outbound:         config.OutboundConfig{QueueSize: 1, Policy: string(policy), BlockTimeout: 20 * time.Millisecond},
+		})
+	}
+
+	send := func(s *Service, id uuid.UUID, text string) error {
+		_, err := s.SendMessage(context.Background(), Target{DeviceID: &id}, Content{Text: text})
+		return err
+	}
+
+	id := uuid.New()
+
+	// the pump holds the first message, the second one fills the outbox
+	fill := func(s *Service) *Session {
+		session, err := s.Register(id, ConnectionInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, text := range []string{"first", "second"} {
+			if err := send(s, id, text); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		return session
+	}
+
+	s := newService(OutboxDropOldest)
+	session := fill(s)
+	if err := send(s, id, "third"); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"first", "third"} {
+		if msg := <-session.Messages(); msg.Text != text {
+			t.Errorf("drop oldest: expected %s, got %+v", text, msg)
+		}
+	}
+
+	s = newService(OutboxDropNewest)
+	fill(s)
+	if err := send(s, id, "third"); err != errors.ErrDeviceQueueFull {
+		t.Errorf("drop newest: expected %v, got %v", errors.ErrDeviceQueueFull, err)
+	}
+
+	s = newService(OutboxBlock)
+	start := time.Now()
+	fill(s)
+	if err := send(s, id, "third"); err != errors.ErrDeviceQueueFull || time.Since(start) < 20*time.Millisecond {
+		t.Errorf("block: expected %v after the timeout, got %v", errors.ErrDeviceQueueFull, err)
+	}
+
+	s = newService(OutboxDisconnect)
+	session = fill(s)
+	if err := send(s, id, "third"); err != nil {
+		t.Fatal(err)
+	}
+	if frame := <-session.Closed(); frame != slowConsumerFrame {
+		t.Errorf("wrong close frame of the slow session: %+v", frame)
+	}
+
+	// every message of the slow session is kept for the device
+	messages := s.Drain(id)
+	if len(messages) != 3 || messages[0].Text != "first" || messages[2].Text != "third" {
+		t.Errorf("wrong mailbox of the slow device: %+v", messages)
+	}
+}
+
+// Test report counts outcomes of the message on every target
+func TestSendReport(t *testing.T) {
+	s := New(log.New(), &config.Config{
+		MessageStatusTTL: time.Hour,
+		Outbound:         config.OutboundConfig{QueueSize: 1, Policy: string(OutboxDropNewest)},
+	})
+
+	idle, slow := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{idle, slow} {
+		if _, err := s.Register(id, ConnectionInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the pump of the slow device holds the first message, the second one fills its outbox
+	for _, text := range []string{"first", "second"} {
+		if _, err := s.SendMessage(context.Background(), Target{DeviceID: &slow}, Content{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	report, err := s.Send(context.Background(), Target{}, Content{Text: "broadcast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Targets != 2 || report.Accepted != 1 || report.Dropped != 1 || report.Devices != nil {
+		t.Errorf("wrong broadcast report: %+v", report)
+	}
+
+	offline := uuid.New()
+	report, err = s.Send(context.Background(), Target{DeviceID: &offline}, Content{Text: "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NotFound != 1 || report.Devices[offline] != OutcomeNotFound || report.Err() != errors.ErrDeviceNotFound {
+		t.Errorf("wrong report of the offline device: %+v", report)
+	}
+}
+
+// Test message reaches the listed devices and skips the excluded ones
+func TestSendDevices(t *testing.T) {
+	s := New(log.New(), &config.Config{
+		Mailbox:          config.MailboxConfig{MaxSize: 10, MaxAge: time.Hour},
+		MessageStatusTTL: time.Hour,
+	})
+
+	connected, excluded, offline := uuid.New(), uuid.New(), uuid.New()
+	sessions := make(map[uuid.UUID]*Session)
+	for _, id := range []uuid.UUID{connected, excluded} {
+		session, err := s.Register(id, ConnectionInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions[id] = session
+	}
+
+	report, err := s.Send(context.Background(), Target{
+		DeviceIDs: []uuid.UUID{connected, excluded, offline, connected},
+		Exclude:   []uuid.UUID{excluded},
+	}, Content{Text: "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the message waits in the outbox until the connection writes it
+	expected := map[uuid.UUID]Outcome{connected: OutcomeAccepted, offline: OutcomeQueued}
+	if report.Targets != 2 || len(report.Devices) != 2 ||
+		report.Devices[connected] != expected[connected] || report.Devices[offline] != expected[offline] {
+		t.Errorf("wrong report: %+v", report)
+	}
+
+	if msg := <-sessions[connected].Messages(); msg.Target.Kind() != TargetDevices {
+		t.Errorf("wrong message: %+v", msg)
+	}
+	if messages := s.Drain(offline); len(messages) != 1 {
+		t.Errorf("offline device must get the message in the mailbox: %+v", messages)
+	}
+
+	report, err = s.Send(context.Background(), Target{Exclude: []uuid.UUID{connected}}, Content{Text: "broadcast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Targets != 1 {
+		t.Errorf("excluded device must not be targeted: %+v", report)
+	}
+	if msg := <-sessions[excluded].Messages(); msg.Text != "broadcast" {
+		t.Errorf("wrong message: %+v", msg)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := New(log.New(), &config.Config{
+		MessageStatusTTL: time.Hour,
+		Replay:           config.ReplayConfig{Size: 2, TTL: time.Hour},
+	})
+
+	id := uuid.New()
+	session, err := s.Register(id, ConnectionInfo{Transport: TransportSSE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make([]uuid.UUID, 0, 3)
+	for _, text := range []string{"first", "second", "third"} {
+		messageID, err := s.SendMessage(context.Background(), Target{DeviceID: &id}, Content{Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-session.Messages()
+		sent = append(sent, messageID)
+	}
+
+	// the message is remembered right after the connection has taken it
+	deadline := time.Now().Add(time.Second)
+	for {
+		messages, ok := s.Replay(id, sent[1])
+		if ok && len(messages) == 1 && messages[0].ID == sent[2] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong replay: %+v, %v", messages, ok)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := s.Replay(id, sent[0]); ok {
+		t.Error("message beyond the replay size must be forgotten")
+	}
+
+	other := uuid.New()
+	wsSession, err := s.Register(other, ConnectionInfo{Transport: TransportWebsocket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageID, err := s.SendMessage(context.Background(), Target{DeviceID: &other}, Content{Text: "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-wsSession.Messages()
+	if _, ok := s.Replay(other, messageID); ok {
+		t.Error("messages of the websocket sessions must not be remembered")
+	}
+}
+
+// Test devices of one tenant don't see devices and messages of another
+func TestTenants(t *testing.T) {
+	s := New(log.New(), &config.Config{
+		Mailbox:          config.MailboxConfig{MaxSize: 10, MaxAge: time.Hour},
+		MessageStatusTTL: time.Hour,
+		Tenant:           config.TenantConfig{MaxDevices: 1},
+	})
+
+	shop, bank := uuid.New(), uuid.New()
+	shopSession, err := s.Register(shop, ConnectionInfo{Tenant: "shop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bankSession, err := s.Register(bank, ConnectionInfo{Tenant: "bank"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Register(uuid.New(), ConnectionInfo{Tenant: "shop"}); err != errors.ErrTenantLimit {
+		t.Errorf("expected %v, got %v", errors.ErrTenantLimit, err)
+	}
+	if _, err := s.Register(shop, ConnectionInfo{Tenant: "bank"}); err != errors.ErrDeviceAlreadyRegistered {
+		t.Errorf("expected %v, got %v", errors.ErrDeviceAlreadyRegistered, err)
+	}
+
+	if devices, count := s.Devices("shop", 1, 10); count != 1 || devices[0].DeviceID != shop {
+		t.Errorf("wrong devices of the tenant: %+v", devices)
+	}
+	if _, err := s.Device("shop", bank); err != errors.ErrDeviceNotFound {
+		t.Errorf("device of another tenant must not be present, got: %v", err)
+	}
+
+	report, err := s.Send(context.Background(), Target{Tenant: "shop"}, Content{Text: "broadcast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Targets != 1 {
+		t.Errorf("broadcast must reach the tenant only: %+v", report)
+	}
+	if msg := <-shopSession.Messages(); msg.Text != "broadcast" {
+		t.Errorf("wrong message: %+v", msg)
+	}
+
+	// the device of another tenant is offline for the sender
+	messageID, err := s.SendMessage(context.Background(), Target{Tenant: "shop", DeviceID: &bank}, Content{Text: "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-bankSession.Messages():
+		t.Errorf("message of another tenant must not be delivered: %+v", msg)
+	default:
+	}
+	if messages := s.Drain(bank); len(messages) != 0 {
+		t.Errorf("mailbox of another tenant must not be drained: %+v", messages)
+	}
+
+	if _, err := s.Status("bank", messageID); err != errors.ErrMessageNotFound {
+		t.Errorf("status of another tenant must not be found, got: %v", err)
+	}
+	if _, err := s.Status("shop", messageID); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test registry of the tenant is dropped once the ban of the device is over
+func TestBanPruned(t *testing.T) {
+	s := newTestService(config.MailboxConfig{})
+
+	frame := CloseFrame{Code: 4000, Reason: "bye"}
+	if err := s.Disconnect(context.Background(), "shop", uuid.New(), frame, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	// another device of the tenant comes and goes
+	session, err := s.Register(uuid.New(), ConnectionInfo{Tenant: "shop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(session, DisconnectNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.RLock()
+	_, ok := s.tenants["shop"]
+	s.mu.RUnlock()
+
+	if ok {
+		t.Error("registry with the expired ban must be dropped")
+	}
+}
+
+// Test delivery status is forgotten after the ttl when nothing else is sent
+func TestTrackerSweep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tr := newTracker(200 * time.Millisecond)
+	tr.start(ctx)
+
+	old := Message{ID: uuid.New(), CreatedAt: time.Now()}
+	tr.track(old, []uuid.UUID{uuid.New()}, "")
+
+	time.Sleep(120 * time.Millisecond)
+
+	fresh := Message{ID: uuid.New(), CreatedAt: time.Now()}
+	tr.track(fresh, []uuid.UUID{uuid.New()}, "")
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := tr.get("", old.ID); err != errors.ErrMessageNotFound {
+		t.Errorf("expired status must be forgotten, got: %v", err)
+	}
+	if _, err := tr.get("", fresh.ID); err != nil {
+		t.Errorf("fresh status must be kept: %v", err)
+	}
+
+	// the ticker sweeps without reads
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		tr.mu.Lock()
+		swept := len(tr.messages) == 0 && len(tr.order) == 0
+		left := len(tr.messages)
+		tr.mu.Unlock()
+
+		if swept {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired statuses must be swept: %d", left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,224 @@
+package device
+
+import (
+	"context"
+	"time"
+	"tokeon-test-task/internal/errors"
+
+	"github.com/google/uuid"
+)
+
+// SessionPolicy - what happens when the device connects while it already has a session
+type SessionPolicy string
+
+const (
+	// SessionReject - the new connection is refused
+	SessionReject SessionPolicy = "reject"
+	// SessionTakeover - the old sessions are closed and the new one gets the mailbox
+	SessionTakeover SessionPolicy = "takeover"
+	// SessionMulti - every session of the device receives the messages
+	SessionMulti SessionPolicy = "multi"
+)
+
+// replacedFrame - close frame of the session replaced by the new connection
+var replacedFrame = CloseFrame{Code: 4409, Reason: "replaced by a new connection"}
+
+const (
+	// takeOverTimeout - time the instance waits for another one to release the device
+	takeOverTimeout = 2 * time.Second
+	takeOverPoll    = 100 * time.Millisecond
+)
+
+// Session is a single connection of the device
+type Session struct {
+	ID       uuid.UUID
+	DeviceID uuid.UUID
+	// Tenant - tenant the device has connected to
+	Tenant string
+
+	messages chan Message
+	outbox   *outbox
+	// pumped - closed when the outbox pump has stopped
+	pumped chan struct{}
+	stop   chan struct{}
+	// closed - receives the close frame if the server closes the session
+	closed chan CloseFrame
+	conn   *connection
+	// seq - order of the session registration
+	seq uint64
+}
+
+func newSession(deviceID uuid.UUID, info ConnectionInfo, seq uint64, outbox *outbox) *Session {
+	return &Session{
+		ID:       uuid.New(),
+		DeviceID: deviceID,
+		Tenant:   info.Tenant,
+		messages: make(chan Message),
+		outbox:   outbox,
+		pumped:   make(chan struct{}),
+		stop:     make(chan struct{}, 1),
+		closed:   make(chan CloseFrame, 1),
+		conn:     newConnection(info),
+		seq:      seq,
+	}
+}
+
+// Messages returns channel of the messages to write to the connection
+func (s *Session) Messages() <-chan Message {
+	return s.messages
+}
+
+// Closed returns channel that receives the close frame when the server closes the
+// session. The session is already unregistered then
+func (s *Session) Closed() <-chan CloseFrame {
+	return s.closed
+}
+
+// CountInbound counts the message the device has sent
+func (s *Session) CountInbound() {
+	s.conn.inboundCount.Add(1)
+	s.conn.lastInbound.Store(time.Now().UnixNano())
+}
+
+// CountOutbound counts the message written to the device
+func (s *Session) CountOutbound() {
+	s.conn.outboundCount.Add(1)
+	s.conn.lastOutbound.Store(time.Now().UnixNano())
+}
+
+// stopSession signals senders and the connection that the session is over and reroutes
+// messages left in its outbox. Must be called with the write lock held
+func (s *Service) stopSession(session *Session, frame *CloseFrame) {
+	session.stop <- struct{}{}
+	close(session.stop)
+	if frame != nil {
+		session.closed <- *frame
+	}
+
+	delete(s.sessions[session.DeviceID], session.ID)
+
+	<-session.pumped
+	s.reroute(session, session.outbox.close())
+}
+
+// reroute passes messages of the stopped session to the session of the device registered
+// after the message has been sent or keeps them in the mailbox if the device is gone.
+// Must be called with the write lock held
+func (s *Service) reroute(session *Session, items []queued) {
+	for _, item := range items {
+		s.rerouteOne(session, item)
+	}
+}
+
+// rerouteOne reroutes the message of the stopped session. Must be called with the write
+// lock held
+func (s *Service) rerouteOne(session *Session, item queued) Outcome {
+	id := session.DeviceID
+
+	if !s.connected(id) {
+		if err := s.enqueue(session.Tenant, id, item.message); err != nil {
+			s.expire(id, []Message{item.message})
+			return OutcomeNotFound
+		}
+
+		return OutcomeQueued
+	}
+
+	next := s.newerSession(id, item.seq)
+	if next == nil {
+		// other sessions of the device have got the message themselves
+		return OutcomeAccepted
+	}
+
+	// the message keeps the deadline it has got from the closed session
+	dropped, err := next.outbox.push(queued{item.message, next.seq, item.deadline})
+	if dropped != nil {
+		s.expire(id, []Message{dropped.message})
+	}
+	if err != nil {
+		s.expire(id, []Message{item.message})
+		return OutcomeDropped
+	}
+
+	return OutcomeAccepted
+}
+
+// deviceSessions returns sessions of the device. Must be called with the lock held
+func (s *Service) deviceSessions(id uuid.UUID) []*Session {
+	sessions := make([]*Session, 0, len(s.sessions[id]))
+	for _, session := range s.sessions[id] {
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// unregister forgets the device that has no sessions left. Must be called with the write
+// lock held
+func (s *Service) unregister(tenant string, id uuid.UUID) {
+	delete(s.sessions, id)
+
+	reg := s.registry(tenant)
+	delete(reg.devices, id)
+	s.unsubscribeAll(reg, id)
+	s.pruneRegistry(tenant)
+}
+
+// connected reports whether the device has a local session. Must be called with the lock held
+func (s *Service) connected(id uuid.UUID) bool {
+	return len(s.sessions[id]) > 0
+}
+
+// newerSession returns the latest session of the device registered after seq or nil.
+// Must be called with the lock held
+func (s *Service) newerSession(id uuid.UUID, seq uint64) *Session {
+	var newer *Session
+	for _, session := range s.sessions[id] {
+		if session.seq > seq && (newer == nil || session.seq > newer.seq) {
+			newer = session
+		}
+	}
+
+	return newer
+}
+
+// takeOver closes sessions of the device of the tenant on the instances it is connected to
+// and claims the device once that instance releases it
+func (s *Service) takeOver(ctx context.Context, tenant string, id uuid.UUID) error {
+	nodes, err := s.remoteNodes(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes[id] {
+		if err := s.cluster.Publish(ctx, node, ClusterEvent{
+			Kind:     ClusterEventDisconnect,
+			Origin:   s.cluster.NodeID(),
+			Tenant:   tenant,
+			DeviceID: &id,
+			Close:    &replacedFrame,
+			Reason:   DisconnectReplaced,
+		}); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, takeOverTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(takeOverPoll)
+	defer ticker.Stop()
+
+	for {
+		err := s.cluster.Claim(ctx, id, true)
+		if err != errors.ErrDeviceAlreadyRegistered {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return errors.ErrDeviceAlreadyRegistered
+		}
+	}
+}
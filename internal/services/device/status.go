@@ -0,0 +1,237 @@
+package device
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+	"tokeon-test-task/internal/errors"
+
+	"github.com/google/uuid"
+)
+
+type DeliveryState string
+
+const (
+	// DeliveryPending - message waits in the mailbox or for the device to read it
+	DeliveryPending DeliveryState = "pending"
+	// DeliveryDelivered - message has been written to the device connection
+	DeliveryDelivered DeliveryState = "delivered"
+	// DeliveryAcked - device has confirmed the message
+	DeliveryAcked DeliveryState = "acked"
+	// DeliveryExpired - message has not reached the device in time
+	DeliveryExpired DeliveryState = "expired"
+)
+
+// rank is used to prevent status going backwards, e.g. acked -> delivered. Expired is
+// below delivered, so the message written to the connection is never reported as expired
+func (s DeliveryState) rank() int {
+	switch s {
+	case DeliveryExpired:
+		return 1
+	case DeliveryDelivered:
+		return 2
+	case DeliveryAcked:
+		return 3
+	default:
+		return 0
+	}
+}
+
+type DeliveryStatus struct {
+	DeviceID  uuid.UUID
+	State     DeliveryState
+	UpdatedAt time.Time
+}
+
+type MessageStatus struct {
+	ID         uuid.UUID
+	CreatedAt  time.Time
+	Deliveries []DeliveryStatus
+}
+
+type trackedMessage struct {
+	createdAt time.Time
+	// tenant - tenant of the sender, the status isn't shown to other tenants
+	tenant string
+	// origin - cluster node that accepted the message, empty for the current one
+	origin     string
+	deliveries map[uuid.UUID]*DeliveryStatus
+}
+
+// tracker keeps delivery status of the sent messages for the ttl
+type tracker struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	messages map[uuid.UUID]*trackedMessage
+	// order - ids of the messages in the order they were tracked, the oldest go first
+	order []uuid.UUID
+}
+
+func newTracker(ttl time.Duration) *tracker {
+	return &tracker{
+		ttl:      ttl,
+		messages: make(map[uuid.UUID]*trackedMessage),
+	}
+}
+
+// start forgets expired messages every half of the ttl until ctx is done, so they are
+// not kept when nothing is sent
+func (t *tracker) start(ctx context.Context) {
+	if t.ttl == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(t.ttl / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				t.mu.Lock()
+				t.sweep(now)
+				t.mu.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (t *tracker) track(msg Message, targets []uuid.UUID, origin string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(time.Now())
+
+	deliveries := make(map[uuid.UUID]*DeliveryStatus, len(targets))
+	for _, id := range targets {
+		deliveries[id] = &DeliveryStatus{
+			DeviceID:  id,
+			State:     DeliveryPending,
+			UpdatedAt: msg.CreatedAt,
+		}
+	}
+
+	t.messages[msg.ID] = &trackedMessage{
+		createdAt:  msg.CreatedAt,
+		tenant:     msg.Target.Tenant,
+		origin:     origin,
+		deliveries: deliveries,
+	}
+	if t.ttl > 0 {
+		t.order = append(t.order, msg.ID)
+	}
+}
+
+// update changes delivery status of the message. Returns origin and tenant of the
+// message and whether the status has changed
+func (t *tracker) update(messageID, deviceID uuid.UUID, state DeliveryState) (string, string, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	msg, ok := t.messages[messageID]
+	if !ok {
+		return "", "", false, errors.ErrMessageNotFound
+	}
+
+	delivery, ok := msg.deliveries[deviceID]
+	if !ok {
+		return "", "", false, errors.ErrMessageNotFound
+	}
+
+	if state.rank() <= delivery.State.rank() {
+		return msg.origin, msg.tenant, false, nil
+	}
+
+	delivery.State = state
+	delivery.UpdatedAt = time.Now()
+
+	return msg.origin, msg.tenant, true, nil
+}
+
+// upsert changes delivery status of the message adding the device if it is not
+// among the targets yet, e.g. broadcast has reached a device of another cluster node
+func (t *tracker) upsert(messageID, deviceID uuid.UUID, state DeliveryState) (string, bool, error) {
+	t.mu.Lock()
+	msg, ok := t.messages[messageID]
+	added := false
+	if ok {
+		if _, ok := msg.deliveries[deviceID]; !ok {
+			msg.deliveries[deviceID] = &DeliveryStatus{
+				DeviceID:  deviceID,
+				State:     DeliveryPending,
+				UpdatedAt: time.Now(),
+			}
+			added = true
+		}
+	}
+	t.mu.Unlock()
+
+	origin, _, changed, err := t.update(messageID, deviceID, state)
+
+	return origin, changed || added, err
+}
+
+// delivered reports whether the message has been written to the device or acked by it
+func (t *tracker) delivered(messageID, deviceID uuid.UUID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	msg, ok := t.messages[messageID]
+	if !ok {
+		return false
+	}
+
+	delivery, ok := msg.deliveries[deviceID]
+
+	return ok && (delivery.State == DeliveryDelivered || delivery.State == DeliveryAcked)
+}
+
+func (t *tracker) get(tenant string, messageID uuid.UUID) (MessageStatus, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(time.Now())
+
+	msg, ok := t.messages[messageID]
+	if !ok || msg.tenant != tenant {
+		return MessageStatus{}, errors.ErrMessageNotFound
+	}
+
+	deliveries := make([]DeliveryStatus, 0, len(msg.deliveries))
+	for _, delivery := range msg.deliveries {
+		deliveries = append(deliveries, *delivery)
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].DeviceID.String() < deliveries[j].DeviceID.String()
+	})
+
+	return MessageStatus{
+		ID:         messageID,
+		CreatedAt:  msg.createdAt,
+		Deliveries: deliveries,
+	}, nil
+}
+
+// sweep forgets messages older than ttl, only the expired ones are visited. Must be
+// called with the lock held
+func (t *tracker) sweep(now time.Time) {
+	if t.ttl == 0 {
+		return
+	}
+
+	expired := 0
+	for _, id := range t.order {
+		msg, ok := t.messages[id]
+		if ok && now.Sub(msg.createdAt) <= t.ttl {
+			break
+		}
+		delete(t.messages, id)
+		expired++
+	}
+
+	t.order = t.order[expired:]
+}
@@ -0,0 +1,112 @@
+package device
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// registry keeps devices of the tenant and everything kept for them. Device ids are
+// unique across the tenants, the device is connected to one tenant at a time
+type registry struct {
+	// devices - connected devices, their sessions are in sessions of the service
+	devices map[uuid.UUID]struct{}
+	// topics - subscribers of every topic, deviceTopics - topics of every device
+	topics       map[string]map[uuid.UUID]struct{}
+	deviceTopics map[uuid.UUID]map[string]struct{}
+	mailboxes    map[uuid.UUID]*mailbox
+	// bans - devices that may not connect until the time
+	bans map[uuid.UUID]time.Time
+}
+
+func newRegistry() *registry {
+	return &registry{
+		devices:      make(map[uuid.UUID]struct{}),
+		topics:       make(map[string]map[uuid.UUID]struct{}),
+		deviceTopics: make(map[uuid.UUID]map[string]struct{}),
+		mailboxes:    make(map[uuid.UUID]*mailbox),
+		bans:         make(map[uuid.UUID]time.Time),
+	}
+}
+
+// empty reports whether the registry keeps nothing
+func (r *registry) empty() bool {
+	return len(r.devices) == 0 && len(r.topics) == 0 && len(r.mailboxes) == 0 && len(r.bans) == 0
+}
+
+// banned reports whether the device may not connect
+func (r *registry) banned(id uuid.UUID) bool {
+	until, ok := r.bans[id]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(until) {
+		delete(r.bans, id)
+		return false
+	}
+
+	return true
+}
+
+// registry returns registry of the tenant, empty one if the tenant has none. Must be
+// called with the lock held, the returned registry must not be changed
+func (s *Service) registry(tenant string) *registry {
+	if reg, ok := s.tenants[tenant]; ok {
+		return reg
+	}
+
+	return &registry{}
+}
+
+// openRegistry returns registry of the tenant creating it. Must be called with the write
+// lock held
+func (s *Service) openRegistry(tenant string) *registry {
+	reg, ok := s.tenants[tenant]
+	if !ok {
+		reg = newRegistry()
+		s.tenants[tenant] = reg
+	}
+
+	return reg
+}
+
+// pruneBans forgets the bans that are over by now
+func (r *registry) pruneBans(now time.Time) {
+	for id, until := range r.bans {
+		if now.After(until) {
+			delete(r.bans, id)
+		}
+	}
+}
+
+// pruneRegistry drops expired bans of the tenant and its registry if it keeps nothing
+// then. Must be called with the write lock held
+func (s *Service) pruneRegistry(tenant string) {
+	reg, ok := s.tenants[tenant]
+	if !ok {
+		return
+	}
+
+	reg.pruneBans(time.Now())
+	if reg.empty() {
+		delete(s.tenants, tenant)
+	}
+}
+
+// tenantOf returns tenant the device is connected to. Must be called with the lock held
+func (s *Service) tenantOf(id uuid.UUID) (string, bool) {
+	for _, session := range s.sessions[id] {
+		return session.Tenant, true
+	}
+
+	return "", false
+}
+
+// connectedTo reports whether the device has a local session in the tenant. Must be
+// called with the lock held
+func (s *Service) connectedTo(tenant string, id uuid.UUID) bool {
+	_, ok := s.registry(tenant).devices[id]
+
+	return ok
+}
@@ -0,0 +1,76 @@
+package device
+
+import (
+	"tokeon-test-task/internal/errors"
+
+	"github.com/google/uuid"
+)
+
+// Subscribe adds the connected device to subscribers of the topic of its tenant. The
+// subscription is shared by all sessions of the device and kept until the last one is closed
+func (s *Service) Subscribe(id uuid.UUID, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant, ok := s.tenantOf(id)
+	if !ok {
+		return errors.ErrDeviceNotFound
+	}
+
+	reg := s.openRegistry(tenant)
+
+	subscribers, ok := reg.topics[topic]
+	if !ok {
+		subscribers = make(map[uuid.UUID]struct{})
+		reg.topics[topic] = subscribers
+	}
+	subscribers[id] = struct{}{}
+
+	topics, ok := reg.deviceTopics[id]
+	if !ok {
+		topics = make(map[string]struct{})
+		reg.deviceTopics[id] = topics
+	}
+	topics[topic] = struct{}{}
+
+	return nil
+}
+
+// Unsubscribe removes the device from subscribers of the topic for all its sessions
+func (s *Service) Unsubscribe(id uuid.UUID, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant, ok := s.tenantOf(id)
+	if !ok {
+		return errors.ErrDeviceNotFound
+	}
+
+	s.unsubscribe(s.registry(tenant), id, topic)
+
+	return nil
+}
+
+// unsubscribe must be called with the write lock held
+func (s *Service) unsubscribe(reg *registry, id uuid.UUID, topic string) {
+	if subscribers, ok := reg.topics[topic]; ok {
+		delete(subscribers, id)
+		if len(subscribers) == 0 {
+			delete(reg.topics, topic)
+		}
+	}
+
+	if topics, ok := reg.deviceTopics[id]; ok {
+		delete(topics, topic)
+		if len(topics) == 0 {
+			delete(reg.deviceTopics, id)
+		}
+	}
+}
+
+// unsubscribeAll removes the device from all topics. Must be called with the write lock held
+func (s *Service) unsubscribeAll(reg *registry, id uuid.UUID) {
+	for topic := range reg.deviceTopics[id] {
+		s.unsubscribe(reg, id, topic)
+	}
+}
@@ -0,0 +1,62 @@
+package events
+
+import (
+	"context"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+	"tokeon-test-task/pkg/webhook"
+
+	"github.com/goccy/go-json"
+)
+
+// Webhooks posts events of the device service to the configured webhooks
+type Webhooks struct {
+	logger   log.Logger
+	webhooks *webhook.Dispatcher
+	// types - events that are posted, all if empty
+	types map[device.EventType]struct{}
+}
+
+func New(logger log.Logger, cfg config.EventsConfig) *Webhooks {
+	types := make(map[device.EventType]struct{}, len(cfg.Types))
+	for _, t := range cfg.Types {
+		types[device.EventType(t)] = struct{}{}
+	}
+
+	return &Webhooks{
+		logger:   logger,
+		webhooks: webhook.New(logger, cfg.Webhook()),
+		types:    types,
+	}
+}
+
+func (w *Webhooks) Enabled() bool {
+	return w.webhooks.Enabled()
+}
+
+// Start posts the events until ctx is done
+func (w *Webhooks) Start(ctx context.Context) {
+	w.webhooks.Start(ctx)
+}
+
+// HandleEvent queues the event, it never blocks
+func (w *Webhooks) HandleEvent(event device.Event) {
+	if len(w.types) > 0 {
+		if _, ok := w.types[event.Type]; !ok {
+			return
+		}
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		w.logger.Errorf("failed to encode event %s: %v", event.Type, err)
+		return
+	}
+
+	w.webhooks.Post(webhook.Request{
+		ID:    event.ID.String(),
+		Event: string(event.Type),
+		Body:  body,
+	})
+}
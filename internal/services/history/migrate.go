@@ -0,0 +1,117 @@
+package history
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationsLockID - key of the advisory lock, so replicas don't migrate concurrently
+const migrationsLockID = 7_241_001
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Migrate applies migrations that have not been applied yet. Migration files are
+// named <version>_<name>.sql and applied in order of versions. Rows of the existing
+// messages are backfilled with the default tenant, migrations read it from
+// app.default_tenant setting
+func Migrate(ctx context.Context, pool *pgxpool.Pool, defaultTenant string) error {
+	list, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationsLockID); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationsLockID)
+
+	if _, err := conn.Exec(ctx, "SELECT set_config('app.default_tenant', $1, false)", defaultTenant); err != nil {
+		return fmt.Errorf("failed to set default tenant: %w", err)
+	}
+
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		name       text        NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var current int
+	if err := conn.QueryRow(ctx, "SELECT coalesce(max(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	for _, m := range list {
+		if m.version <= current {
+			continue
+		}
+
+		if err := conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, m.sql); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to apply migration %d_%s: %w", m.version, m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("wrong migration name: %s", entry.Name())
+		}
+
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("wrong migration version: %s", entry.Name())
+		}
+
+		sql, err := migrations.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, migration{v, name, string(sql)})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].version < list[j].version
+	})
+
+	return list, nil
+}
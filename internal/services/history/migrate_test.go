@@ -0,0 +1,21 @@
+package history
+
+import "testing"
+
+// Test embedded migrations have valid names and unique versions
+func TestLoadMigrations(t *testing.T) {
+	list, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) == 0 {
+		t.Fatal("no migrations found")
+	}
+
+	for i := 1; i < len(list); i++ {
+		if list[i].version == list[i-1].version {
+			t.Errorf("duplicated migration version %d", list[i].version)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+CREATE TABLE messages (
+    id         uuid PRIMARY KEY,
+    -- target device, NULL for broadcasts
+    device_id  uuid,
+    text       text        NOT NULL,
+    created_at timestamptz NOT NULL
+);
+
+CREATE INDEX messages_created_at_idx ON messages (created_at DESC);
+CREATE INDEX messages_device_id_idx ON messages (device_id, created_at DESC);
+
+CREATE TABLE message_deliveries (
+    message_id uuid        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    device_id  uuid        NOT NULL,
+    state      text        NOT NULL,
+    updated_at timestamptz NOT NULL,
+    PRIMARY KEY (message_id, device_id)
+);
+
+CREATE INDEX message_deliveries_device_id_idx ON message_deliveries (device_id);
@@ -0,0 +1,2 @@
+-- topic the message was published to, NULL for direct messages and broadcasts
+ALTER TABLE messages ADD COLUMN topic text;
@@ -0,0 +1,5 @@
+ALTER TABLE messages
+    ADD COLUMN type    text,
+    ADD COLUMN sender  text,
+    ADD COLUMN headers jsonb,
+    ADD COLUMN payload jsonb;
@@ -0,0 +1,3 @@
+-- binary data is not kept in the history, only its size
+ALTER TABLE messages
+    ADD COLUMN binary_size integer;
@@ -0,0 +1,2 @@
+ALTER TABLE messages
+    ADD COLUMN expires_at timestamptz;
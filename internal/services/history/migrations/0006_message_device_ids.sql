@@ -0,0 +1,3 @@
+ALTER TABLE messages
+    ADD COLUMN device_ids uuid[],
+    ADD COLUMN exclude_device_ids uuid[];
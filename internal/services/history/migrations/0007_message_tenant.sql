@@ -0,0 +1,11 @@
+-- tenant of the sender, messages sent before tenants belong to the default one that is
+-- passed by the service in app.default_tenant setting
+ALTER TABLE messages
+    ADD COLUMN tenant text;
+
+UPDATE messages SET tenant = current_setting('app.default_tenant');
+
+ALTER TABLE messages
+    ALTER COLUMN tenant SET NOT NULL;
+
+CREATE INDEX messages_tenant_idx ON messages (tenant, created_at DESC);
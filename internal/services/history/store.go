@@ -0,0 +1,356 @@
+package history
+
+import (
+	"context"
+	e "errors"
+	"fmt"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+	"tokeon-test-task/pkg/utils"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// batchSize - max amount of delivery updates written at once
+const batchSize = 500
+
+type Record struct {
+	ID uuid.UUID
+	// DeviceID - target device, nil for broadcasts
+	DeviceID *uuid.UUID
+	// DeviceIDs - target devices of the message sent to many devices
+	DeviceIDs []uuid.UUID
+	// ExcludeDeviceIDs - devices excluded from the broadcast
+	ExcludeDeviceIDs []uuid.UUID
+	// Topic - target topic, empty for direct messages and broadcasts
+	Topic   string
+	Type    string
+	Sender  string
+	Headers map[string]string
+	Text    string
+	Payload json.RawMessage
+	// BinarySize - size of the binary data, nil if the message is not binary
+	BinarySize *int
+	CreatedAt  time.Time
+	// ExpiresAt - nil if the message has no ttl
+	ExpiresAt  *time.Time
+	Deliveries []device.DeliveryStatus
+}
+
+// batchSender runs the batch of queries, it is the pool of the store
+type batchSender interface {
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+type stateUpdate struct {
+	messageID uuid.UUID
+	deviceID  uuid.UUID
+	state     device.DeliveryState
+	at        time.Time
+}
+
+// Store keeps sent messages and their delivery outcome in postgres
+type Store struct {
+	logger  log.Logger
+	pool    *pgxpool.Pool
+	updates chan stateUpdate
+}
+
+// New connects to postgres and applies migrations, messages saved before the tenants are
+// moved to defaultTenant. History is disabled if dsn is empty
+func New(ctx context.Context, logger log.Logger, cfg config.PostgresConfig, defaultTenant string) (*Store, error) {
+	s := &Store{
+		logger: logger,
+	}
+
+	if cfg.DSN == "" {
+		return s, nil
+	}
+
+	pool, err := pgxpool.Connect(ctx, cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	if err := Migrate(ctx, pool, defaultTenant); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to migrate: %w", err)
+	}
+
+	s.pool = pool
+	s.updates = make(chan stateUpdate, cfg.HistoryBuffer)
+
+	return s, nil
+}
+
+func (s *Store) Enabled() bool {
+	return s.pool != nil
+}
+
+// Start writes delivery updates until ctx is done
+func (s *Store) Start(ctx context.Context) {
+	if !s.Enabled() {
+		return
+	}
+
+	go func() {
+		defer s.pool.Close()
+
+		for {
+			select {
+			case update := <-s.updates:
+				s.write(ctx, s.pool, s.batch(update))
+			case <-ctx.Done():
+				// flush what is left before exit
+				flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				for {
+					select {
+					case update := <-s.updates:
+						s.write(flushCtx, s.pool, s.batch(update))
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (s *Store) SaveMessage(ctx context.Context, msg device.Message, target device.Target) error {
+	var topic *string
+	if target.Topic != "" {
+		topic = &target.Topic
+	}
+
+	var headers []byte
+	if len(msg.Headers) > 0 {
+		var err error
+		if headers, err = json.Marshal(msg.Headers); err != nil {
+			return err
+		}
+	}
+
+	var payload []byte
+	if len(msg.Payload) > 0 {
+		payload = msg.Payload
+	}
+
+	var binarySize *int
+	if msg.Binary != nil {
+		size := len(msg.Binary)
+		binarySize = &size
+	}
+
+	var expiresAt *time.Time
+	if !msg.ExpiresAt.IsZero() {
+		expiresAt = &msg.ExpiresAt
+	}
+
+	if _, err := s.pool.Exec(
+		ctx,
+		"INSERT INTO messages (id, device_id, topic, type, sender, headers, text, payload, binary_size, created_at, expires_at, "+
+			"device_ids, exclude_device_ids, tenant) "+
+			"VALUES ($1, $2, $3, nullif($4, ''), nullif($5, ''), $6::jsonb, $7, $8::jsonb, $9, $10, $11, $12::uuid[], $13::uuid[], $14)",
+		msg.ID, target.DeviceID, topic, msg.Type, msg.Sender, headers, msg.Text, payload, binarySize, msg.CreatedAt, expiresAt,
+		uuidStrings(target.DeviceIDs), uuidStrings(target.Exclude), target.Tenant,
+	); err != nil {
+		return fmt.Errorf("failed to save message: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) SaveState(messageID, deviceID uuid.UUID, state device.DeliveryState, at time.Time) {
+	select {
+	case s.updates <- stateUpdate{messageID, deviceID, state, at}:
+	default:
+		s.logger.Errorf("history buffer is full, status %s of message %s for device %s is lost", state, messageID, deviceID)
+	}
+}
+
+// List returns page of the messages sent in the tenant from the newest to the oldest and
+// total amount of messages. If deviceID is set, only messages sent to the device are returned
+func (s *Store) List(ctx context.Context, tenant string, deviceID *uuid.UUID, page, pageSize uint64) ([]Record, int64, error) {
+	if !s.Enabled() {
+		return nil, 0, errors.ErrHistoryDisabled
+	}
+
+	filter := "m.tenant = $2 AND ($1::uuid IS NULL OR m.device_id = $1 OR EXISTS (" +
+		"SELECT 1 FROM message_deliveries d WHERE d.message_id = m.id AND d.device_id = $1))"
+
+	var count int64
+	if err := s.pool.QueryRow(ctx, "SELECT count(*) FROM messages m WHERE "+filter, deviceID, tenant).Scan(&count); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.pool.Query(
+		ctx,
+		"SELECT m.id, m.device_id, coalesce(m.topic, ''), coalesce(m.type, ''), coalesce(m.sender, ''), "+
+			"m.headers, m.text, m.payload, m.binary_size, m.created_at, m.expires_at, "+
+			"m.device_ids::text[], m.exclude_device_ids::text[] FROM messages m WHERE "+filter+
+			" ORDER BY m.created_at DESC, m.id LIMIT $3 OFFSET $4",
+		deviceID, tenant, pageSize, (page-1)*pageSize,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	records := make([]Record, 0, pageSize)
+	index := make(map[uuid.UUID]int, pageSize)
+	ids := make([]string, 0, pageSize)
+
+	for rows.Next() {
+		var (
+			record    Record
+			headers   []byte
+			payload   []byte
+			deviceIDs []string
+			excluded  []string
+		)
+		if err := rows.Scan(
+			&record.ID, &record.DeviceID, &record.Topic, &record.Type, &record.Sender,
+			&headers, &record.Text, &payload, &record.BinarySize, &record.CreatedAt, &record.ExpiresAt,
+			&deviceIDs, &excluded,
+		); err != nil {
+			return nil, 0, err
+		}
+
+		if record.DeviceIDs, err = parseUUIDs(deviceIDs); err != nil {
+			return nil, 0, err
+		}
+		if record.ExcludeDeviceIDs, err = parseUUIDs(excluded); err != nil {
+			return nil, 0, err
+		}
+
+		if len(headers) > 0 {
+			if err := json.Unmarshal(headers, &record.Headers); err != nil {
+				return nil, 0, err
+			}
+		}
+		if len(payload) > 0 {
+			record.Payload = payload
+		}
+
+		record.Deliveries = []device.DeliveryStatus{}
+		index[record.ID] = len(records)
+		ids = append(ids, record.ID.String())
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err = s.pool.Query(
+		ctx,
+		"SELECT message_id, device_id, state, updated_at FROM message_deliveries "+
+			"WHERE message_id = ANY($1::uuid[]) AND ($2::uuid IS NULL OR device_id = $2) ORDER BY device_id",
+		ids, deviceID,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID uuid.UUID
+			delivery  device.DeliveryStatus
+		)
+		if err := rows.Scan(&messageID, &delivery.DeviceID, &delivery.State, &delivery.UpdatedAt); err != nil {
+			return nil, 0, err
+		}
+
+		i := index[messageID]
+		records[i].Deliveries = append(records[i].Deliveries, delivery)
+	}
+
+	return records, count, rows.Err()
+}
+
+// batch collects the updates that are waiting in the buffer
+func (s *Store) batch(first stateUpdate) []stateUpdate {
+	updates := []stateUpdate{first}
+
+	for len(updates) < batchSize {
+		select {
+		case update := <-s.updates:
+			updates = append(updates, update)
+		default:
+			return updates
+		}
+	}
+
+	return updates
+}
+
+// write saves the updates in one batch. The batch is run in one transaction, so the update
+// failed by postgres is logged and skipped and the rest are written again
+func (s *Store) write(ctx context.Context, db batchSender, updates []stateUpdate) {
+	for len(updates) > 0 {
+		failed, err := send(ctx, db, updates)
+		if err == nil {
+			return
+		}
+
+		var pgErr *pgconn.PgError
+		if failed < 0 || !e.As(err, &pgErr) {
+			s.logger.Errorf("failed to save %d delivery updates: %v", len(updates), err)
+			return
+		}
+
+		u := updates[failed]
+		s.logger.Errorf("failed to save status %s of message %s for device %s: %v", u.state, u.messageID, u.deviceID, err)
+
+		updates = append(updates[:failed:failed], updates[failed+1:]...)
+	}
+}
+
+// send writes the updates in the batch, index of the failed update is returned with the error
+func send(ctx context.Context, db batchSender, updates []stateUpdate) (int, error) {
+	batch := &pgx.Batch{}
+	for _, u := range updates {
+		batch.Queue(
+			"INSERT INTO message_deliveries (message_id, device_id, state, updated_at) VALUES ($1, $2, $3, $4) "+
+				"ON CONFLICT (message_id, device_id) DO UPDATE SET state = EXCLUDED.state, updated_at = EXCLUDED.updated_at",
+			u.messageID, u.deviceID, string(u.state), u.at,
+		)
+	}
+
+	results := db.SendBatch(ctx, batch)
+	for i := range updates {
+		if _, err := results.Exec(); err != nil {
+			results.Close()
+			return i, err
+		}
+	}
+
+	return -1, results.Close()
+}
+
+// uuidStrings returns text of the ids, nil if there are none
+func uuidStrings(ids []uuid.UUID) []string {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return utils.Map(ids, uuid.UUID.String)
+}
+
+func parseUUIDs(values []string) ([]uuid.UUID, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	return utils.MapWithError(values, uuid.Parse)
+}
@@ -0,0 +1,219 @@
+package history
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// newTestStore migrates the schema of its own in the postgres from HISTORY_POSTGRES_DSN.
+// The test is skipped if the dsn is not set
+func newTestStore(t *testing.T, ctx context.Context) *Store {
+	t.Helper()
+
+	dsn := os.Getenv("HISTORY_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("HISTORY_POSTGRES_DSN is not set")
+	}
+
+	schema := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema
+
+	pool, err := pgxpool.ConnectConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pool.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		pool.Close()
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if _, err := pool.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Error(err)
+		}
+		pool.Close()
+	})
+
+	if err := Migrate(ctx, pool, "default"); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Store{logger: log.New(), pool: pool, updates: make(chan stateUpdate, 16)}
+}
+
+// batches fails the statement of the batch at the index by the call, statements after the
+// failed one are aborted like in postgres. All statements fail with err if it is set
+type batches struct {
+	fail  map[int]int
+	err   error
+	sizes []int
+}
+
+func (b *batches) SendBatch(_ context.Context, batch *pgx.Batch) pgx.BatchResults {
+	failed, ok := b.fail[len(b.sizes)]
+	if !ok {
+		failed = -1
+	}
+	b.sizes = append(b.sizes, batch.Len())
+
+	return &batchResults{failed: failed, err: b.err}
+}
+
+type batchResults struct {
+	pgx.BatchResults
+	failed int
+	err    error
+	next   int
+}
+
+func (r *batchResults) Exec() (pgconn.CommandTag, error) {
+	i := r.next
+	r.next++
+
+	switch {
+	case r.err != nil:
+		return nil, r.err
+	case r.failed < 0 || i < r.failed:
+		return pgconn.CommandTag("INSERT 0 1"), nil
+	case i == r.failed:
+		return nil, &pgconn.PgError{Code: "23503", Message: "foreign key violation"}
+	default:
+		return nil, &pgconn.PgError{Code: "25P02", Message: "current transaction is aborted"}
+	}
+}
+
+func (r *batchResults) Close() error {
+	return nil
+}
+
+// Test only the failed update is skipped and the rest of the batch is written again
+func TestStoreWriteFailed(t *testing.T) {
+	s := &Store{logger: log.New()}
+
+	updates := make([]stateUpdate, 4)
+	for i := range updates {
+		updates[i] = stateUpdate{uuid.New(), uuid.New(), device.DeliveryDelivered, time.Now()}
+	}
+
+	db := &batches{fail: map[int]int{0: 1, 1: 2}}
+	s.write(context.Background(), db, updates)
+
+	if len(db.sizes) != 3 || db.sizes[0] != 4 || db.sizes[1] != 3 || db.sizes[2] != 2 {
+		t.Errorf("failed updates must be skipped one by one: %v", db.sizes)
+	}
+
+	// the batch is not written again when the connection fails
+	db = &batches{err: context.DeadlineExceeded}
+	s.write(context.Background(), db, updates)
+
+	if len(db.sizes) != 1 {
+		t.Errorf("batch must be written once: %v", db.sizes)
+	}
+}
+
+// Test messages are saved with their deliveries and listed by pages of the tenant
+func TestStoreList(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t, ctx)
+
+	id, other := uuid.New(), uuid.New()
+	start := time.Now().Truncate(time.Millisecond)
+
+	messages := []struct {
+		msg    device.Message
+		target device.Target
+	}{
+		{
+			device.Message{ID: uuid.New(), CreatedAt: start, Content: device.Content{Text: "direct", Type: "note", Headers: map[string]string{"k": "v"}}},
+			device.Target{Tenant: "shop", DeviceID: &id},
+		},
+		{
+			device.Message{ID: uuid.New(), CreatedAt: start.Add(time.Second), Content: device.Content{Payload: []byte(`{"a":1}`), Binary: []byte{1, 2}}},
+			device.Target{Tenant: "shop", Topic: "news", Exclude: []uuid.UUID{other}},
+		},
+		{
+			device.Message{ID: uuid.New(), CreatedAt: start.Add(2 * time.Second), ExpiresAt: start.Add(time.Hour)},
+			device.Target{Tenant: "shop", DeviceIDs: []uuid.UUID{id, other}},
+		},
+		{
+			device.Message{ID: uuid.New(), CreatedAt: start.Add(3 * time.Second), Content: device.Content{Text: "bank"}},
+			device.Target{Tenant: "bank", DeviceID: &id},
+		},
+	}
+
+	for _, m := range messages {
+		if err := s.SaveMessage(ctx, m.msg, m.target); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.write(ctx, s.pool, []stateUpdate{
+		{messages[0].msg.ID, id, device.DeliveryAcked, start},
+		{messages[1].msg.ID, id, device.DeliveryDelivered, start},
+		// the update of the unknown message fails, the ones after it are saved anyway
+		{uuid.New(), id, device.DeliveryDelivered, start},
+		{messages[1].msg.ID, other, device.DeliveryPending, start},
+		{messages[2].msg.ID, other, device.DeliveryExpired, start},
+	})
+
+	records, count, err := s.List(ctx, "shop", nil, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || len(records) != 2 || records[0].ID != messages[2].msg.ID || records[1].ID != messages[1].msg.ID {
+		t.Fatalf("wrong first page: %+v, count %d", records, count)
+	}
+
+	if r := records[0]; len(r.DeviceIDs) != 2 || r.ExpiresAt == nil || len(r.Deliveries) != 1 || r.Deliveries[0].State != device.DeliveryExpired {
+		t.Errorf("wrong message to the devices: %+v", r)
+	}
+	if r := records[1]; r.Topic != "news" || len(r.ExcludeDeviceIDs) != 1 || r.BinarySize == nil || *r.BinarySize != 2 || len(r.Deliveries) != 2 {
+		t.Errorf("wrong topic message: %+v", r)
+	}
+
+	records, _, err = s.List(ctx, "shop", nil, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Text != "direct" || records[0].Type != "note" || records[0].Headers["k"] != "v" {
+		t.Errorf("wrong second page: %+v", records)
+	}
+
+	// the device gets the direct message and the ones it has deliveries of
+	records, count, err = s.List(ctx, "shop", &id, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || records[0].ID != messages[1].msg.ID || records[1].ID != messages[0].msg.ID {
+		t.Errorf("wrong messages of the device: %+v, count %d", records, count)
+	}
+	for _, r := range records {
+		if len(r.Deliveries) != 1 || r.Deliveries[0].DeviceID != id {
+			t.Errorf("only deliveries of the device must be listed: %+v", r.Deliveries)
+		}
+	}
+
+	records, count, err = s.List(ctx, "bank", nil, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || records[0].Text != "bank" {
+		t.Errorf("wrong messages of another tenant: %+v, count %d", records, count)
+	}
+}
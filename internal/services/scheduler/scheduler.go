@@ -0,0 +1,263 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/google/uuid"
+)
+
+// sweepInterval - how often finished items are checked for removal
+const sweepInterval = time.Minute
+
+type ItemState string
+
+const (
+	ItemPending ItemState = "pending"
+	ItemSent    ItemState = "sent"
+	ItemFailed  ItemState = "failed"
+)
+
+// Item is a message waiting to be sent at SendAt
+type Item struct {
+	ID        uuid.UUID      `json:"id"`
+	Target    device.Target  `json:"target"`
+	Content   device.Content `json:"content"`
+	SendAt    time.Time      `json:"send_at"`
+	CreatedAt time.Time      `json:"created_at"`
+	State     ItemState      `json:"state"`
+	// MessageID - id of the sent message to track its delivery status
+	MessageID *uuid.UUID `json:"message_id,omitempty"`
+	// Error - why the message has not been sent
+	Error string `json:"error,omitempty"`
+	// DoneAt - when the item has been sent or failed
+	DoneAt *time.Time `json:"done_at,omitempty"`
+}
+
+type Sender interface {
+	SendMessage(ctx context.Context, target device.Target, content device.Content) (uuid.UUID, error)
+}
+
+// Scheduler holds messages until they are due and hands them over to the sender.
+// Items are persisted to the local directory, so they survive a restart
+type Scheduler struct {
+	logger log.Logger
+	sender Sender
+	store  fileStore
+
+	// sendTimeout - how long the devices may take to accept the message without ttl
+	sendTimeout time.Duration
+	// retention - how long sent and failed items are available
+	retention time.Duration
+
+	mu    sync.Mutex
+	items map[uuid.UUID]*Item
+	// sending - pending items handed over to the sender right now
+	sending map[uuid.UUID]struct{}
+	wake    chan struct{}
+}
+
+// New loads items saved by the previous run
+func New(logger log.Logger, cfg *config.Config, sender Sender) (*Scheduler, error) {
+	s := &Scheduler{
+		logger:      logger,
+		sender:      sender,
+		store:       fileStore{cfg.Scheduler.StorePath},
+		sendTimeout: cfg.SendTimeout,
+		retention:   cfg.MessageStatusTTL,
+		items:       make(map[uuid.UUID]*Item),
+		sending:     make(map[uuid.UUID]struct{}),
+		wake:        make(chan struct{}, 1),
+	}
+
+	items, err := s.store.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range items {
+		// items saved before the tenants belong to the default tenant
+		if items[i].Target.Tenant == "" {
+			items[i].Target.Tenant = cfg.Tenant.Default
+			if err := s.store.save(items[i]); err != nil {
+				return nil, err
+			}
+		}
+
+		s.items[items[i].ID] = &items[i]
+	}
+
+	return s, nil
+}
+
+// Start sends due items until ctx is done. Items missed while the service was down
+// are sent at once
+func (s *Scheduler) Start(ctx context.Context) {
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-timer.C:
+			case <-s.wake:
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			timer.Reset(s.dispatch(ctx))
+		}
+	}()
+}
+
+// Schedule saves the message to be sent at sendAt
+func (s *Scheduler) Schedule(target device.Target, content device.Content, sendAt time.Time) (Item, error) {
+	item := &Item{
+		ID:        uuid.New(),
+		Target:    target,
+		Content:   content,
+		SendAt:    sendAt,
+		CreatedAt: time.Now(),
+		State:     ItemPending,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.store.save(*item); err != nil {
+		return Item{}, err
+	}
+	s.items[item.ID] = item
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return *item, nil
+}
+
+func (s *Scheduler) Get(id uuid.UUID) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[id]
+	if !ok {
+		return Item{}, errors.ErrScheduledNotFound
+	}
+
+	return *item, nil
+}
+
+// Cancel removes the item that has not been sent yet
+func (s *Scheduler) Cancel(id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[id]
+	if !ok {
+		return errors.ErrScheduledNotFound
+	}
+
+	if _, sending := s.sending[id]; sending || item.State != ItemPending {
+		return errors.ErrScheduledNotPending
+	}
+
+	if err := s.store.remove(id); err != nil {
+		return err
+	}
+	delete(s.items, id)
+
+	return nil
+}
+
+// dispatch starts sending of the due items, removes outdated finished items and
+// returns time until the next due item
+func (s *Scheduler) dispatch(ctx context.Context) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	wait := sweepInterval
+
+	for id, item := range s.items {
+		if item.State != ItemPending {
+			if now.Sub(*item.DoneAt) > s.retention {
+				if err := s.store.remove(id); err != nil {
+					s.logger.Errorf("failed to remove scheduled message %s: %v", id, err)
+					continue
+				}
+				delete(s.items, id)
+			}
+			continue
+		}
+
+		if _, ok := s.sending[id]; ok {
+			continue
+		}
+
+		if until := item.SendAt.Sub(now); until > 0 {
+			wait = min(wait, until)
+			continue
+		}
+
+		s.sending[id] = struct{}{}
+		go s.send(ctx, *item)
+	}
+
+	return wait
+}
+
+func (s *Scheduler) send(ctx context.Context, item Item) {
+	timeout := s.sendTimeout
+	if item.Content.TTL > 0 {
+		timeout = item.Content.TTL
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	messageID, err := s.sender.SendMessage(sendCtx, item.Target, item.Content)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sending, item.ID)
+
+	// service is stopping, the item is sent again after restart
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	stored, ok := s.items[item.ID]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	stored.DoneAt = &now
+
+	if err != nil {
+		s.logger.Warnf("failed to send scheduled message %s: %v", item.ID, err)
+		stored.State = ItemFailed
+		stored.Error = err.Error()
+	} else {
+		stored.State = ItemSent
+		stored.MessageID = &messageID
+	}
+
+	if err := s.store.save(*stored); err != nil {
+		s.logger.Errorf("failed to save scheduled message %s: %v", item.ID, err)
+	}
+}
@@ -0,0 +1,230 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/errors"
+	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/pkg/log"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+type senderFunc func(ctx context.Context, target device.Target, content device.Content) (uuid.UUID, error)
+
+func (f senderFunc) SendMessage(ctx context.Context, target device.Target, content device.Content) (uuid.UUID, error) {
+	return f(ctx, target, content)
+}
+
+// Test scheduled items are kept across restarts, sent when due and may be cancelled before
+func TestScheduler(t *testing.T) {
+	cfg := &config.Config{
+		SendTimeout:      time.Second,
+		MessageStatusTTL: time.Hour,
+		Scheduler:        config.SchedulerConfig{StorePath: filepath.Join(t.TempDir(), "scheduled")},
+	}
+
+	sent := make(chan string, 2)
+	messageID := uuid.New()
+	sender := senderFunc(func(ctx context.Context, target device.Target, content device.Content) (uuid.UUID, error) {
+		sent <- content.Text
+		return messageID, nil
+	})
+
+	s, err := New(log.New(), cfg, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	due, err := s.Schedule(device.Target{}, device.Content{Text: "due"}, time.Now().Add(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, err := s.Schedule(device.Target{}, device.Content{Text: "cancelled"}, time.Now().Add(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// items are loaded by the next run
+	s, err = New(log.New(), cfg, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Cancel(cancelled.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Start(ctx)
+
+	select {
+	case text := <-sent:
+		if text != "due" {
+			t.Errorf("wrong message has been sent: %s", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled message has not been sent")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		item, err := s.Get(due.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if item.State == ItemSent {
+			if *item.MessageID != messageID {
+				t.Errorf("wrong message id: %+v", item)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("item has not been marked sent: %+v", item)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.Cancel(due.ID); err != errors.ErrScheduledNotPending {
+		t.Errorf("sent item must not be cancelled, got: %v", err)
+	}
+
+	if _, err := s.Get(cancelled.ID); err != errors.ErrScheduledNotFound {
+		t.Errorf("cancelled item must be removed, got: %v", err)
+	}
+
+	select {
+	case text := <-sent:
+		t.Errorf("cancelled message has been sent: %s", text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Test every item is kept in its own file and the file of the previous versions is moved
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scheduled")
+
+	legacy := []Item{{ID: uuid.New(), State: ItemPending}, {ID: uuid.New(), State: ItemSent}}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store := fileStore{path}
+
+	items, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("wrong migrated items: %+v", items)
+	}
+	if _, err := os.Stat(path + ".old"); err != nil {
+		t.Errorf("file of the previous version must be kept: %v", err)
+	}
+
+	if err := store.remove(legacy[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	added := Item{ID: uuid.New(), State: ItemPending}
+	if err := store.save(added); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("every item must have one file: %v", entries)
+	}
+
+	items, err = store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[uuid.UUID]bool{}
+	for _, item := range items {
+		ids[item.ID] = true
+	}
+	if len(items) != 2 || !ids[legacy[1].ID] || !ids[added.ID] {
+		t.Errorf("wrong items: %+v", items)
+	}
+}
+
+// Test the default file of the previous versions is moved to the directory next to it
+func TestFileStoreDefaultFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scheduled")
+
+	data, err := json.Marshal([]Item{{ID: uuid.New(), State: ItemPending}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".json", data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if items, err := (fileStore{path}).load(); err != nil || len(items) != 1 {
+		t.Fatalf("wrong migrated items: %+v, %v", items, err)
+	}
+
+	if items, err := (fileStore{path}).load(); err != nil || len(items) != 1 {
+		t.Errorf("migrated items must be loaded from the directory: %+v, %v", items, err)
+	}
+}
+
+// Test items saved without the tenant are loaded into the default tenant
+func TestSchedulerDefaultTenant(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scheduled")
+	store := fileStore{path}
+
+	legacy := Item{ID: uuid.New(), State: ItemPending, SendAt: time.Now().Add(time.Hour)}
+	tenant := Item{ID: uuid.New(), Target: device.Target{Tenant: "shop"}, State: ItemPending, SendAt: time.Now().Add(time.Hour)}
+	for _, item := range []Item{legacy, tenant} {
+		if err := store.save(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{
+		Scheduler: config.SchedulerConfig{StorePath: path},
+		Tenant:    config.TenantConfig{Default: "default"},
+	}
+
+	s, err := New(log.New(), cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item, err := s.Get(legacy.ID); err != nil || item.Target.Tenant != "default" {
+		t.Errorf("item without tenant must belong to the default one: %+v, %v", item, err)
+	}
+	if item, err := s.Get(tenant.ID); err != nil || item.Target.Tenant != "shop" {
+		t.Errorf("tenant of the item must be kept: %+v, %v", item, err)
+	}
+
+	items, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if item.Target.Tenant == "" {
+			t.Errorf("default tenant must be saved: %+v", item)
+		}
+	}
+}
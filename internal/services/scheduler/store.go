@@ -0,0 +1,173 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// fileStore keeps every scheduled item in its own json file of the directory, so a change
+// of the item rewrites only its file. Empty path disables persistence
+type fileStore struct {
+	path string
+}
+
+func (f fileStore) load() ([]Item, error) {
+	if f.path == "" {
+		return nil, nil
+	}
+
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		// the default file of the previous versions is next to the directory
+		if _, err := os.Stat(f.path + ".json"); err == nil {
+			return f.migrate(f.path + ".json")
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return f.migrate(f.path)
+	}
+
+	entries, err := os.ReadDir(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, 0, len(entries))
+	for _, entry := range entries {
+		// files left by the interrupted save are ignored
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(f.path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var item Item
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", entry.Name(), err)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// migrate moves items of the single file kept by the previous versions to the directory.
+// The file is renamed with .old suffix
+func (f fileStore) migrate(file string) ([]Item, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []Item
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", file, err)
+	}
+
+	dir := fileStore{f.path + ".new"}
+	if err := os.RemoveAll(dir.path); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if err := dir.save(item); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.Rename(file, file+".old"); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(dir.path, f.path); err != nil {
+		return nil, err
+	}
+
+	return items, syncDir(filepath.Dir(f.path))
+}
+
+// save replaces the file of the item, so it is never left half written
+func (f fileStore) save(item Item) error {
+	if f.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(f.path, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.path, item.ID.String()+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), f.file(item.ID)); err != nil {
+		return err
+	}
+
+	return syncDir(f.path)
+}
+
+// remove deletes the file of the item
+func (f fileStore) remove(id uuid.UUID) error {
+	if f.path == "" {
+		return nil
+	}
+
+	if err := os.Remove(f.file(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return syncDir(f.path)
+}
+
+func (f fileStore) file(id uuid.UUID) string {
+	return filepath.Join(f.path, id.String()+".json")
+}
+
+// syncDir makes the renames and removals of the directory durable. File systems that
+// can't sync directories are skipped
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+
+	return nil
+}
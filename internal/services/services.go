@@ -1,21 +1,98 @@
 package services
 
 import (
+	"context"
+	"fmt"
 	"tokeon-test-task/internal/config"
+	"tokeon-test-task/internal/services/cluster"
 	"tokeon-test-task/internal/services/device"
+	"tokeon-test-task/internal/services/events"
+	"tokeon-test-task/internal/services/history"
+	"tokeon-test-task/internal/services/scheduler"
+	"tokeon-test-task/internal/services/upstream"
 	"tokeon-test-task/pkg/log"
 )
 
 type Services struct {
 	deviceService *device.Service
+	historyStore  *history.Store
+	upstream      *upstream.Upstream
+	scheduler     *scheduler.Scheduler
 }
 
-func New(logger log.Logger, config *config.Config) (*Services, error) {
+func New(ctx context.Context, logger log.Logger, config *config.Config) (*Services, error) {
+	var opts []device.Option
+
+	var clusterService *cluster.Cluster
+	if config.Cluster.Enabled {
+		var err error
+		clusterService, err = cluster.New(logger, config.Cluster)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init cluster: %w", err)
+		}
+
+		opts = append(opts, device.WithCluster(clusterService))
+	}
+
+	historyStore, err := history.New(ctx, logger, config.Postgres, config.Tenant.Default)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init history: %w", err)
+	}
+
+	if historyStore.Enabled() {
+		historyStore.Start(ctx)
+		opts = append(opts, device.WithHistory(historyStore))
+	}
+
+	eventWebhooks := events.New(logger, config.Events)
+	if eventWebhooks.Enabled() {
+		eventWebhooks.Start(ctx)
+		opts = append(opts, device.WithEventSubscriber(eventWebhooks))
+	}
+
+	deviceService := device.New(logger, config, opts...)
+	deviceService.Start(ctx)
+
+	if clusterService != nil {
+		if err := clusterService.Start(ctx, deviceService); err != nil {
+			return nil, fmt.Errorf("failed to start cluster: %w", err)
+		}
+
+		logger.Infof("cluster mode enabled, node id: %s", clusterService.NodeID())
+	}
+
+	schedulerService, err := scheduler.New(logger, config, deviceService)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init scheduler: %w", err)
+	}
+
+	schedulerService.Start(ctx)
+
+	upstreamService := upstream.New(logger, config.Upstream)
+	if upstreamService.Enabled() {
+		upstreamService.Start(ctx)
+	}
+
 	return &Services{
-		deviceService: device.New(),
+		deviceService: deviceService,
+		historyStore:  historyStore,
+		upstream:      upstreamService,
+		scheduler:     schedulerService,
 	}, nil
 }
 
 func (s *Services) Device() *device.Service {
 	return s.deviceService
 }
+
+func (s *Services) History() *history.Store {
+	return s.historyStore
+}
+
+func (s *Services) Upstream() *upstream.Upstream {
+	return s.upstream
+}
+
+func (s *Services) Scheduler() *scheduler.Scheduler {
+	return s.scheduler
+}
@@ -0,0 +1,109 @@
+package upstream
+
+import (
+	"context"
+	"time"
+	"tokeon-test-task/internal/config"
+	"tokeon-test-task/pkg/log"
+	"tokeon-test-task/pkg/webhook"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// EventDeviceMessage - webhook event of the message sent by the device
+const EventDeviceMessage = "device.message"
+
+// Message is posted to the webhooks for every frame the device has sent, e.g.
+// {"id":"...","device_id":"...","received_at":"...","tenant":"...","type":"button","data":{"type":"button","id":1}}
+type Message struct {
+	ID         uuid.UUID `json:"id"`
+	DeviceID   uuid.UUID `json:"device_id"`
+	ReceivedAt time.Time `json:"received_at"`
+	// Tenant - tenant the device is connected to
+	Tenant string `json:"tenant"`
+	// Type - type field of the json frame
+	Type string `json:"type,omitempty"`
+	// Data - json frame as is
+	Data json.RawMessage `json:"data,omitempty"`
+	// Text - text frame that is not json
+	Text string `json:"text,omitempty"`
+	// Binary - binary frame, base64 in json
+	Binary []byte `json:"binary,omitempty"`
+}
+
+// Upstream passes messages sent by the devices to the backend webhooks
+type Upstream struct {
+	logger   log.Logger
+	webhooks *webhook.Dispatcher
+}
+
+func New(logger log.Logger, cfg config.UpstreamConfig) *Upstream {
+	return &Upstream{
+		logger:   logger,
+		webhooks: webhook.New(logger, cfg.Webhook()),
+	}
+}
+
+func (u *Upstream) Enabled() bool {
+	return u.webhooks.Enabled()
+}
+
+// Start posts the messages until ctx is done
+func (u *Upstream) Start(ctx context.Context) {
+	u.webhooks.Start(ctx)
+}
+
+// Forward tags the frame with the device id and its tenant and queues it to the webhooks.
+// The frame is only logged if upstream is disabled
+func (u *Upstream) Forward(deviceID uuid.UUID, tenant string, frame []byte, binary bool) {
+	if !u.Enabled() {
+		u.logger.Infof("revieved message from device %s: %s", deviceID, frame)
+		return
+	}
+
+	msg := newMessage(deviceID, tenant, frame, binary)
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		u.logger.Errorf("failed to encode message from device %s: %v", deviceID, err)
+		return
+	}
+
+	u.webhooks.Post(webhook.Request{
+		ID:    msg.ID.String(),
+		Event: EventDeviceMessage,
+		Body:  body,
+	})
+}
+
+func newMessage(deviceID uuid.UUID, tenant string, frame []byte, binary bool) Message {
+	msg := Message{
+		ID:         uuid.New(),
+		Tenant:     tenant,
+		DeviceID:   deviceID,
+		ReceivedAt: time.Now(),
+	}
+
+	if binary {
+		msg.Binary = frame
+		return msg
+	}
+
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if json.Valid(frame) {
+		msg.Data = frame
+		// frame may be any json value, type is taken only from objects
+		if err := json.Unmarshal(frame, &typed); err == nil {
+			msg.Type = typed.Type
+		}
+
+		return msg
+	}
+
+	msg.Text = string(frame)
+
+	return msg
+}
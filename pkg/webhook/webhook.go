@@ -0,0 +1,189 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"tokeon-test-task/pkg/log"
+)
+
+const (
+	// HeaderID - unique id of the request, the same for all attempts
+	HeaderID = "X-Webhook-Id"
+	// HeaderEvent - kind of the posted data
+	HeaderEvent = "X-Webhook-Event"
+	// HeaderTimestamp - unix time of the attempt, part of the signature
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	// HeaderSignature - "sha256=" and hex of HMAC-SHA256 of "<timestamp>.<body>"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+type Config struct {
+	// URLs - webhooks every request is posted to
+	URLs []string
+	// Secret - key of the signature, requests are not signed if empty
+	Secret string
+	// BufferSize - max amount of requests waiting to be posted per webhook
+	BufferSize int
+	// MaxRetries - how many times a failed request is retried
+	MaxRetries int
+	// Backoff - delay before the first retry, doubled on every next one
+	Backoff time.Duration
+	// MaxBackoff - max delay between retries
+	MaxBackoff time.Duration
+	// Timeout - timeout of a single attempt
+	Timeout time.Duration
+}
+
+type Request struct {
+	ID    string
+	Event string
+	// Body - json posted to the webhook
+	Body []byte
+}
+
+type endpoint struct {
+	url      string
+	requests chan Request
+}
+
+// Dispatcher posts requests to the webhooks in background. Every webhook has its own
+// bounded buffer, so a slow webhook doesn't delay the others
+type Dispatcher struct {
+	logger    log.Logger
+	config    Config
+	client    *http.Client
+	endpoints []endpoint
+}
+
+func New(logger log.Logger, cfg Config) *Dispatcher {
+	d := &Dispatcher{
+		logger: logger,
+		config: cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+
+	for _, url := range cfg.URLs {
+		d.endpoints = append(d.endpoints, endpoint{
+			url:      url,
+			requests: make(chan Request, cfg.BufferSize),
+		})
+	}
+
+	return d
+}
+
+func (d *Dispatcher) Enabled() bool {
+	return len(d.endpoints) > 0
+}
+
+// Start posts the requests until ctx is done. Requests left in the buffers are lost
+func (d *Dispatcher) Start(ctx context.Context) {
+	for _, e := range d.endpoints {
+		go func(e endpoint) {
+			for {
+				select {
+				case req := <-e.requests:
+					d.deliver(ctx, e.url, req)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(e)
+	}
+}
+
+// Post queues the request to every webhook. Returns false if the request has been
+// dropped by any of them because its buffer is full
+func (d *Dispatcher) Post(req Request) bool {
+	queued := true
+
+	for _, e := range d.endpoints {
+		select {
+		case e.requests <- req:
+		default:
+			d.logger.Errorf("webhook %s buffer is full, %s request %s is dropped", e.url, req.Event, req.ID)
+			queued = false
+		}
+	}
+
+	return queued
+}
+
+// deliver posts the request retrying with exponential backoff
+func (d *Dispatcher) deliver(ctx context.Context, url string, req Request) {
+	backoff := d.config.Backoff
+
+	for attempt := 0; ; attempt++ {
+		retry, err := d.post(ctx, url, req)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= d.config.MaxRetries {
+			d.logger.Errorf("failed to post %s request %s to %s after %d attempts: %v", req.Event, req.ID, url, attempt+1, err)
+			return
+		}
+
+		d.logger.Warnf("failed to post %s request %s to %s, retry in %s: %v", req.Event, req.ID, url, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff *= 2; backoff > d.config.MaxBackoff {
+			backoff = d.config.MaxBackoff
+		}
+	}
+}
+
+// post makes a single attempt. Returns whether the failed request may be retried
+func (d *Dispatcher) post(ctx context.Context, url string, req Request) (bool, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(req.Body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(HeaderID, req.ID)
+	r.Header.Set(HeaderEvent, req.Event)
+	r.Header.Set(HeaderTimestamp, timestamp)
+	if d.config.Secret != "" {
+		r.Header.Set(HeaderSignature, Sign(d.config.Secret, timestamp, req.Body))
+	}
+
+	resp, err := d.client.Do(r)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+// Sign returns signature of the body, webhooks may check it to verify the sender
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tokeon-test-task/pkg/log"
+)
+
+// Test failed requests are retried and every attempt is signed
+func TestDispatcherRetry(t *testing.T) {
+	var attempts int32
+	done := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if r.Header.Get(HeaderSignature) != Sign("secret", r.Header.Get(HeaderTimestamp), body) {
+			t.Errorf("wrong signature of attempt %d", attempts)
+		}
+
+		if r.Header.Get(HeaderID) != "1" || r.Header.Get(HeaderEvent) != "test" || string(body) != `{"a":1}` {
+			t.Errorf("wrong request: %v %s", r.Header, body)
+		}
+
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		close(done)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := New(log.New(), Config{
+		URLs:       []string{srv.URL},
+		Secret:     "secret",
+		BufferSize: 1,
+		MaxRetries: 5,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		Timeout:    time.Second,
+	})
+	d.Start(ctx)
+
+	if !d.Post(Request{ID: "1", Event: "test", Body: []byte(`{"a":1}`)}) {
+		t.Fatal("request has not been queued")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request has not been delivered, attempts: %d", atomic.LoadInt32(&attempts))
+	}
+}